@@ -0,0 +1,261 @@
+package scala
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An AbletonScale is a scale read from an Ableton Live .ascl file: an SCL file with extra
+// "! @ABL" comment lines, which ScaleFromSCLStream skips like any other comment.
+//
+// REFERENCE_PITCH gives the frequency of the note at an index of the scale in an octave,
+// where octave 3 is the one starting at middle C (MIDI note 60), as in Live.
+type AbletonScale struct {
+	Scale              Scale
+	NoteNames          []string // NOTE_NAMES: the name of each degree of the scale, starting with the root
+	ReferenceOctave    int      // REFERENCE_PITCH octave
+	ReferenceIndex     int      // REFERENCE_PITCH scale index within the octave
+	ReferenceFrequency float64  // REFERENCE_PITCH frequency in Hz; 0 if the file has none
+	Source             string   // SOURCE: where the scale comes from
+	Link               string   // LINK: a URL with more about the scale
+}
+
+// ablPrefix starts the comment lines that hold Ableton directives
+const ablPrefix = "@ABL"
+
+// AbletonScaleFromASCLStream returns an AbletonScale from an .ascl file. Directives that
+// it does not know are skipped, so that newer files can still be read.
+func AbletonScaleFromASCLStream(rdr io.Reader) (ascl AbletonScale, err error) {
+	var doc SCLDocument
+	if doc, ascl.Scale, _, err = parseSCL(rdr, ParseOptions{}); err != nil {
+		return
+	}
+	for i, line := range doc.Lines {
+		if line.Role != LineComment {
+			continue
+		}
+		fields := strings.TrimSpace(strings.TrimPrefix(line.Text, "!"))
+		if !strings.HasPrefix(fields, ablPrefix+" ") {
+			continue
+		}
+		if err = ascl.directive(strings.TrimSpace(fields[len(ablPrefix):]), i+1, line.Text); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// AbletonScaleFromASCLFile returns an AbletonScale from the .ascl file fname
+func AbletonScaleFromASCLFile(fname string) (ascl AbletonScale, err error) {
+	var file *os.File
+	if file, err = os.Open(fname); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", fname)
+		return
+	}
+	defer file.Close()
+	if ascl, err = AbletonScaleFromASCLStream(file); err != nil {
+		err = errors.Wrapf(withFile(err, fname), "Unable to parse file '%s'", fname)
+		return
+	}
+	ascl.Scale.Name = fname
+	return
+}
+
+// AbletonScaleFromASCLString returns an AbletonScale from the .ascl file contents in memory
+func AbletonScaleFromASCLString(asclContents string) (ascl AbletonScale, err error) {
+	if ascl, err = AbletonScaleFromASCLStream(strings.NewReader(asclContents)); err != nil {
+		return
+	}
+	ascl.Scale.Name = "Scale from patch"
+	return
+}
+
+// splitABLArgs splits the arguments of a directive at spaces, except within double
+// quotes. A backslash within quotes escapes the next character.
+func splitABLArgs(s string) (args []string, ok bool) {
+	var arg strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quoted || escaped {
+		return
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	ok = true
+	return
+}
+
+// directive records one "! @ABL" line
+func (ascl *AbletonScale) directive(text string, lineno int, line string) (err error) {
+	name := text
+	rest := ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		name, rest = text[:i], text[i+1:]
+	}
+	args, ok := splitABLArgs(rest)
+	if !ok {
+		return newParseError(KindBadHeader, lineno, line, rest, nil, "Unterminated quote in "+name)
+	}
+	expect := func(n int) error {
+		if len(args) != n {
+			return newParseError(KindBadHeader, lineno, line, rest, nil,
+				fmt.Sprintf("%s must have %d values", name, n))
+		}
+		return nil
+	}
+	switch name {
+	case "NOTE_NAMES":
+		ascl.NoteNames = args
+	case "REFERENCE_PITCH":
+		if err = expect(3); err != nil {
+			return
+		}
+		var e error
+		if ascl.ReferenceOctave, e = strconv.Atoi(args[0]); e != nil {
+			return newParseError(KindBadHeader, lineno, line, args[0], e, "Invalid REFERENCE_PITCH octave")
+		}
+		if ascl.ReferenceIndex, e = strconv.Atoi(args[1]); e != nil || ascl.ReferenceIndex < 0 {
+			return newParseError(KindBadHeader, lineno, line, args[1], e, "Invalid REFERENCE_PITCH index")
+		}
+		if ascl.ReferenceFrequency, e = strconv.ParseFloat(args[2], 64); e != nil || !(ascl.ReferenceFrequency > 0) {
+			return newParseError(KindBadHeader, lineno, line, args[2], e, "Invalid REFERENCE_PITCH frequency")
+		}
+	case "SOURCE":
+		if err = expect(1); err != nil {
+			return
+		}
+		ascl.Source = args[0]
+	case "LINK":
+		if err = expect(1); err != nil {
+			return
+		}
+		ascl.Link = args[0]
+	}
+	return
+}
+
+// ReferenceNote returns the MIDI note of the reference pitch, where the scale starts on
+// middle C in octave 3
+func (ascl AbletonScale) ReferenceNote() int {
+	return 60 + (ascl.ReferenceOctave-3)*ascl.Scale.Count + ascl.ReferenceIndex
+}
+
+// KeyboardMapping returns a linear mapping which starts the scale on middle C and tunes
+// the reference note to the reference frequency. Without a reference pitch middle C
+// is tuned to its standard frequency.
+func (ascl AbletonScale) KeyboardMapping() (kbm KeyboardMapping, err error) {
+	if ascl.ReferenceFrequency == 0 {
+		kbm, err = KeyboardMappingStandard()
+		return
+	}
+	kbm, err = KeyboardMappingStartScaleOnAndTuneNoteTo(60, ascl.ReferenceNote(), ascl.ReferenceFrequency)
+	return
+}
+
+// Tuning returns the tuning of the scale with the mapping of KeyboardMapping
+func (ascl AbletonScale) Tuning() (t Tuning, err error) {
+	var kbm KeyboardMapping
+	if kbm, err = ascl.KeyboardMapping(); err != nil {
+		return
+	}
+	if t, err = TuningFromSCLAndKBM(ascl.Scale, kbm); err != nil {
+		return
+	}
+	return
+}
+
+// AbletonScaleFromSCLAndKBM returns an AbletonScale whose reference pitch is the tuning
+// note of kbm. An .ascl file has no keyboard mapping of its own, so kbm must map the scale
+// in order: it must have a map size of 0, or map each key to the degree of the same number.
+func AbletonScaleFromSCLAndKBM(s Scale, kbm KeyboardMapping) (ascl AbletonScale, err error) {
+	if s.Count <= 0 {
+		err = errors.Errorf("Unable to write a scale with no notes. Your scale provided %v notes.", s.Count)
+		return
+	}
+	if kbm.Count > 0 {
+		if kbm.Count != s.Count {
+			err = errors.Errorf("Mapping of size %d does not map scale of %d notes in order", kbm.Count, s.Count)
+			return
+		}
+		for i, key := range kbm.Keys {
+			if key != i {
+				err = errors.Errorf("Mapping of key %d to degree %d does not map the scale in order", i, key)
+				return
+			}
+		}
+	}
+	ascl.Scale = s
+	d := kbm.TuningConstantNote - kbm.MiddleNote
+	octaves := int(math.Floor(float64(d) / float64(s.Count)))
+	ascl.ReferenceOctave = 3 + octaves
+	ascl.ReferenceIndex = d - octaves*s.Count
+	ascl.ReferenceFrequency = kbm.TuningFrequency
+	return
+}
+
+// quoteABL quotes a directive argument
+func quoteABL(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// WriteASCL writes the scale to w as an .ascl file: the SCL file of WriteSCL followed by
+// a "! @ABL" line for each of the directives that has a value
+func (ascl AbletonScale) WriteASCL(w io.Writer) (err error) {
+	for _, s := range append([]string{ascl.Source, ascl.Link}, ascl.NoteNames...) {
+		if strings.ContainsAny(s, "\r\n") {
+			err = errors.Errorf("Ableton directive must be a single line: \"%s\"", s)
+			return
+		}
+	}
+	bw := bufio.NewWriter(w)
+	if err = ascl.Scale.WriteSCL(bw); err != nil {
+		return
+	}
+	fmt.Fprintf(bw, "!\n")
+	if len(ascl.NoteNames) > 0 {
+		quoted := make([]string, len(ascl.NoteNames))
+		for i, n := range ascl.NoteNames {
+			quoted[i] = quoteABL(n)
+		}
+		fmt.Fprintf(bw, "! %s NOTE_NAMES %s\n", ablPrefix, strings.Join(quoted, " "))
+	}
+	if ascl.ReferenceFrequency > 0 {
+		fmt.Fprintf(bw, "! %s REFERENCE_PITCH %d %d %s\n", ablPrefix, ascl.ReferenceOctave, ascl.ReferenceIndex,
+			strconv.FormatFloat(ascl.ReferenceFrequency, 'f', -1, 64))
+	}
+	if ascl.Source != "" {
+		fmt.Fprintf(bw, "! %s SOURCE %s\n", ablPrefix, quoteABL(ascl.Source))
+	}
+	if ascl.Link != "" {
+		fmt.Fprintf(bw, "! %s LINK %s\n", ablPrefix, quoteABL(ascl.Link))
+	}
+	err = bw.Flush()
+	return
+}
@@ -0,0 +1,106 @@
+package scala
+
+import (
+	"gotest.tools/v3/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+// ASCL - directives
+func TestASCLParse(t *testing.T) {
+	ascl, err := AbletonScaleFromASCLFile(testFile("meantone.ascl"))
+	assert.NilError(t, err)
+	assert.Equal(t, ascl.Scale.Count, 12)
+	assert.Equal(t, ascl.Scale.Description, "Quarter-comma meantone")
+	assert.DeepEqual(t, ascl.NoteNames, []string{"C", "C#", "D", "Eb", "E", "F", "F#", "G", "G#", "A", "Bb", "B"})
+	assert.Equal(t, ascl.ReferenceOctave, 3)
+	assert.Equal(t, ascl.ReferenceIndex, 9)
+	assert.Equal(t, ascl.ReferenceFrequency, 440.0)
+	assert.Equal(t, ascl.ReferenceNote(), 69)
+	assert.Equal(t, ascl.Source, `Pietro Aron, "Toscanello" (1523)`)
+	assert.Equal(t, ascl.Link, "https://en.wikipedia.org/wiki/Quarter-comma_meantone")
+
+	tuning, err := ascl.Tuning()
+	assert.NilError(t, err)
+	assert.Equal(t, "", approxEqual(1e-9, tuning.FrequencyForMidiNote(69), 440))
+	assert.Equal(t, "", approxEqual(1e-6, tuning.FrequencyForMidiNote(64), 440*1.25/math.Pow(2, 889.73529/1200)))
+
+	// the same file read as SCL
+	s, err := ScaleFromSCLFile(testFile("meantone.ascl"))
+	assert.NilError(t, err)
+	assert.Equal(t, s.RawText, ascl.Scale.RawText)
+	assert.Equal(t, s.Count, ascl.Scale.Count)
+}
+
+// ASCL - a file without directives is a plain scale at standard pitch
+func TestASCLPlain(t *testing.T) {
+	ascl, err := AbletonScaleFromASCLString("plain\n1\n2/1\n")
+	assert.NilError(t, err)
+	assert.Equal(t, ascl.ReferenceFrequency, 0.0)
+	k, err := ascl.KeyboardMapping()
+	assert.NilError(t, err)
+	assert.Equal(t, "", approxEqual(1e-3, k.TuningFrequency, 261.626))
+}
+
+// ASCL - errors
+func TestASCLErrors(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		msg  string
+	}{
+		{"! @ABL REFERENCE_PITCH 3 9\nx\n1\n2/1\n", "must have 3 values"},
+		{"! @ABL REFERENCE_PITCH three 9 440\nx\n1\n2/1\n", "octave"},
+		{"! @ABL REFERENCE_PITCH 3 -1 440\nx\n1\n2/1\n", "index"},
+		{"! @ABL REFERENCE_PITCH 3 9 0\nx\n1\n2/1\n", "frequency"},
+		{"x\n1\n2/1\n! @ABL SOURCE \"open\n", "Unterminated quote"},
+		{"x\n1\n2/1\n! @ABL LINK a b\n", "must have 1 values"},
+	} {
+		_, err := AbletonScaleFromASCLString(c.text)
+		assert.ErrorContains(t, err, c.msg)
+		assert.Equal(t, parseErrorOf(t, err).Kind, KindBadHeader)
+	}
+	ascl, err := AbletonScaleFromASCLString("x\n1\n2/1\n! @ABL FUTURE_DIRECTIVE 1 2 3\n")
+	assert.NilError(t, err)
+	assert.Equal(t, ascl.Scale.Count, 1)
+}
+
+// ASCL - writing from a scale and mapping
+func TestWriteASCL(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingTuneNoteTo(50, 300)
+	assert.NilError(t, err)
+	ascl, err := AbletonScaleFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+	assert.Equal(t, ascl.ReferenceOctave, 2)
+	assert.Equal(t, ascl.ReferenceIndex, 21)
+	ascl.NoteNames = []string{`say "hi"`, `back\slash`}
+	ascl.Source = "Test"
+
+	var buf strings.Builder
+	assert.NilError(t, ascl.WriteASCL(&buf))
+	assert.Assert(t, strings.Contains(buf.String(), "! @ABL REFERENCE_PITCH 2 21 300\n"))
+	assert.Assert(t, strings.Contains(buf.String(), `! @ABL NOTE_NAMES "say \"hi\"" "back\\slash"`+"\n"))
+	back, err := AbletonScaleFromASCLString(buf.String())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, back.NoteNames, ascl.NoteNames)
+	assert.Equal(t, back.Source, "Test")
+	assert.Equal(t, back.Link, "")
+
+	t1, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+	t2, err := back.Tuning()
+	assert.NilError(t, err)
+	sameTuning(t, t2, t1, -256, 255)
+
+	k, err = KeyboardMappingFromKBMFile(testFile("mapping-whitekeys-c261.kbm"))
+	assert.NilError(t, err)
+	s, err = ScaleEvenTemperment12NoteScale()
+	assert.NilError(t, err)
+	_, err = AbletonScaleFromSCLAndKBM(s, k)
+	assert.ErrorContains(t, err, "in order")
+
+	ascl.Source = "two\nlines"
+	assert.ErrorContains(t, ascl.WriteASCL(&buf), "single line")
+}
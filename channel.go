@@ -0,0 +1,179 @@
+package scala
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+)
+
+// A ChannelTuning tunes the notes of all 16 MIDI channels, for instruments that address
+// more than 128 pitches by channel and note. Each channel is a Tuning: either an offset
+// into the degrees of one large scale, so that the scale plays seamlessly across channels,
+// or a KeyboardMapping of its own.
+//
+// Like Tuning, a ChannelTuning does not change once constructed. The zero ChannelTuning
+// tunes every channel to standard tuning, with degree 0 of the scale at middle C.
+type ChannelTuning struct {
+	scale   Scale
+	tunings [16]Tuning
+	bases   [16]int // the degree of the scale at the middle note of each channel's mapping
+}
+
+var standardChannels struct {
+	once sync.Once
+	ct   ChannelTuning
+}
+
+// orStandard returns ct, or standard tuning on every channel if ct is the zero ChannelTuning
+func (ct ChannelTuning) orStandard() ChannelTuning {
+	if ct.scale.Count > 0 {
+		return ct
+	}
+	standardChannels.once.Do(func() {
+		var offsets [16]int
+		for ch := range offsets {
+			offsets[ch] = -60
+		}
+		s, err := ScaleEvenTemperment12NoteScale()
+		if err == nil {
+			standardChannels.ct, err = ChannelTuningFromOffsets(s, 0, offsets)
+		}
+		if err != nil {
+			panic(err)
+		}
+	})
+	return standardChannels.ct
+}
+
+// ContiguousChannelOffsets returns offsets for ChannelTuningFromOffsets that continue the
+// degrees of the scale from note 127 of each channel to note 0 of the next, starting with
+// degree lowest at note 0 of channel 0
+func ContiguousChannelOffsets(lowest int) (offsets [16]int) {
+	for ch := range offsets {
+		offsets[ch] = lowest + 128*ch
+	}
+	return
+}
+
+// ChannelTuningFromOffsets returns a ChannelTuning in which note n of channel ch plays
+// degree n + offsets[ch] of s, counting periods, where degree 0 is tuned to frequency,
+// or to middle C of standard tuning if frequency is 0
+func ChannelTuningFromOffsets(s Scale, frequency float64, offsets [16]int) (ct ChannelTuning, err error) {
+	if s.Count <= 0 {
+		err = &TuningError{Kind: KindEmptyScale,
+			Msg: fmt.Sprintf("Unable to tune to a scale with no notes. Your scale provided %v notes.", s.Count)}
+		return
+	}
+	if frequency == 0 {
+		frequency = midi0Freq * 32.0
+	}
+	ct.scale = s
+	for ch, offset := range offsets {
+		// the mapping starts the scale on the first note of the channel that plays
+		// degree 0 of a period
+		start := ((-offset)%s.Count + s.Count) % s.Count
+		ct.bases[ch] = offset + start
+		var k KeyboardMapping
+		if k, err = KeyboardMappingStartScaleOnAndTuneNoteTo(start, start, frequency*math.Pow(2.0, degreeCents(s, ct.bases[ch])/1200.0)); err != nil {
+			return
+		}
+		if ct.tunings[ch], err = TuningFromSCLAndKBM(s, k); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// WithChannelMapping returns a copy of ct in which channel ch is tuned by the scale with its
+// own mapping k. The degrees of the channel are counted from the middle note of k.
+func (ct ChannelTuning) WithChannelMapping(ch int, k KeyboardMapping) (res ChannelTuning, err error) {
+	ct = ct.orStandard()
+	if ch < 0 || ch > 15 {
+		err = errors.Errorf("MIDI channel must be in 0..15: %d", ch)
+		return
+	}
+	var t Tuning
+	if t, err = TuningFromSCLAndKBM(ct.scale, k); err != nil {
+		return
+	}
+	res = ct
+	res.tunings[ch] = t
+	res.bases[ch] = 0
+	return
+}
+
+// Scale returns the scale of all the channels
+func (ct ChannelTuning) Scale() Scale {
+	return ct.orStandard().scale
+}
+
+// Channel returns the Tuning of channel ch 0..15
+func (ct ChannelTuning) Channel(ch int) Tuning {
+	return ct.orStandard().tunings[ch]
+}
+
+// FrequencyForChannelNote returns the frequency in Hz of note on channel ch 0..15
+func (ct ChannelTuning) FrequencyForChannelNote(ch int, note int) float64 {
+	return ct.Channel(ch).FrequencyForMidiNote(note)
+}
+
+// ScalePositionForChannelNote returns the position in the scale, 0..Count-1, of note on
+// channel ch 0..15, or -1 if it is unmapped
+func (ct ChannelTuning) ScalePositionForChannelNote(ch int, note int) int {
+	return ct.Channel(ch).ScalePositionForMidiNote(note)
+}
+
+// IsChannelNoteMapped reports whether note on channel ch 0..15 is mapped
+func (ct ChannelTuning) IsChannelNoteMapped(ch int, note int) bool {
+	return ct.Channel(ch).IsMidiNoteMapped(note)
+}
+
+// DegreeForChannelNote returns the degree of the scale, counting periods, that note on
+// channel ch 0..15 plays. ok is false if the note is unmapped.
+func (ct ChannelTuning) DegreeForChannelNote(ch int, note int) (d int, ok bool) {
+	ct = ct.orStandard()
+	k := ct.tunings[ch].KeyboardMapping()
+	rounds, thisRound, disable := scaleStep(ct.scale, k, note-k.MiddleNote)
+	if disable {
+		return
+	}
+	d = ct.bases[ch] + rounds*ct.scale.Count + thisRound + 1
+	ok = true
+	return
+}
+
+// ChannelNoteForDegree returns the lowest channel, and the note 0..127 on it, that plays
+// degree d of the scale. ok is false if no note does.
+func (ct ChannelTuning) ChannelNoteForDegree(d int) (ch int, note int, ok bool) {
+	for ch = 0; ch < 16; ch++ {
+		for note = 0; note < 128; note++ {
+			if nd, mapped := ct.DegreeForChannelNote(ch, note); mapped && nd == d {
+				ok = true
+				return
+			}
+		}
+	}
+	ch, note = 0, 0
+	return
+}
+
+// ChannelNoteForFrequency returns the channel and note 0..127 whose frequency is nearest to
+// freq, preferring the lowest channel and note, and the difference in cents of the note
+// from freq
+func (ct ChannelTuning) ChannelNoteForFrequency(freq float64) (ch int, note int, cents float64) {
+	ct = ct.orStandard()
+	cents = math.Inf(1)
+	for c := 0; c < 16; c++ {
+		for n := 0; n < 128; n++ {
+			if !ct.tunings[c].IsMidiNoteMapped(n) {
+				continue
+			}
+			diff := 1200.0 * math.Log2(ct.tunings[c].FrequencyForMidiNote(n)/freq)
+			if math.Abs(diff) < math.Abs(cents) {
+				ch, note, cents = c, n, diff
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package scala
+
+import (
+	"gotest.tools/v3/assert"
+	"math"
+	"testing"
+)
+
+// Channel - 31-EDO continuing across channels
+func TestChannelTuningContiguous(t *testing.T) {
+	s, err := ScaleEvenDivisionOfSpanByM(2, 31)
+	assert.NilError(t, err)
+	ct, err := ChannelTuningFromOffsets(s, 0, ContiguousChannelOffsets(-200))
+	assert.NilError(t, err)
+	for ch := 0; ch < 4; ch++ {
+		for note := 0; note < 128; note++ {
+			d := -200 + 128*ch + note
+			want := midi0Freq * 32.0 * math.Pow(2.0, float64(d)/31.0)
+			assert.Equal(t, "", approxEqual(1e-9*want, ct.FrequencyForChannelNote(ch, note), want), d)
+			assert.Equal(t, ct.ScalePositionForChannelNote(ch, note), ((d%31)+31)%31, d)
+			dd, ok := ct.DegreeForChannelNote(ch, note)
+			assert.Assert(t, ok)
+			assert.Equal(t, dd, d)
+			assert.Assert(t, ct.IsChannelNoteMapped(ch, note))
+		}
+	}
+	// seamless from the top of one channel to the bottom of the next
+	assert.Equal(t, "", approxEqual(1e-9, ct.FrequencyForChannelNote(2, 0)/ct.FrequencyForChannelNote(1, 127), math.Pow(2.0, 1.0/31.0)))
+
+	ch, note, ok := ct.ChannelNoteForDegree(0)
+	assert.Assert(t, ok)
+	assert.Equal(t, ch, 1)
+	assert.Equal(t, note, 72)
+	_, _, ok = ct.ChannelNoteForDegree(-201)
+	assert.Assert(t, !ok)
+
+	ch, note, cents := ct.ChannelNoteForFrequency(440.0)
+	d, _ := ct.DegreeForChannelNote(ch, note)
+	assert.Equal(t, d, 23)
+	assert.Equal(t, "", approxEqual(1e-6, cents, 1200.0*23.0/31.0-900.0))
+}
+
+// Channel - the zero ChannelTuning is standard tuning on every channel
+func TestChannelTuningZero(t *testing.T) {
+	var ct ChannelTuning
+	assert.Equal(t, ct.Scale().Count, 12)
+	assert.Equal(t, "", approxEqual(1e-9, ct.FrequencyForChannelNote(15, 69), 440.0))
+	assert.Equal(t, ct.Channel(3).Scale().Count, 12)
+	assert.Equal(t, ct.ScalePositionForChannelNote(0, 62), 2)
+	assert.Assert(t, ct.IsChannelNoteMapped(9, 0))
+	d, ok := ct.DegreeForChannelNote(5, 72)
+	assert.Assert(t, ok)
+	assert.Equal(t, d, 12)
+	ch, note, ok := ct.ChannelNoteForDegree(12)
+	assert.Assert(t, ok)
+	assert.Equal(t, ch, 0)
+	assert.Equal(t, note, 72)
+	_, note, cents := ct.ChannelNoteForFrequency(440.0)
+	assert.Equal(t, note, 69)
+	assert.Equal(t, "", approxEqual(1e-9, cents, 0))
+
+	k, err := KeyboardMappingTuneNoteTo(69, 432)
+	assert.NilError(t, err)
+	ct, err = ct.WithChannelMapping(1, k)
+	assert.NilError(t, err)
+	assert.Equal(t, "", approxEqual(1e-9, ct.FrequencyForChannelNote(1, 69), 432.0))
+	assert.Equal(t, "", approxEqual(1e-9, ct.FrequencyForChannelNote(0, 69), 440.0))
+}
+
+// Channel - offsets which overlap, non-octave scales and a tuned degree 0
+func TestChannelTuningOffsets(t *testing.T) {
+	bp, err := ScaleEvenDivisionOfSpanByM(3, 13)
+	assert.NilError(t, err)
+	var offsets [16]int
+	for ch := range offsets {
+		offsets[ch] = 13*ch - 60
+	}
+	ct, err := ChannelTuningFromOffsets(bp, 220.0, offsets)
+	assert.NilError(t, err)
+	assert.Equal(t, ct.Scale().Count, 13)
+	assert.Equal(t, "", approxEqual(1e-9, ct.FrequencyForChannelNote(0, 60), 220.0))
+	assert.Equal(t, "", approxEqual(1e-9, ct.FrequencyForChannelNote(1, 60), 660.0))
+	assert.Equal(t, "", approxEqual(1e-9, ct.FrequencyForChannelNote(1, 47), 220.0))
+	ch, note, ok := ct.ChannelNoteForDegree(13)
+	assert.Assert(t, ok)
+	assert.Equal(t, ch, 0)
+	assert.Equal(t, note, 73)
+}
+
+// Channel - a channel with its own mapping
+func TestChannelTuningWithMapping(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("12-intune.scl"))
+	assert.NilError(t, err)
+	ct, err := ChannelTuningFromOffsets(s, 0, ContiguousChannelOffsets(-60))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingFromKBMFile(testFile("mapping-whitekeys-c261.kbm"))
+	assert.NilError(t, err)
+	mapped, err := ct.WithChannelMapping(9, k)
+	assert.NilError(t, err)
+
+	whiteKeys, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+	for note := 0; note < 128; note++ {
+		assert.Equal(t, mapped.FrequencyForChannelNote(9, note), whiteKeys.FrequencyForMidiNote(note))
+		assert.Equal(t, mapped.IsChannelNoteMapped(9, note), whiteKeys.IsMidiNoteMapped(note))
+		d, ok := mapped.DegreeForChannelNote(9, note)
+		assert.Equal(t, ok, whiteKeys.IsMidiNoteMapped(note))
+		if ok {
+			assert.Equal(t, ((d%12)+12)%12, whiteKeys.ScalePositionForMidiNote(note), note)
+			assert.Equal(t, "", approxEqual(1e-6, whiteKeys.FrequencyForMidiNote(note),
+				whiteKeys.FrequencyForMidiNote(60)*math.Pow(2.0, float64(d)/12.0)), note)
+		}
+		// other channels are untouched
+		assert.Equal(t, mapped.FrequencyForChannelNote(8, note), ct.FrequencyForChannelNote(8, note))
+	}
+	assert.Assert(t, ct.FrequencyForChannelNote(9, 61) != mapped.FrequencyForChannelNote(9, 61))
+
+	_, err = ct.WithChannelMapping(16, k)
+	assert.ErrorContains(t, err, "0..15")
+	_, err = ChannelTuningFromOffsets(Scale{}, 0, [16]int{})
+	assert.ErrorContains(t, err, "no notes")
+}
+
+// Channel - the tunings of isomorphic and Lumatone layouts
+func TestChannelTuningOfLayouts(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	layout, err := LumatoneLayoutFromScale(s, LumatoneOptions{RightStep: 5, DownRightStep: 3})
+	assert.NilError(t, err)
+	ct := layout.ChannelTuning()
+	assert.Equal(t, ct.Scale().Count, 31)
+	// the degrees of the channel tuning count from a different note, but step with the keys
+	d0, ok := ct.DegreeForChannelNote(layout.Keys[0].Channel, layout.Keys[0].Note)
+	assert.Assert(t, ok)
+	for _, k := range layout.Keys {
+		assert.Equal(t, ct.FrequencyForChannelNote(k.Channel, k.Note), layout.Tunings[k.Channel].FrequencyForMidiNote(k.Note))
+		d, ok := ct.DegreeForChannelNote(k.Channel, k.Note)
+		assert.Assert(t, ok)
+		assert.Equal(t, d-d0, k.Degree-layout.Keys[0].Degree)
+	}
+
+	m, err := JankoLayout(GridSquare, 1).Map(s, 0, []GridKey{{0, 0}, {0, 200}})
+	assert.NilError(t, err)
+	assert.Equal(t, len(m.Tunings), 4)
+	assert.Equal(t, m.ChannelTuning().FrequencyForChannelNote(3, 16), m.Keys[1].Frequency)
+}
@@ -0,0 +1,132 @@
+// Command smftune embeds MIDI Tuning Standard messages in a Standard MIDI File, so that
+// MTS-capable synths play the file in its tuning.
+//
+// Usage:
+//
+//	smftune [flags] in.mid TICK=TUNING ...
+//
+// Each TUNING takes effect at TICK, and is an SCL file, an SCL and KBM file separated by a
+// comma, or an AnaMark .tun file. For example:
+//
+//	smftune -o out.mid in.mid 0=meantone.scl,a432.kbm 1920=31edo.scl
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/chinenual/go-scala"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "smftune: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command with args, writing usage to stderr
+func run(args []string, stderr io.Writer) (err error) {
+	flags := flag.NewFlagSet("smftune", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	output := flags.String("o", "", "the output file; by default the input file with -mts added to its name")
+	single := flags.Bool("single", false, "send single note tuning changes rather than bulk dumps")
+	track := flags.Int("track", 0, "the track that holds the tuning messages")
+	device := flags.Int("device", scala.MTSAllDevices, "the MTS device ID")
+	program := flags.Int("program", 0, "the MTS tuning program")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: smftune [flags] in.mid TICK=TUNING ...\n\n"+
+			"TUNING is an SCL file, an SCL and KBM file separated by a comma, or a .tun file\n\n")
+		flags.PrintDefaults()
+	}
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() < 2 {
+		flags.Usage()
+		err = errors.New("Need an input file and at least one tuning")
+		return
+	}
+
+	in := flags.Arg(0)
+	var smf scala.SMF
+	if smf, err = scala.SMFFromFile(in); err != nil {
+		return
+	}
+	var tunings []scala.TimedTuning
+	for _, spec := range flags.Args()[1:] {
+		var tt scala.TimedTuning
+		if tt, err = parseTimedTuning(spec); err != nil {
+			return
+		}
+		tunings = append(tunings, tt)
+	}
+	opts := scala.EmbedMTSOptions{
+		MTS:        scala.MTSOptions{DeviceID: *device, Program: *program},
+		SingleNote: *single,
+		Track:      *track,
+	}
+	var out scala.SMF
+	if out, err = scala.EmbedMTS(smf, tunings, opts); err != nil {
+		return
+	}
+
+	fname := *output
+	if fname == "" {
+		ext := filepath.Ext(in)
+		fname = strings.TrimSuffix(in, ext) + "-mts" + ext
+	}
+	var file *os.File
+	if file, err = os.Create(fname); err != nil {
+		err = errors.Wrapf(err, "Unable to create file '%s'", fname)
+		return
+	}
+	if err = out.WriteSMF(file); err != nil {
+		file.Close()
+		return
+	}
+	err = file.Close()
+	return
+}
+
+// parseTimedTuning parses a TICK=TUNING argument
+func parseTimedTuning(spec string) (tt scala.TimedTuning, err error) {
+	eq := strings.Index(spec, "=")
+	if eq < 0 {
+		err = errors.Errorf("Tuning '%s' must be TICK=TUNING", spec)
+		return
+	}
+	if tt.Tick, err = strconv.ParseInt(spec[:eq], 10, 64); err != nil {
+		err = errors.Wrapf(err, "Invalid tick in '%s'", spec)
+		return
+	}
+	files := strings.Split(spec[eq+1:], ",")
+	switch {
+	case len(files) == 1 && strings.EqualFold(filepath.Ext(files[0]), ".tun"):
+		tt.Tuning, err = scala.TuningFromTUNFile(files[0])
+	case len(files) == 1:
+		var s scala.Scale
+		if s, err = scala.ScaleFromSCLFile(files[0]); err != nil {
+			return
+		}
+		tt.Tuning, err = scala.TuningFromSCL(s)
+	case len(files) == 2:
+		var s scala.Scale
+		var k scala.KeyboardMapping
+		if s, err = scala.ScaleFromSCLFile(files[0]); err != nil {
+			return
+		}
+		if k, err = scala.KeyboardMappingFromKBMFile(files[1]); err != nil {
+			return
+		}
+		tt.Tuning, err = scala.TuningFromSCLAndKBM(s, k)
+	default:
+		err = errors.Errorf("Tuning '%s' must be an SCL file, SCL and KBM files, or a .tun file", spec)
+	}
+	return
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"github.com/chinenual/go-scala"
+	"gotest.tools/v3/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func testFile(f string) string {
+	return filepath.Join("..", "..", "testdata", f)
+}
+
+// smftune - tunings from the command line
+func TestParseTimedTuning(t *testing.T) {
+	tt, err := parseTimedTuning("960=" + testFile("31edo.scl"))
+	assert.NilError(t, err)
+	assert.Equal(t, tt.Tick, int64(960))
+	assert.Equal(t, tt.Tuning.Scale().Count, 31)
+
+	tt, err = parseTimedTuning("0=" + testFile("12-intune.scl") + "," + testFile("mapping-a442-7-to-12.kbm"))
+	assert.NilError(t, err)
+	assert.Equal(t, tt.Tuning.KeyboardMapping().TuningFrequency, 442.0)
+
+	tt, err = parseTimedTuning("10=" + testFile("tun/31edo-exact.tun"))
+	assert.NilError(t, err)
+	assert.Equal(t, tt.Tick, int64(10))
+
+	for _, spec := range []string{"31edo.scl", "x=" + testFile("31edo.scl"), "0=a.scl,b.kbm,c.kbm", "0=" + testFile("missing.scl")} {
+		_, err = parseTimedTuning(spec)
+		assert.Assert(t, err != nil, spec)
+	}
+}
+
+// smftune - embedding tunings in a file
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	smf := scala.SMF{Format: 0, Division: 96, Tracks: [][]scala.SMFEvent{{
+		{Tick: 0, Data: []byte{0x90, 60, 100}},
+		{Tick: 96, Data: []byte{0x80, 60, 0}},
+	}}}
+	var buf bytes.Buffer
+	assert.NilError(t, smf.WriteSMF(&buf))
+	in := filepath.Join(dir, "song.mid")
+	assert.NilError(t, ioutil.WriteFile(in, buf.Bytes(), 0644))
+
+	var stderr bytes.Buffer
+	assert.NilError(t, run([]string{"-single", in, "0=" + testFile("31edo.scl"), "48=" + testFile("12-intune.scl")}, &stderr))
+	out, err := scala.SMFFromFile(filepath.Join(dir, "song-mts.mid"))
+	assert.NilError(t, err)
+	var sysex []int64
+	for _, e := range out.Tracks[0] {
+		if e.IsSysEx() {
+			sysex = append(sysex, e.Tick)
+		}
+	}
+	assert.DeepEqual(t, sysex, []int64{0, 0, 48, 48})
+
+	outName := filepath.Join(dir, "bulk.mid")
+	assert.NilError(t, run([]string{"-o", outName, "-program", "5", in, "0=" + testFile("31edo.scl")}, &stderr))
+	out, err = scala.SMFFromFile(outName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, out.Tracks[0][0].Data[:6], []byte{0xF0, 0x7E, 0x7F, 0x08, 0x01, 0x05})
+
+	assert.ErrorContains(t, run([]string{in}, &stderr), "at least one tuning")
+	assert.Assert(t, bytes.Contains(stderr.Bytes(), []byte("Usage")))
+	assert.ErrorContains(t, run([]string{"-track", "1", in, "0=" + testFile("31edo.scl")}, &stderr), "no track 1")
+}
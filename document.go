@@ -0,0 +1,468 @@
+package scala
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LineRole records the part a line plays in an SCL or KBM file
+type LineRole int
+
+const (
+	// LineComment for lines starting with '!'
+	LineComment LineRole = iota
+	// LineBlank for empty lines which the parser skips
+	LineBlank
+	// LineDescription for the description line of an SCL file
+	LineDescription
+	// LineCount for the note count line of an SCL file
+	LineCount
+	// LineTone for a tone of an SCL file. Index is the position in Scale.Tones
+	LineTone
+	// LineHeader for one of the seven header fields of a KBM file. Index is a KBMField
+	LineHeader
+	// LineKey for a key of a KBM file. Index is the position in KeyboardMapping.Keys
+	LineKey
+	// LineTrailing for any text found after the last tone or key
+	LineTrailing
+	// LineInvalid for a line skipped by ParseLenient because it could not be parsed
+	LineInvalid
+)
+
+// KBMField identifies one of the header fields of a KBM file, in file order
+type KBMField int
+
+const (
+	// KBMMapSize is the size of the map (KeyboardMapping.Count)
+	KBMMapSize KBMField = iota
+	// KBMFirstMidi is the first MIDI note to retune
+	KBMFirstMidi
+	// KBMLastMidi is the last MIDI note to retune
+	KBMLastMidi
+	// KBMMiddleNote is the note where the first entry of the mapping is mapped to
+	KBMMiddleNote
+	// KBMReferenceNote is the note for which the frequency is given
+	KBMReferenceNote
+	// KBMReferenceFrequency is the frequency of the reference note
+	KBMReferenceFrequency
+	// KBMOctaveDegree is the scale degree to consider as the formal octave
+	KBMOctaveDegree
+)
+
+// A DocumentLine is a single line of an SCL or KBM file.
+type DocumentLine struct {
+	Role  LineRole
+	Index int    // tone, key or header field index, depending on Role
+	Text  string // the text of the line, without the line ending
+	EOL   string // the line ending: "\n", "\r\n" or "" on a final unterminated line
+}
+
+// An SCLDocument is the line by line representation of an SCL file.  Unlike
+// Scale, it keeps every comment, blank line and line ending of the original
+// file, so a tone or the description can be edited and the file written back
+// with everything else intact.
+//
+// Lines are held as UTF-8, and written back in the Encoding of the original file.
+type SCLDocument struct {
+	Lines    []DocumentLine
+	Encoding Encoding
+}
+
+// A KBMDocument is the line by line representation of a KBM file. See SCLDocument.
+type KBMDocument struct {
+	Lines    []DocumentLine
+	Encoding Encoding
+}
+
+// splitEOL separates a line returned by a lineReader into the text and its line ending
+func splitEOL(token string) (text string, eol string) {
+	switch {
+	case strings.HasSuffix(token, "\r\n"):
+		return token[:len(token)-2], "\r\n"
+	case strings.HasSuffix(token, "\n"), strings.HasSuffix(token, "\r"):
+		return token[:len(token)-1], token[len(token)-1:]
+	}
+	return token, ""
+}
+
+// replaceValue replaces the value on a line, keeping the whitespace around it
+func replaceValue(text string, value string) string {
+	trimmed := strings.TrimLeft(text, "\t ")
+	lead := text[:len(text)-len(trimmed)]
+	value = strings.TrimSpace(value)
+	tail := trimmed[len(strings.TrimRight(trimmed, "\t ")):]
+	return lead + value + tail
+}
+
+// lineEnding returns the line ending used by the document, so that inserted lines match their neighbours
+func lineEnding(lines []DocumentLine) string {
+	for _, l := range lines {
+		if l.EOL != "" {
+			return l.EOL
+		}
+	}
+	return "\n"
+}
+
+func writeLines(w io.Writer, lines []DocumentLine, enc Encoding) (n int64, err error) {
+	var buf bytes.Buffer
+	buf.Write(enc.bom())
+	for _, l := range lines {
+		buf.Write(enc.encode(l.Text + l.EOL))
+	}
+	n, err = buf.WriteTo(w)
+	return
+}
+
+func findLine(lines []DocumentLine, role LineRole, index int) int {
+	for i, l := range lines {
+		if l.Role == role && l.Index == index {
+			return i
+		}
+	}
+	return -1
+}
+
+// insertLine adds a line after the line at position after (or at the end when after is -1)
+func insertLine(lines *[]DocumentLine, after int, line DocumentLine) {
+	at := after + 1
+	if after < 0 {
+		at = len(*lines)
+	}
+	if line.EOL == "" {
+		line.EOL = lineEnding(*lines)
+	}
+	if at > 0 && (*lines)[at-1].EOL == "" {
+		// the previous line was the unterminated last line of the file
+		(*lines)[at-1].EOL = line.EOL
+		if at == len(*lines) {
+			line.EOL = ""
+		}
+	}
+	*lines = append(*lines, DocumentLine{})
+	copy((*lines)[at+1:], (*lines)[at:])
+	(*lines)[at] = line
+}
+
+// SCLDocumentFromStream returns an SCLDocument from the SCL input stream
+func SCLDocumentFromStream(rdr io.Reader) (doc SCLDocument, err error) {
+	doc, _, _, err = parseSCL(rdr, ParseOptions{})
+	return
+}
+
+// SCLDocumentFromString returns an SCLDocument from the SCL file contents in memory
+func SCLDocumentFromString(sclContents string) (doc SCLDocument, err error) {
+	doc, err = SCLDocumentFromStream(strings.NewReader(sclContents))
+	return
+}
+
+// SCLDocumentFromFile returns an SCLDocument from the SCL File in fname
+func SCLDocumentFromFile(fname string) (doc SCLDocument, err error) {
+	var file *os.File
+	if file, err = os.Open(fname); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", fname)
+		return
+	}
+	defer file.Close()
+	if doc, err = SCLDocumentFromStream(file); err != nil {
+		err = errors.Wrapf(withFile(err, fname), "Unable to parse file '%s'", fname)
+		return
+	}
+	return
+}
+
+// String returns the contents of the SCL file
+func (doc SCLDocument) String() string {
+	var buf strings.Builder
+	_, _ = doc.WriteTo(&buf)
+	return buf.String()
+}
+
+// WriteTo writes the SCL file to w
+func (doc SCLDocument) WriteTo(w io.Writer) (n int64, err error) {
+	n, err = writeLines(w, doc.Lines, doc.Encoding)
+	return
+}
+
+// Scale returns the Scale described by the document
+func (doc SCLDocument) Scale() (scale Scale, err error) {
+	scale, err = ScaleFromSCLString(doc.String())
+	return
+}
+
+// SetDescription replaces the description line
+func (doc *SCLDocument) SetDescription(description string) (err error) {
+	if strings.ContainsAny(description, "\r\n") {
+		err = errors.Errorf("Scale description must be a single line: \"%s\"", description)
+		return
+	}
+	if strings.HasPrefix(description, "!") {
+		err = errors.Errorf("Scale description must not start with '!': \"%s\"", description)
+		return
+	}
+	i := findLine(doc.Lines, LineDescription, 0)
+	if i < 0 {
+		err = errors.Errorf("Document has no description line")
+		return
+	}
+	doc.Lines[i].Text = description
+	return
+}
+
+// SetTone replaces the i'th tone (the index into Scale.Tones) and its label,
+// keeping the indentation of the line and the spacing before the label
+func (doc *SCLDocument) SetTone(i int, tone Tone) (err error) {
+	l := findLine(doc.Lines, LineTone, i)
+	if l < 0 {
+		err = errors.Errorf("Document has no tone %d", i)
+		return
+	}
+	doc.Lines[l].Text = replaceTone(doc.Lines[l].Text, tone)
+	return
+}
+
+// replaceTone replaces the pitch and label on a tone line
+func replaceTone(text string, tone Tone) string {
+	if strings.ContainsAny(tone.Label, "\r\n") {
+		tone.Label = strings.Join(strings.Fields(tone.Label), " ")
+	}
+	pitch, label := splitPitch(text)
+	if label == "" {
+		text = replaceValue(text, tone.sclString())
+		if tone.Label != "" {
+			text = strings.TrimRight(text, " \t") + " " + tone.Label
+		}
+		return text
+	}
+	start := strings.Index(text, pitch)
+	labelStart := start + len(pitch) + strings.Index(text[start+len(pitch):], label)
+	if tone.Label == "" {
+		return text[:start] + tone.sclString()
+	}
+	return text[:start] + tone.sclString() + text[start+len(pitch):labelStart] + tone.Label + text[labelStart+len(label):]
+}
+
+// AppendTone adds a tone after the last tone and updates the count
+func (doc *SCLDocument) AppendTone(tone Tone) (err error) {
+	var count int
+	if count, err = doc.count(); err != nil {
+		return
+	}
+	after := findLine(doc.Lines, LineTone, count-1)
+	if after < 0 {
+		err = errors.Errorf("Document has no tone %d", count-1)
+		return
+	}
+	insertLine(&doc.Lines, after, DocumentLine{Role: LineTone, Index: count, Text: replaceTone(doc.Lines[after].Text, tone)})
+	err = doc.setCount(count + 1)
+	return
+}
+
+// RemoveTone removes the i'th tone and updates the count
+func (doc *SCLDocument) RemoveTone(i int) (err error) {
+	var count int
+	if count, err = doc.count(); err != nil {
+		return
+	}
+	if count <= 1 {
+		err = errors.Errorf("Unable to remove the only tone of a scale")
+		return
+	}
+	l := findLine(doc.Lines, LineTone, i)
+	if l < 0 {
+		err = errors.Errorf("Document has no tone %d", i)
+		return
+	}
+	if l == len(doc.Lines)-1 && l > 0 {
+		doc.Lines[l-1].EOL = doc.Lines[l].EOL
+	}
+	doc.Lines = append(doc.Lines[:l], doc.Lines[l+1:]...)
+	for j := range doc.Lines {
+		if doc.Lines[j].Role == LineTone && doc.Lines[j].Index > i {
+			doc.Lines[j].Index--
+		}
+	}
+	err = doc.setCount(count - 1)
+	return
+}
+
+func (doc SCLDocument) count() (count int, err error) {
+	i := findLine(doc.Lines, LineCount, 0)
+	if i < 0 {
+		err = errors.Errorf("Document has no count line")
+		return
+	}
+	count, err = strconv.Atoi(strings.TrimSpace(doc.Lines[i].Text))
+	return
+}
+
+func (doc *SCLDocument) setCount(count int) (err error) {
+	i := findLine(doc.Lines, LineCount, 0)
+	if i < 0 {
+		err = errors.Errorf("Document has no count line")
+		return
+	}
+	doc.Lines[i].Text = replaceValue(doc.Lines[i].Text, strconv.Itoa(count))
+	return
+}
+
+// KBMDocumentFromStream returns a KBMDocument from a KBM input stream
+func KBMDocumentFromStream(rdr io.Reader) (doc KBMDocument, err error) {
+	doc, _, _, err = parseKBM(rdr, ParseOptions{})
+	return
+}
+
+// KBMDocumentFromString returns a KBMDocument from KBM data in memory
+func KBMDocumentFromString(kbmContents string) (doc KBMDocument, err error) {
+	doc, err = KBMDocumentFromStream(strings.NewReader(kbmContents))
+	return
+}
+
+// KBMDocumentFromFile returns a KBMDocument from a KBM file name
+func KBMDocumentFromFile(fname string) (doc KBMDocument, err error) {
+	var file *os.File
+	if file, err = os.Open(fname); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", fname)
+		return
+	}
+	defer file.Close()
+	if doc, err = KBMDocumentFromStream(file); err != nil {
+		err = errors.Wrapf(withFile(err, fname), "Unable to parse file '%s'", fname)
+		return
+	}
+	return
+}
+
+// String returns the contents of the KBM file
+func (doc KBMDocument) String() string {
+	var buf strings.Builder
+	_, _ = doc.WriteTo(&buf)
+	return buf.String()
+}
+
+// WriteTo writes the KBM file to w
+func (doc KBMDocument) WriteTo(w io.Writer) (n int64, err error) {
+	n, err = writeLines(w, doc.Lines, doc.Encoding)
+	return
+}
+
+// KeyboardMapping returns the KeyboardMapping described by the document
+func (doc KBMDocument) KeyboardMapping() (kbm KeyboardMapping, err error) {
+	kbm, err = KeyboardMappingFromKBMString(doc.String())
+	return
+}
+
+// SetField replaces the value of a header field. Use SetReferenceFrequency for
+// the frequency and AppendKey / RemoveKey to change the map size.
+func (doc *KBMDocument) SetField(field KBMField, value int) (err error) {
+	if field == KBMMapSize || field == KBMReferenceFrequency {
+		err = errors.Errorf("Field %d cannot be set as an integer", field)
+		return
+	}
+	if value < 0 {
+		err = errors.Errorf("Unable to set negative value %d", value)
+		return
+	}
+	err = doc.setField(field, strconv.Itoa(value))
+	return
+}
+
+// SetReferenceFrequency replaces the frequency of the reference note
+func (doc *KBMDocument) SetReferenceFrequency(freq float64) (err error) {
+	if !(freq > 0) {
+		err = errors.Errorf("Tuning frequency %v must be a positive number", freq)
+		return
+	}
+	err = doc.setField(KBMReferenceFrequency, strconv.FormatFloat(freq, 'f', -1, 64))
+	return
+}
+
+func (doc *KBMDocument) setField(field KBMField, value string) (err error) {
+	i := findLine(doc.Lines, LineHeader, int(field))
+	if i < 0 {
+		err = errors.Errorf("Document has no header field %d", field)
+		return
+	}
+	doc.Lines[i].Text = replaceValue(doc.Lines[i].Text, value)
+	return
+}
+
+func keyString(degree int) string {
+	if degree < 0 {
+		return "x"
+	}
+	return strconv.Itoa(degree)
+}
+
+// SetKey replaces the scale degree of the i'th key. Use -1 for an unmapped key.
+func (doc *KBMDocument) SetKey(i int, degree int) (err error) {
+	l := findLine(doc.Lines, LineKey, i)
+	if l < 0 {
+		err = errors.Errorf("Document has no key %d", i)
+		return
+	}
+	doc.Lines[l].Text = replaceValue(doc.Lines[l].Text, keyString(degree))
+	return
+}
+
+// AppendKey adds a key after the last key and updates the map size
+func (doc *KBMDocument) AppendKey(degree int) (err error) {
+	var count int
+	if count, err = doc.mapSize(); err != nil {
+		return
+	}
+	after := findLine(doc.Lines, LineKey, count-1)
+	if after < 0 {
+		// an empty mapping: add the key after the last header field
+		after = findLine(doc.Lines, LineHeader, int(KBMOctaveDegree))
+	}
+	if after < 0 {
+		err = errors.Errorf("Document has no header field %d", KBMOctaveDegree)
+		return
+	}
+	// skip any comments that introduce the mapping
+	for after+1 < len(doc.Lines) && doc.Lines[after+1].Role == LineComment && count == 0 {
+		after++
+	}
+	insertLine(&doc.Lines, after, DocumentLine{Role: LineKey, Index: count, Text: keyString(degree)})
+	err = doc.setField(KBMMapSize, strconv.Itoa(count+1))
+	return
+}
+
+// RemoveKey removes the i'th key and updates the map size
+func (doc *KBMDocument) RemoveKey(i int) (err error) {
+	var count int
+	if count, err = doc.mapSize(); err != nil {
+		return
+	}
+	l := findLine(doc.Lines, LineKey, i)
+	if l < 0 {
+		err = errors.Errorf("Document has no key %d", i)
+		return
+	}
+	if l == len(doc.Lines)-1 && l > 0 {
+		doc.Lines[l-1].EOL = doc.Lines[l].EOL
+	}
+	doc.Lines = append(doc.Lines[:l], doc.Lines[l+1:]...)
+	for j := range doc.Lines {
+		if doc.Lines[j].Role == LineKey && doc.Lines[j].Index > i {
+			doc.Lines[j].Index--
+		}
+	}
+	err = doc.setField(KBMMapSize, strconv.Itoa(count-1))
+	return
+}
+
+func (doc KBMDocument) mapSize() (count int, err error) {
+	i := findLine(doc.Lines, LineHeader, int(KBMMapSize))
+	if i < 0 {
+		err = errors.Errorf("Document has no map size")
+		return
+	}
+	count, err = strconv.Atoi(strings.TrimSpace(doc.Lines[i].Text))
+	return
+}
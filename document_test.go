@@ -0,0 +1,119 @@
+package scala
+
+import (
+	"gotest.tools/v3/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Documents - files are reproduced byte for byte
+func TestDocumentRoundTrip(t *testing.T) {
+	for _, fname := range append(testSCLs, "12-intune-dosle.scl", "12-intune-nodesc.scl", "bad/extraline.scl") {
+		raw, err := ioutil.ReadFile(testFile(fname))
+		assert.NilError(t, err)
+		doc, err := SCLDocumentFromFile(testFile(fname))
+		assert.NilError(t, err, fname)
+		assert.Equal(t, doc.String(), string(raw), fname)
+	}
+	for _, fname := range append(testKBMs, "empty-note69-dosle.kbm", "bad/empty-extra.kbm", "bad/extraline-long.kbm") {
+		raw, err := ioutil.ReadFile(testFile(fname))
+		assert.NilError(t, err)
+		doc, err := KBMDocumentFromFile(testFile(fname))
+		assert.NilError(t, err, fname)
+		assert.Equal(t, doc.String(), string(raw), fname)
+	}
+}
+
+// Documents - line roles
+func TestSCLDocumentRoles(t *testing.T) {
+	doc, err := SCLDocumentFromString("! comment\n!\ndesc\n 2\n!\n 100.0\n\n 2/1\ntrailing\n")
+	assert.NilError(t, err)
+	roles := []LineRole{LineComment, LineComment, LineDescription, LineCount, LineComment, LineTone, LineBlank, LineTone, LineTrailing}
+	assert.Equal(t, len(doc.Lines), len(roles))
+	for i, l := range doc.Lines {
+		assert.Equal(t, l.Role, roles[i], "line %d", i)
+	}
+	assert.Equal(t, doc.Lines[7].Index, 1)
+}
+
+// Documents - editing an SCL tone keeps everything else intact
+func TestSCLDocumentEdit(t *testing.T) {
+	raw, err := ioutil.ReadFile(testFile("31edo_dos_lineends.scl"))
+	assert.NilError(t, err)
+	doc, err := SCLDocumentFromString(string(raw))
+	assert.NilError(t, err)
+
+	fifth, err := ToneFromRatio(3, 2)
+	assert.NilError(t, err)
+	assert.NilError(t, doc.SetTone(17, fifth))
+	assert.NilError(t, doc.SetDescription("31 with a just fifth"))
+
+	scale, err := doc.Scale()
+	assert.NilError(t, err)
+	assert.Equal(t, scale.Description, "31 with a just fifth")
+	assert.Equal(t, scale.Tones[17].RatioN, 3)
+	assert.Equal(t, scale.Tones[16].Cents, 658.06452)
+
+	before := strings.Split(string(raw), "\r\n")
+	after := strings.Split(doc.String(), "\r\n")
+	assert.Equal(t, len(before), len(after))
+	changed := 0
+	for i := range before {
+		if before[i] != after[i] {
+			changed++
+		}
+	}
+	assert.Equal(t, changed, 2)
+
+	assert.NilError(t, doc.AppendTone(ToneFromCents(2400.0)))
+	assert.NilError(t, doc.RemoveTone(0))
+	scale, err = doc.Scale()
+	assert.NilError(t, err)
+	assert.Equal(t, scale.Count, 31)
+	assert.Equal(t, scale.Tones[30].Cents, 2400.0)
+	assert.Check(t, strings.HasSuffix(doc.String(), " 2/1\r\n 2400.0\r\n"))
+
+	assert.ErrorContains(t, doc.SetTone(31, fifth), "no tone")
+}
+
+// Documents - editing a KBM key keeps everything else intact
+func TestKBMDocumentEdit(t *testing.T) {
+	raw, err := ioutil.ReadFile(testFile("mapping-whitekeys-a440.kbm"))
+	assert.NilError(t, err)
+	doc, err := KBMDocumentFromString(string(raw))
+	assert.NilError(t, err)
+
+	assert.NilError(t, doc.SetKey(1, 0))
+	assert.NilError(t, doc.SetKey(0, -1))
+	assert.NilError(t, doc.SetField(KBMReferenceNote, 57))
+	assert.NilError(t, doc.SetReferenceFrequency(220.5))
+	k, err := doc.KeyboardMapping()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, k.Keys[:3], []int{-1, 0, 1})
+	assert.Equal(t, k.TuningConstantNote, 57)
+	assert.Equal(t, k.TuningFrequency, 220.5)
+	assert.Check(t, strings.HasPrefix(doc.String(), "! Template for a keyboard mapping\n!\n! Size of map."))
+
+	assert.NilError(t, doc.AppendKey(7))
+	assert.NilError(t, doc.RemoveKey(0))
+	k, err = doc.KeyboardMapping()
+	assert.NilError(t, err)
+	assert.Equal(t, k.Count, 12)
+	assert.DeepEqual(t, k.Keys, []int{0, 1, -1, 2, 3, -1, 4, -1, 5, -1, 6, 7})
+
+	assert.ErrorContains(t, doc.SetField(KBMMapSize, 3), "cannot be set")
+}
+
+// Documents - keys can be added to an empty mapping
+func TestKBMDocumentAppendToEmpty(t *testing.T) {
+	doc, err := KBMDocumentFromFile(testFile("empty-note69.kbm"))
+	assert.NilError(t, err)
+	for _, d := range []int{0, 2, 4} {
+		assert.NilError(t, doc.AppendKey(d))
+	}
+	k, err := doc.KeyboardMapping()
+	assert.NilError(t, err)
+	assert.Equal(t, k.Count, 3)
+	assert.DeepEqual(t, k.Keys, []int{0, 2, 4})
+}
@@ -0,0 +1,250 @@
+package scala
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encoding records the character encoding of an SCL or KBM file. Whatever the
+// encoding of the file, the loaders always return text as UTF-8.
+type Encoding int
+
+const (
+	// EncodingUTF8 for UTF-8 (and so plain ASCII) files without a byte order mark
+	EncodingUTF8 Encoding = iota
+	// EncodingUTF8BOM for UTF-8 files that start with a byte order mark
+	EncodingUTF8BOM
+	// EncodingUTF16LE for little endian UTF-16 files, which always start with a byte order mark
+	EncodingUTF16LE
+	// EncodingUTF16BE for big endian UTF-16 files, which always start with a byte order mark
+	EncodingUTF16BE
+	// EncodingWindows1252 for files without a byte order mark whose first 64 KiB are not valid UTF-8.
+	// These are read as Windows-1252 (CP-1252), the superset of Latin-1 used by DOS and Windows editors.
+	EncodingWindows1252
+)
+
+var encodingNames = []string{"UTF-8", "UTF-8 with BOM", "UTF-16LE", "UTF-16BE", "Windows-1252"}
+
+func (e Encoding) String() string {
+	if e >= 0 && int(e) < len(encodingNames) {
+		return encodingNames[e]
+	}
+	return "Encoding(" + strconv.Itoa(int(e)) + ")"
+}
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// bom returns the byte order mark written at the start of a file in this encoding
+func (e Encoding) bom() []byte {
+	switch e {
+	case EncodingUTF8BOM:
+		return bomUTF8
+	case EncodingUTF16LE:
+		return bomUTF16LE
+	case EncodingUTF16BE:
+		return bomUTF16BE
+	}
+	return nil
+}
+
+// decodeBOM looks for a byte order mark at the start of r. It returns a reader
+// of the remaining contents as UTF-8 and the encoding the mark indicates.
+func decodeBOM(r io.Reader) (io.Reader, Encoding) {
+	br := bufio.NewReader(r)
+	start, _ := br.Peek(3)
+	switch {
+	case len(start) >= 3 && string(start[:3]) == string(bomUTF8):
+		_, _ = br.Discard(3)
+		return br, EncodingUTF8BOM
+	case len(start) >= 2 && string(start[:2]) == string(bomUTF16LE):
+		_, _ = br.Discard(2)
+		return &utf16Reader{r: br}, EncodingUTF16LE
+	case len(start) >= 2 && string(start[:2]) == string(bomUTF16BE):
+		_, _ = br.Discard(2)
+		return &utf16Reader{r: br, bigEndian: true}, EncodingUTF16BE
+	}
+	return br, EncodingUTF8
+}
+
+// legacyPrefix is how much of a file without a byte order mark is read to decide its encoding
+const legacyPrefix = 64 << 10
+
+// decodeLegacy decides the encoding of r, which has no byte order mark, from its first
+// legacyPrefix bytes: UTF-8 if they are valid UTF-8 and Windows-1252 otherwise. It returns
+// a reader of the contents as UTF-8, which converts them as they are read.
+func decodeLegacy(r io.Reader) (io.Reader, Encoding) {
+	br := bufio.NewReaderSize(r, legacyPrefix)
+	prefix, err := br.Peek(legacyPrefix)
+	if err == nil {
+		// a character may be cut off at the end of the prefix
+		for i := len(prefix) - 1; i >= 0 && i >= len(prefix)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(prefix[i]) {
+				if !utf8.FullRune(prefix[i:]) {
+					prefix = prefix[:i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(prefix) {
+		return br, EncodingUTF8
+	}
+	return &windows1252Reader{r: br}, EncodingWindows1252
+}
+
+// utf16Reader converts a UTF-16 stream into UTF-8
+type utf16Reader struct {
+	r         *bufio.Reader
+	bigEndian bool
+	out       []byte // converted bytes not yet returned
+	err       error
+}
+
+func (u *utf16Reader) Read(p []byte) (n int, err error) {
+	for len(u.out) == 0 && u.err == nil {
+		u.convert()
+	}
+	if len(u.out) > 0 {
+		n = copy(p, u.out)
+		u.out = u.out[n:]
+		return
+	}
+	return 0, u.err
+}
+
+func (u *utf16Reader) readUnit() (rune, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(u.r, b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// a stray final byte is not a character
+			err = io.EOF
+		}
+		return 0, err
+	}
+	if u.bigEndian {
+		return rune(b[0])<<8 | rune(b[1]), nil
+	}
+	return rune(b[1])<<8 | rune(b[0]), nil
+}
+
+// convert reads a block of UTF-16 code units into out
+func (u *utf16Reader) convert() {
+	var buf [utf8.UTFMax]byte
+	for i := 0; i < 1024; i++ {
+		r, err := u.readUnit()
+		if err != nil {
+			u.err = err
+			return
+		}
+		if utf16.IsSurrogate(r) {
+			var r2 rune
+			if r2, err = u.readUnit(); err != nil {
+				u.err = err
+				r = utf8.RuneError
+			} else {
+				r = utf16.DecodeRune(r, r2)
+			}
+		}
+		n := utf8.EncodeRune(buf[:], r)
+		u.out = append(u.out, buf[:n]...)
+		if u.err != nil {
+			return
+		}
+	}
+}
+
+// windows1252 holds the characters for bytes 0x80 to 0x9F; the other bytes
+// are the same as the Unicode code points. The five bytes that Windows-1252
+// leaves undefined map to the control characters of the same value, so that
+// every byte can be converted back.
+var windows1252 = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// windows1252Reader converts a Windows-1252 stream into UTF-8
+type windows1252Reader struct {
+	r   io.Reader
+	out []byte // converted bytes not yet returned
+	err error
+}
+
+func (w *windows1252Reader) Read(p []byte) (n int, err error) {
+	for len(w.out) == 0 && w.err == nil {
+		var in [1024]byte
+		n, w.err = w.r.Read(in[:])
+		w.out = append(w.out, decodeWindows1252(in[:n])...)
+	}
+	if len(w.out) > 0 {
+		n = copy(p, w.out)
+		w.out = w.out[n:]
+		return n, nil
+	}
+	return 0, w.err
+}
+
+// decodeWindows1252 converts Windows-1252 text to UTF-8
+func decodeWindows1252(b []byte) string {
+	var out strings.Builder
+	out.Grow(len(b))
+	for _, c := range b {
+		if c >= 0x80 && c < 0xA0 {
+			out.WriteRune(windows1252[c-0x80])
+		} else {
+			out.WriteRune(rune(c))
+		}
+	}
+	return out.String()
+}
+
+// encodeWindows1252 converts UTF-8 text to Windows-1252. Characters that
+// Windows-1252 cannot represent are written as '?'.
+func encodeWindows1252(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 0x80 || (r >= 0xA0 && r <= 0xFF):
+			out = append(out, byte(r))
+		default:
+			c := byte('?')
+			for i, w := range windows1252 {
+				if w == r {
+					c = byte(0x80 + i)
+					break
+				}
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// encode converts UTF-8 text to the encoding (without a byte order mark)
+func (e Encoding) encode(s string) []byte {
+	switch e {
+	case EncodingUTF16LE, EncodingUTF16BE:
+		units := utf16.Encode([]rune(s))
+		out := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			if e == EncodingUTF16BE {
+				out = append(out, byte(u>>8), byte(u))
+			} else {
+				out = append(out, byte(u), byte(u>>8))
+			}
+		}
+		return out
+	case EncodingWindows1252:
+		return encodeWindows1252(s)
+	}
+	return []byte(s)
+}
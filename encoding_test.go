@@ -0,0 +1,123 @@
+package scala
+
+import (
+	"bytes"
+	"gotest.tools/v3/assert"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const encodingSCL = "! encoded.scl\n!\nGrün scale\n 2\n!\n 3/2 Quinte\n 2/1\n"
+
+const encodingKBM = "! encoded.kbm\n! Größe\n0\n0\n127\n60\n69\n440.0\n0\n"
+
+func utf16Bytes(s string, bigEndian bool) []byte {
+	out := []byte{0xFF, 0xFE}
+	if bigEndian {
+		out = []byte{0xFE, 0xFF}
+	}
+	for _, u := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			out = append(out, byte(u>>8), byte(u))
+		} else {
+			out = append(out, byte(u), byte(u>>8))
+		}
+	}
+	return out
+}
+
+// Encoding - SCL files in each encoding all read as the same UTF-8 scale
+func TestEncodingSCL(t *testing.T) {
+	cp1252 := bytes.Replace([]byte(encodingSCL), []byte("ü"), []byte{0xFC}, 1)
+	for _, c := range []struct {
+		data []byte
+		enc  Encoding
+	}{
+		{[]byte(encodingSCL), EncodingUTF8},
+		{append([]byte{0xEF, 0xBB, 0xBF}, encodingSCL...), EncodingUTF8BOM},
+		{utf16Bytes(encodingSCL, false), EncodingUTF16LE},
+		{utf16Bytes(encodingSCL, true), EncodingUTF16BE},
+		{cp1252, EncodingWindows1252},
+	} {
+		s, err := ScaleFromSCLStream(bytes.NewReader(c.data))
+		assert.NilError(t, err, c.enc.String())
+		assert.Equal(t, s.Encoding, c.enc)
+		assert.Equal(t, s.Description, "Grün scale")
+		assert.Equal(t, s.RawText, strings.TrimSuffix(encodingSCL, "\n"))
+		assert.Equal(t, s.Count, 2)
+		assert.Equal(t, s.Tones[0].Label, "Quinte")
+	}
+}
+
+// Encoding - a BOM does not upset the character check of the first KBM line
+func TestEncodingKBM(t *testing.T) {
+	for _, data := range [][]byte{
+		append([]byte{0xEF, 0xBB, 0xBF}, "0\n0\n127\n60\n69\n440.0\n0\n"...),
+		utf16Bytes(encodingKBM, false),
+		bytes.Replace([]byte(encodingKBM), []byte("ö"), []byte{0xF6}, 1),
+	} {
+		k, err := KeyboardMappingFromKBMStream(bytes.NewReader(data))
+		assert.NilError(t, err)
+		assert.Equal(t, k.Count, 0)
+		assert.Equal(t, k.TuningFrequency, 440.0)
+		assert.Assert(t, k.Encoding != EncodingUTF8)
+	}
+}
+
+// Encoding - Windows-1252 characters beyond Latin-1
+func TestEncodingWindows1252(t *testing.T) {
+	s, err := ScaleFromSCLStream(strings.NewReader("\x93Quoted\x94 \x80\n1\n2/1\n"))
+	assert.NilError(t, err)
+	assert.Equal(t, s.Description, "“Quoted” €")
+	assert.Equal(t, string(EncodingWindows1252.encode(s.Description)), "\x93Quoted\x94 \x80")
+	assert.Equal(t, string(EncodingWindows1252.encode("漢")), "?")
+
+	// a file longer than the blocks it is converted in
+	long := strings.Repeat("\x93\x80", 5000)
+	s, err = ScaleFromSCLStream(strings.NewReader(long + "\n1\n2/1\n"))
+	assert.NilError(t, err)
+	assert.Equal(t, s.Description, strings.Repeat("“€", 5000))
+}
+
+// Encoding - PreserveRawText keeps the original bytes
+func TestEncodingPreserveRawText(t *testing.T) {
+	data := utf16Bytes(encodingSCL, false)
+	s, _, err := ScaleFromSCLStreamWithOptions(bytes.NewReader(data), ParseOptions{PreserveRawText: true})
+	assert.NilError(t, err)
+	assert.Equal(t, s.RawText, string(data))
+	assert.Equal(t, s.Description, "Grün scale")
+
+	data = bytes.Replace([]byte(encodingKBM), []byte("ö"), []byte{0xF6}, 1)
+	k, _, err := KeyboardMappingFromKBMStreamWithOptions(bytes.NewReader(data), ParseOptions{PreserveRawText: true})
+	assert.NilError(t, err)
+	assert.Equal(t, k.RawText, string(data))
+}
+
+// Encoding - documents are written back in the encoding they were read in
+func TestEncodingDocumentRoundTrip(t *testing.T) {
+	for _, data := range [][]byte{
+		append([]byte{0xEF, 0xBB, 0xBF}, encodingSCL...),
+		utf16Bytes(encodingSCL, false),
+		utf16Bytes(encodingSCL, true),
+		bytes.Replace([]byte(encodingSCL), []byte("ü"), []byte{0xFC}, 1),
+		// one line that is not UTF-8 makes the whole file Windows-1252
+		[]byte("! caf\xe9\n\xe2\x82\xac desc\n1\n2/1\n"),
+	} {
+		doc, err := SCLDocumentFromStream(bytes.NewReader(data))
+		assert.NilError(t, err)
+		var buf bytes.Buffer
+		_, err = doc.WriteTo(&buf)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, buf.Bytes(), data)
+	}
+
+	data := utf16Bytes(encodingKBM, true)
+	doc, err := KBMDocumentFromStream(bytes.NewReader(data))
+	assert.NilError(t, err)
+	assert.Equal(t, doc.Encoding, EncodingUTF16BE)
+	var buf bytes.Buffer
+	_, err = doc.WriteTo(&buf)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, buf.Bytes(), data)
+}
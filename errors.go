@@ -0,0 +1,131 @@
+package scala
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// ErrorKind classifies the errors returned by the loaders and by TuningFromSCLAndKBM
+type ErrorKind int
+
+const (
+	// KindBadCount for an SCL note count that is not a positive integer
+	KindBadCount ErrorKind = iota
+	// KindBadTone for an SCL tone that is neither cents nor a ratio
+	KindBadTone
+	// KindToneCount for an SCL file with fewer tones than its count
+	KindToneCount
+	// KindBadCharacter for a KBM line containing a character that is not allowed
+	KindBadCharacter
+	// KindBadHeader for a KBM header field that is not a number
+	KindBadHeader
+	// KindBadKey for a KBM key that is neither a number nor "x"
+	KindBadKey
+	// KindKeyCount for a KBM file with a different number of keys than its map size
+	KindKeyCount
+	// KindIncomplete for a file that ends before its tones or keys section
+	KindIncomplete
+	// KindEmptyScale for a tuning of a scale with no notes
+	KindEmptyScale
+	// KindMappingTooLarge for a tuning whose mapping octave degree is beyond the end of the scale
+	KindMappingTooLarge
+	// KindTrailing for text after the last tone or key, which only ParseStrict rejects
+	KindTrailing
+	// KindRange for a value outside the range the format allows
+	KindRange
+	// KindLimit for input beyond one of the limits of ParseOptions
+	KindLimit
+)
+
+var errorKindNames = []string{
+	"bad count",
+	"bad tone",
+	"tone count",
+	"bad character",
+	"bad header",
+	"bad key",
+	"key count",
+	"incomplete",
+	"empty scale",
+	"mapping too large",
+	"trailing text",
+	"out of range",
+	"limit exceeded",
+}
+
+func (k ErrorKind) String() string {
+	if k >= 0 && int(k) < len(errorKindNames) {
+		return errorKindNames[k]
+	}
+	return "ErrorKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// A ParseError is returned by the SCL and KBM loaders when the input cannot be
+// parsed. It records where the problem was found so that editors can point
+// at the offending text. Use errors.As to retrieve it from a returned error.
+type ParseError struct {
+	File   string // the file being parsed, if known
+	Line   int    // 1 based line number; 0 if the error is not about a particular line
+	Column int    // 1 based column of Text within the line; 0 if unknown
+	Kind   ErrorKind
+	Text   string // the offending text
+	Msg    string // a description of the problem
+	Err    error  // the underlying error, if any
+}
+
+func (e *ParseError) Error() string {
+	// the loaders that know the File already mention it when they wrap the error
+	var buf strings.Builder
+	buf.WriteString(e.Msg)
+	if e.Text != "" {
+		fmt.Fprintf(&buf, ": \"%s\"", e.Text)
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, ", line %d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&buf, ", column %d", e.Column)
+		}
+	}
+	if e.Err != nil {
+		buf.WriteString(": " + e.Err.Error())
+	}
+	return buf.String()
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError returns a ParseError for text found on the given line
+func newParseError(kind ErrorKind, lineno int, line string, text string, cause error, msg string) *ParseError {
+	column := 0
+	if text != "" {
+		if i := strings.Index(line, text); i >= 0 {
+			column = i + 1
+		}
+	}
+	return &ParseError{Line: lineno, Column: column, Kind: kind, Text: text, Msg: msg, Err: cause}
+}
+
+// withFile records the file name on a ParseError contained in err
+func withFile(err error, fname string) error {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		pe.File = fname
+	}
+	return err
+}
+
+// A TuningError is returned by TuningFromSCLAndKBM when a scale and a mapping
+// cannot be combined.
+type TuningError struct {
+	Kind ErrorKind
+	Msg  string
+}
+
+func (e *TuningError) Error() string {
+	return e.Msg
+}
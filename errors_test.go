@@ -0,0 +1,91 @@
+package scala
+
+import (
+	"github.com/pkg/errors"
+	"gotest.tools/v3/assert"
+	"testing"
+)
+
+func parseErrorOf(t *testing.T, err error) *ParseError {
+	var pe *ParseError
+	assert.Assert(t, errors.As(err, &pe), "%v", err)
+	return pe
+}
+
+// Parse errors - SCL errors have a kind and a position
+func TestParseErrorSCL(t *testing.T) {
+	_, err := ScaleFromSCLFile(testFile("bad/badnote.scl"))
+	pe := parseErrorOf(t, err)
+	assert.Equal(t, pe.File, testFile("bad/badnote.scl"))
+	assert.Equal(t, pe.Kind, KindBadTone)
+	assert.Equal(t, pe.Line, 12)
+	assert.Equal(t, pe.Column, 1)
+	assert.Equal(t, pe.Text, "What")
+
+	_, err = ScaleFromSCLString("desc\n 12\n 100.0\n 3/x\n")
+	pe = parseErrorOf(t, err)
+	assert.Equal(t, pe.File, "")
+	assert.Equal(t, pe.Kind, KindBadTone)
+	assert.Equal(t, pe.Line, 4)
+	assert.Equal(t, pe.Column, 4)
+	assert.Equal(t, pe.Text, "x")
+
+	_, err = ScaleFromSCLString("desc\n  twelve\n")
+	pe = parseErrorOf(t, err)
+	assert.Equal(t, pe.Kind, KindBadCount)
+	assert.Equal(t, pe.Line, 2)
+	assert.Equal(t, pe.Column, 3)
+
+	_, err = ScaleFromSCLString("desc\n 0\n")
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindBadCount)
+
+	_, err = ScaleFromSCLFile(testFile("bad/missingnote.scl"))
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindToneCount)
+
+	_, err = ScaleFromSCLString("! only a comment\n")
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindIncomplete)
+}
+
+// Parse errors - KBM errors have a kind and a position
+func TestParseErrorKBM(t *testing.T) {
+	_, err := KeyboardMappingFromKBMFile(testFile("bad/garbage-key.kbm"))
+	pe := parseErrorOf(t, err)
+	assert.Equal(t, pe.File, testFile("bad/garbage-key.kbm"))
+	assert.Equal(t, pe.Kind, KindBadCharacter)
+	assert.Equal(t, pe.Line, 26)
+	assert.Equal(t, pe.Column, 1)
+	assert.Equal(t, pe.Text, "g")
+
+	_, err = KeyboardMappingFromKBMFile(testFile("bad/blank-line.kbm"))
+	pe = parseErrorOf(t, err)
+	assert.Equal(t, pe.Kind, KindBadKey)
+	assert.Equal(t, pe.Line, 27)
+
+	_, err = KeyboardMappingFromKBMString("0\n0\n127\n60\n69\n4 40.0\n0\n")
+	pe = parseErrorOf(t, err)
+	assert.Equal(t, pe.Kind, KindBadHeader)
+	assert.Equal(t, pe.Line, 6)
+
+	_, err = KeyboardMappingFromKBMFile(testFile("bad/empty-bad.kbm"))
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindIncomplete)
+
+	_, err = KeyboardMappingFromKBMFile(testFile("bad/missing-note.kbm"))
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindKeyCount)
+}
+
+// Tuning errors - mapping larger than the scale
+func TestTuningError(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("6-exact.scl"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingFromKBMFile(testFile("mapping-whitekeys-a440.kbm"))
+	assert.NilError(t, err)
+	_, err = TuningFromSCLAndKBM(s, k)
+	var te *TuningError
+	assert.Assert(t, errors.As(err, &te))
+	assert.Equal(t, te.Kind, KindMappingTooLarge)
+	assert.ErrorContains(t, err, "Unable to apply mapping of size 7")
+
+	_, err = TuningFromSCLAndKBM(Scale{}, k)
+	assert.Assert(t, errors.As(err, &te))
+	assert.Equal(t, te.Kind, KindEmptyScale)
+}
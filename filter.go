@@ -0,0 +1,254 @@
+package scala
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetuneStrategy selects how a RetuneFilter retunes notes
+type RetuneStrategy int
+
+const (
+	// RetuneMTS sends a real-time MTS single note tuning change before each note on whose
+	// tuning the synth has not yet been sent, and passes the notes on unchanged. The synth
+	// holds one tuning per key, so the change also retunes a note of that key still
+	// sounding, on any channel.
+	RetuneMTS RetuneStrategy = iota
+	// RetunePitchBend plays each note on a member channel of an MPE zone with its own
+	// pitch bend, as RetuneSMF does. Each channel not passed through is a part whose
+	// controllers, program, pressure and pitch bend go to the member channels of its notes.
+	RetunePitchBend
+)
+
+var retuneStrategyNames = []string{"MTS", "pitch bend"}
+
+func (s RetuneStrategy) String() string {
+	if s >= 0 && int(s) < len(retuneStrategyNames) {
+		return retuneStrategyNames[s]
+	}
+	return "RetuneStrategy(" + strconv.Itoa(int(s)) + ")"
+}
+
+// RetuneFilterOptions controls a RetuneFilter
+type RetuneFilterOptions struct {
+	Strategy RetuneStrategy
+	MTS      MTSOptions // RetuneMTS: the device ID and tuning program of the messages
+	// MPE gives the zone of RetunePitchBend. Its ReleaseTail is in nanoseconds.
+	MPE MPEOptions
+	// Configure sends the MPE configuration messages of RetunePitchBend before anything else
+	Configure bool
+	// PassThrough has bit n set to keep the messages of MIDI channel n+1 unchanged and
+	// untuned, as RetuneOptions.PassThrough
+	PassThrough uint16
+}
+
+// A RetuneFilter retunes a live stream of MIDI bytes, such as those from a controller to
+// a synth. It follows running status, and passes system exclusive, system common and real-time
+// messages through unchanged; real-time messages are passed on at once, even in the middle of
+// another message. System exclusive messages longer than 64 KiB and notes that the tuning
+// leaves unmapped are dropped. The output never uses running status.
+//
+// SetTuning may be called from another goroutine while Run is filtering. The new tuning
+// applies from the next note on. With RetunePitchBend, notes sounding when the tuning
+// changes keep their pitch; with RetuneMTS, they do until their key is played again.
+type RetuneFilter struct {
+	mu     sync.Mutex
+	opts   RetuneFilterOptions
+	tuning Tuning
+	bend   *bendRetuner
+	held   [16][128]bool // RetuneMTS: the notes sounding on each channel
+	sent   [128]float64  // RetuneMTS: the frequency the synth was last sent for each note
+	start  time.Time
+}
+
+// RetuneFilterFromTuning returns a filter which retunes to t
+func RetuneFilterFromTuning(t Tuning, opts RetuneFilterOptions) (f *RetuneFilter, err error) {
+	f = &RetuneFilter{opts: opts, tuning: t, start: time.Now()}
+	switch opts.Strategy {
+	case RetuneMTS:
+		if err = opts.MTS.validate(); err != nil {
+			return
+		}
+	case RetunePitchBend:
+		var a *MPEAllocator
+		if a, err = MPEAllocatorFromTuning(t, opts.MPE); err != nil {
+			return
+		}
+		if f.bend, err = newBendRetuner(a, opts.PassThrough); err != nil {
+			return
+		}
+	default:
+		err = errors.Errorf("Unknown retune strategy %d", int(opts.Strategy))
+	}
+	return
+}
+
+// SetTuning changes the tuning of the notes that follow
+func (f *RetuneFilter) SetTuning(t Tuning) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tuning = t
+	if f.bend != nil {
+		f.bend.a.SetTuning(t)
+	}
+}
+
+// Tuning returns the current tuning
+func (f *RetuneFilter) Tuning() Tuning {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tuning
+}
+
+// systemCommonLength returns the number of data bytes of a system common message
+func systemCommonLength(status byte) int {
+	switch status {
+	case 0xF1, 0xF3:
+		return 1
+	case 0xF2:
+		return 2
+	}
+	return 0
+}
+
+// maxFilterSysEx is the longest system exclusive message a RetuneFilter passes through
+const maxFilterSysEx = 64 << 10
+
+// Run filters the MIDI bytes of r to w until r ends, when it returns nil, or until reading
+// or writing fails. An incomplete message at the end of r is dropped.
+func (f *RetuneFilter) Run(r io.Reader, w io.Writer) (err error) {
+	br := bufio.NewReader(r)
+	if f.opts.Strategy == RetunePitchBend && f.opts.Configure {
+		f.mu.Lock()
+		msgs := f.bend.a.ConfigurationMessages()
+		f.mu.Unlock()
+		for _, msg := range msgs {
+			if _, err = w.Write(msg); err != nil {
+				return
+			}
+		}
+	}
+	var running byte // the status of channel messages without one
+	var msg []byte   // the message being read
+	need := 0        // the data bytes the message still needs
+	sysex := false
+	for {
+		var b byte
+		if b, err = br.ReadByte(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		switch {
+		case b >= 0xF8:
+			if _, err = w.Write([]byte{b}); err != nil {
+				return
+			}
+			continue
+		case sysex && b == 0xF7:
+			sysex = false
+			if msg != nil {
+				if err = f.message(append(msg, b), w); err != nil {
+					return
+				}
+			}
+			msg = nil
+			continue
+		case sysex && b < 0x80:
+			// the rest of a message too long to pass through is dropped as it arrives
+			if msg != nil {
+				msg = append(msg, b)
+			}
+			if len(msg) >= maxFilterSysEx {
+				msg = nil
+			}
+			continue
+		case b == 0xF0:
+			// a system exclusive message that another status byte interrupts is dropped
+			sysex, running, msg, need = true, 0, []byte{b}, 0
+			continue
+		case b >= 0xF1:
+			sysex, running, msg = false, 0, []byte{b}
+			need = systemCommonLength(b)
+		case b >= 0x80:
+			sysex, running, msg = false, b, []byte{b}
+			need = channelMessageLength(b)
+			continue
+		case need > 0:
+			msg = append(msg, b)
+			need--
+		case running != 0:
+			msg = []byte{running, b}
+			need = channelMessageLength(running) - 1
+		default:
+			// a data byte with no status
+			continue
+		}
+		if need == 0 && msg != nil {
+			if err = f.message(msg, w); err != nil {
+				return
+			}
+			msg = nil
+		}
+	}
+}
+
+// message filters one complete message
+func (f *RetuneFilter) message(msg []byte, w io.Writer) (err error) {
+	f.mu.Lock()
+	var out [][]byte
+	emit := func(data []byte) {
+		out = append(out, data)
+	}
+	if f.bend != nil {
+		f.bend.message(msg, 0, int64(time.Since(f.start)), emit)
+	} else {
+		err = f.mtsMessage(msg, emit)
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return
+	}
+	for _, data := range out {
+		if _, err = w.Write(data); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// mtsMessage filters one complete message for RetuneMTS
+func (f *RetuneFilter) mtsMessage(msg []byte, emit func([]byte)) (err error) {
+	status := msg[0] & 0xF0
+	if (status != 0x90 && status != 0x80) || f.opts.PassThrough&(1<<(msg[0]&0x0F)) != 0 {
+		emit(msg)
+		return
+	}
+	ch, key := int(msg[0]&0x0F), int(msg[1])
+	if status == 0x90 && msg[2] > 0 {
+		if !f.tuning.IsMidiNoteMapped(key) {
+			return
+		}
+		if freq := f.tuning.FrequencyForMidiNote(key); freq != f.sent[key] {
+			var change []byte
+			if change, _, err = MTSSingleNoteChange(f.tuning, []int{key}, f.opts.MTS); err != nil {
+				return
+			}
+			emit(change)
+			f.sent[key] = freq
+		}
+		f.held[ch][key] = true
+		emit(msg)
+		return
+	}
+	if f.held[ch][key] {
+		f.held[ch][key] = false
+		emit(msg)
+	}
+	return
+}
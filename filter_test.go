@@ -0,0 +1,210 @@
+package scala
+
+import (
+	"bytes"
+	"gotest.tools/v3/assert"
+	"io"
+	"math"
+	"testing"
+)
+
+// runFilter runs f between in-memory pipes, returning the writer of its input, the reader
+// of its output, and the channel of the error of Run
+func runFilter(f *RetuneFilter) (in *io.PipeWriter, out *io.PipeReader, done chan error) {
+	inR, in := io.Pipe()
+	out, outW := io.Pipe()
+	done = make(chan error, 1)
+	go func() {
+		err := f.Run(inR, outW)
+		outW.Close()
+		done <- err
+	}()
+	return
+}
+
+func readBytes(t *testing.T, r io.Reader, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	assert.NilError(t, err)
+	return b
+}
+
+// Filter - MTS single note changes, running status and swapping tunings
+func TestRetuneFilterMTS(t *testing.T) {
+	tun := mpeTestTuning(t)
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	f, err := RetuneFilterFromTuning(tun, RetuneFilterOptions{MTS: MTSOptions{DeviceID: MTSAllDevices}})
+	assert.NilError(t, err)
+	in, out, done := runFilter(f)
+
+	change60, _, err := MTSSingleNoteChange(tun, []int{60}, MTSOptions{DeviceID: MTSAllDevices})
+	assert.NilError(t, err)
+	change62, _, err := MTSSingleNoteChange(tun, []int{62}, MTSOptions{DeviceID: MTSAllDevices})
+	assert.NilError(t, err)
+
+	// a note on, then another by running status with a clock in the middle of it
+	_, err = in.Write([]byte{0x90, 60, 100, 62, 0xF8, 90})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, readBytes(t, out, len(change60)+3), append(change60, 0x90, 60, 100))
+	assert.DeepEqual(t, readBytes(t, out, 1), []byte{0xF8})
+	assert.DeepEqual(t, readBytes(t, out, len(change62)+3), append(change62, 0x90, 62, 90))
+
+	// notes off by running status, and a note whose tuning was already sent
+	_, err = in.Write([]byte{60, 0, 62, 0, 0x90, 60, 80})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, readBytes(t, out, 9), []byte{0x90, 60, 0, 0x90, 62, 0, 0x90, 60, 80})
+
+	// system exclusive and controllers pass through
+	sysex := []byte{0xF0, 0x43, 0x10, 0x01, 0xF7}
+	_, err = in.Write(append(sysex, 0xB0, 7, 100, 64))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, readBytes(t, out, len(sysex)), sysex)
+	assert.DeepEqual(t, readBytes(t, out, 3), []byte{0xB0, 7, 100})
+
+	// a new tuning is sent with the next note on
+	f.SetTuning(std)
+	assert.Equal(t, f.Tuning().Scale().Count, 12)
+	change62, _, err = MTSSingleNoteChange(std, []int{62}, MTSOptions{DeviceID: MTSAllDevices})
+	assert.NilError(t, err)
+	_, err = in.Write([]byte{0x80, 60, 0, 0x90, 62, 70})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, readBytes(t, out, 3+len(change62)+3), append(append([]byte{0x80, 60, 0}, change62...), 0x90, 62, 70))
+
+	assert.NilError(t, in.Close())
+	assert.NilError(t, <-done)
+	rest, err := io.ReadAll(out)
+	assert.NilError(t, err)
+	assert.Equal(t, len(rest), 0)
+}
+
+// Filter - pitch bend rotation
+func TestRetuneFilterPitchBend(t *testing.T) {
+	tun := mpeTestTuning(t)
+	f, err := RetuneFilterFromTuning(tun, RetuneFilterOptions{Strategy: RetunePitchBend, Configure: true,
+		MPE: MPEOptions{MemberChannels: 2}})
+	assert.NilError(t, err)
+	var input bytes.Buffer
+	input.Write([]byte{0x90, 60, 100, 64, 100, 0xE0, 0x00, 0x50, 0x80, 60, 0, 0xC0, 5})
+	var output bytes.Buffer
+	assert.NilError(t, f.Run(&input, &output))
+
+	a := mustMPEAllocator(t, tun, MPEOptions{MemberChannels: 2})
+	var want bytes.Buffer
+	for _, msg := range a.ConfigurationMessages() {
+		want.Write(msg)
+	}
+	v60, _, _ := a.NoteOn(60, 0)
+	v64, _, _ := a.NoteOn(64, 0)
+	want.Write(v60.PitchBendMessage())
+	want.Write(v60.NoteOnMessage(100))
+	want.Write(v64.PitchBendMessage())
+	want.Write(v64.NoteOnMessage(100))
+	// the pitch bend and program of the channel go to the notes played on it
+	for _, v := range []MPEVoice{v60, v64} {
+		v.Bend += int(math.Round((0x2800 - 8192) * 2 / 48.0))
+		want.Write(v.PitchBendMessage())
+	}
+	want.Write(v60.NoteOffMessage(0))
+	want.Write([]byte{0xC2, 5})
+	assert.DeepEqual(t, output.Bytes(), want.Bytes())
+	assert.Equal(t, v60.Channel, 1)
+	assert.Equal(t, v64.Channel, 2)
+}
+
+// Filter - unmapped notes, system common messages and stray data
+func TestRetuneFilterStream(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("12-intune.scl"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingFromKBMFile(testFile("mapping-whitekeys-c261.kbm"))
+	assert.NilError(t, err)
+	whiteKeys, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+	for _, strategy := range []RetuneStrategy{RetuneMTS, RetunePitchBend} {
+		f, err := RetuneFilterFromTuning(whiteKeys, RetuneFilterOptions{Strategy: strategy})
+		assert.NilError(t, err)
+		input := []byte{
+			0x12, 0x34, // data with no status
+			0x91, 61, 100, 61, 0, // an unmapped note
+			0xF2, 0x10, 0x20, 0x30, // song position; its running status ends
+			0xF0, 0x01, 0x90, 60, 1, // system exclusive interrupted by a note
+			0xF6,     // tune request
+			0xFE,     // active sensing
+			0x90, 60, // an incomplete message
+		}
+		var output bytes.Buffer
+		assert.NilError(t, f.Run(bytes.NewReader(input), &output))
+		got := output.Bytes()
+		assert.Assert(t, bytes.HasPrefix(got, []byte{0xF2, 0x10, 0x20}), strategy)
+		assert.Assert(t, bytes.HasSuffix(got, []byte{0xF6, 0xFE}), strategy)
+		assert.Assert(t, !bytes.Contains(got, []byte{0x91, 61}), strategy)
+		assert.Assert(t, !bytes.Contains(got, []byte{0xF0, 0x01}), strategy)
+		assert.Equal(t, bytes.Count(got, []byte{0xF2}), 1, strategy)
+		if strategy == RetuneMTS {
+			assert.Assert(t, bytes.Contains(got, []byte{0x90, 60, 1, 0xF6}))
+		}
+	}
+	assert.Equal(t, RetunePitchBend.String(), "pitch bend")
+
+	// system exclusive messages are passed through up to a limit on their length
+	for _, length := range []int{maxFilterSysEx, maxFilterSysEx + 1, 10 * maxFilterSysEx} {
+		f, err := RetuneFilterFromTuning(whiteKeys, RetuneFilterOptions{})
+		assert.NilError(t, err)
+		sysex := append(append([]byte{0xF0}, make([]byte, length-2)...), 0xF7)
+		var output bytes.Buffer
+		assert.NilError(t, f.Run(bytes.NewReader(append(sysex, 0xF6)), &output))
+		if length <= maxFilterSysEx {
+			assert.DeepEqual(t, output.Bytes(), append(sysex, 0xF6))
+		} else {
+			assert.DeepEqual(t, output.Bytes(), []byte{0xF6})
+		}
+	}
+
+	// channels passed through are neither tuned nor dropped
+	for _, strategy := range []RetuneStrategy{RetuneMTS, RetunePitchBend} {
+		f, err := RetuneFilterFromTuning(whiteKeys, RetuneFilterOptions{Strategy: strategy, PassThrough: 1 << 9,
+			MPE: MPEOptions{MemberChannels: 8}})
+		assert.NilError(t, err)
+		input := []byte{0x99, 61, 100, 0x89, 61, 0}
+		var output bytes.Buffer
+		assert.NilError(t, f.Run(bytes.NewReader(input), &output))
+		assert.DeepEqual(t, output.Bytes(), input)
+	}
+	_, err = RetuneFilterFromTuning(whiteKeys, RetuneFilterOptions{Strategy: RetunePitchBend, PassThrough: 1 << 9})
+	assert.ErrorContains(t, err, "in the MPE zone")
+
+	_, err = RetuneFilterFromTuning(whiteKeys, RetuneFilterOptions{Strategy: 5})
+	assert.ErrorContains(t, err, "Unknown retune strategy")
+	_, err = RetuneFilterFromTuning(whiteKeys, RetuneFilterOptions{MTS: MTSOptions{Program: 200}})
+	assert.ErrorContains(t, err, "0..127")
+	_, err = RetuneFilterFromTuning(whiteKeys, RetuneFilterOptions{Strategy: RetunePitchBend, MPE: MPEOptions{MemberChannels: 20}})
+	assert.ErrorContains(t, err, "member channels")
+}
+
+// Filter - swapping tunings while running
+func TestRetuneFilterConcurrentTuning(t *testing.T) {
+	tun := mpeTestTuning(t)
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	f, err := RetuneFilterFromTuning(tun, RetuneFilterOptions{Strategy: RetunePitchBend})
+	assert.NilError(t, err)
+	in, out, done := runFilter(f)
+	go func() {
+		for i := 0; i < 200; i++ {
+			in.Write([]byte{0x90, byte(40 + i%40), 100, 0x80, byte(40 + i%40), 0})
+		}
+		in.Close()
+	}()
+	for i := 0; i < 200; i++ {
+		if i%2 == 0 {
+			f.SetTuning(std)
+		} else {
+			f.SetTuning(tun)
+		}
+	}
+	rest, err := io.ReadAll(out)
+	assert.NilError(t, err)
+	assert.NilError(t, <-done)
+	assert.Equal(t, len(rest), 200*9)
+}
@@ -0,0 +1,120 @@
+package scala
+
+import (
+	"github.com/pkg/errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ScaleFromSCLFS returns a scale from the SCL file at name in fsys, such as an
+// embed.FS, a zip.Reader or os.DirFS. The scale's Name is the base name of the file.
+func ScaleFromSCLFS(fsys fs.FS, name string) (scale Scale, err error) {
+	var file fs.File
+	if file, err = fsys.Open(name); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", name)
+		return
+	}
+	defer file.Close()
+	if scale, err = ScaleFromSCLStream(file); err != nil {
+		err = errors.Wrapf(withFile(err, name), "Unable to parse file '%s'", name)
+		return
+	}
+	scale.Name = path.Base(name)
+	return
+}
+
+// KeyboardMappingFromKBMFS returns a KeyboardMapping from the KBM file at name in
+// fsys. The mapping's Name is the base name of the file.
+func KeyboardMappingFromKBMFS(fsys fs.FS, name string) (kbm KeyboardMapping, err error) {
+	var file fs.File
+	if file, err = fsys.Open(name); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", name)
+		return
+	}
+	defer file.Close()
+	if kbm, err = KeyboardMappingFromKBMStream(file); err != nil {
+		err = errors.Wrapf(withFile(err, name), "Unable to parse file '%s'", name)
+		return
+	}
+	kbm.Name = path.Base(name)
+	return
+}
+
+// A FileError records a file or directory that LoadFS could not read
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// A Library holds every scale and mapping found by LoadFS, keyed by their path
+// within the file system
+type Library struct {
+	Scales   map[string]Scale
+	Mappings map[string]KeyboardMapping
+	Errors   []*FileError // in path order
+}
+
+// ScalePaths returns the paths of the scales in sorted order
+func (lib Library) ScalePaths() []string {
+	paths := make([]string, 0, len(lib.Scales))
+	for p := range lib.Scales {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// MappingPaths returns the paths of the mappings in sorted order
+func (lib Library) MappingPaths() []string {
+	paths := make([]string, 0, len(lib.Mappings))
+	for p := range lib.Mappings {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// LoadFS loads every .scl and .kbm file (in any letter case) in the tree at root
+// in fsys. A file that cannot be loaded does not stop the walk: its error is
+// recorded in the Library's Errors and the remaining files are still loaded.
+func LoadFS(fsys fs.FS, root string) (lib Library) {
+	lib.Scales = make(map[string]Scale)
+	lib.Mappings = make(map[string]KeyboardMapping)
+	_ = fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// a directory that cannot be read is skipped along with its contents
+			lib.Errors = append(lib.Errors, &FileError{Path: p, Err: err})
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(path.Ext(p)) {
+		case ".scl":
+			if scale, err := ScaleFromSCLFS(fsys, p); err != nil {
+				lib.Errors = append(lib.Errors, &FileError{Path: p, Err: err})
+			} else {
+				lib.Scales[p] = scale
+			}
+		case ".kbm":
+			if kbm, err := KeyboardMappingFromKBMFS(fsys, p); err != nil {
+				lib.Errors = append(lib.Errors, &FileError{Path: p, Err: err})
+			} else {
+				lib.Mappings[p] = kbm
+			}
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,95 @@
+package scala
+
+import (
+	"archive/zip"
+	"bytes"
+	"gotest.tools/v3/assert"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var testFS = fstest.MapFS{
+	"scales/just.scl":     {Data: []byte("! just.scl\n!\nJust\n 2\n!\n 3/2\n 2/1\n")},
+	"scales/OLD/ET12.SCL": {Data: []byte("12 ET\n12\n100.\n200.\n300.\n400.\n500.\n600.\n700.\n800.\n900.\n1000.\n1100.\n2/1\n")},
+	"scales/broken.scl":   {Data: []byte("broken\n3\n3/2\n")},
+	"maps/a440.kbm":       {Data: []byte("0\n0\n127\n60\n69\n440.0\n0\n")},
+	"maps/readme.txt":     {Data: []byte("not a tuning")},
+}
+
+// FS - single files are named by their base name
+func TestFSLoaders(t *testing.T) {
+	s, err := ScaleFromSCLFS(testFS, "scales/just.scl")
+	assert.NilError(t, err)
+	assert.Equal(t, s.Name, "just.scl")
+	assert.Equal(t, s.Count, 2)
+
+	k, err := KeyboardMappingFromKBMFS(testFS, "maps/a440.kbm")
+	assert.NilError(t, err)
+	assert.Equal(t, k.Name, "a440.kbm")
+	assert.Equal(t, k.TuningFrequency, 440.0)
+
+	_, err = ScaleFromSCLFS(testFS, "scales/missing.scl")
+	assert.ErrorContains(t, err, "Unable to open file 'scales/missing.scl'")
+
+	_, err = ScaleFromSCLFS(testFS, "scales/broken.scl")
+	assert.ErrorContains(t, err, "Unable to parse file 'scales/broken.scl'")
+	assert.Equal(t, parseErrorOf(t, err).File, "scales/broken.scl")
+}
+
+// FS - a walk loads every file and collects the errors
+func TestLoadFS(t *testing.T) {
+	lib := LoadFS(testFS, ".")
+	assert.DeepEqual(t, lib.ScalePaths(), []string{"scales/OLD/ET12.SCL", "scales/just.scl"})
+	assert.DeepEqual(t, lib.MappingPaths(), []string{"maps/a440.kbm"})
+	assert.Equal(t, lib.Scales["scales/OLD/ET12.SCL"].Name, "ET12.SCL")
+	assert.Equal(t, len(lib.Errors), 1)
+	assert.Equal(t, lib.Errors[0].Path, "scales/broken.scl")
+	assert.Equal(t, parseErrorOf(t, lib.Errors[0]).Kind, KindToneCount)
+
+	lib = LoadFS(testFS, "maps")
+	assert.Equal(t, len(lib.Scales), 0)
+	assert.Equal(t, len(lib.Mappings), 1)
+
+	lib = LoadFS(testFS, "nowhere")
+	assert.Equal(t, len(lib.Errors), 1)
+	assert.Equal(t, lib.Errors[0].Path, "nowhere")
+}
+
+// FS - the test data directory
+func TestLoadDirFS(t *testing.T) {
+	lib := LoadFS(os.DirFS("testdata"), ".")
+	for _, fname := range testSCLs {
+		_, ok := lib.Scales[fname]
+		assert.Assert(t, ok, fname)
+	}
+	for _, fname := range testKBMs {
+		_, ok := lib.Mappings[fname]
+		assert.Assert(t, ok, fname)
+	}
+	assert.Assert(t, len(lib.Errors) > 0)
+	for _, e := range lib.Errors {
+		assert.Assert(t, strings.HasPrefix(e.Path, "bad/"), e.Path)
+	}
+}
+
+// FS - scales inside a zip archive
+func TestLoadZipFS(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"scales/just.scl", "maps/a440.kbm"} {
+		w, err := zw.Create("pack/" + name)
+		assert.NilError(t, err)
+		_, err = w.Write(testFS[name].Data)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, zw.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NilError(t, err)
+	lib := LoadFS(zr, "pack")
+	assert.Equal(t, len(lib.Errors), 0)
+	assert.Equal(t, lib.Scales["pack/scales/just.scl"].Description, "Just")
+	assert.Equal(t, lib.Mappings["pack/maps/a440.kbm"].Name, "a440.kbm")
+}
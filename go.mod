@@ -1,6 +1,6 @@
 module github.com/chinenual/go-scala
 
-go 1.14
+go 1.16
 
 require (
 	github.com/pkg/errors v0.9.1
@@ -0,0 +1,185 @@
+package scala
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+)
+
+// An isomorphic keyboard is a grid of keys on which every interval has the same shape
+// wherever it is played. The scale degree of a key is a sum of two steps: one for each
+// key to the right, and one for each key up.
+//
+// Keys are given by Row, counting down, and Column, counting to the right along a row.
+// On a square grid the key at (Row-1, Column) is above (Row, Column). On a hex grid rows
+// are offset by half a key and use axial coordinates: (Row-1, Column+1) is up and to the
+// right of (Row, Column), and (Row+1, Column) is down and to the right.
+
+// Grid is the shape of the keys of an isomorphic keyboard
+type Grid int
+
+const (
+	// GridHex for hexagonal keys, as on the Lumatone and other generalized keyboards
+	GridHex Grid = iota
+	// GridSquare for square keys, as on grid controllers
+	GridSquare
+)
+
+var gridNames = []string{"hex", "square"}
+
+func (g Grid) String() string {
+	if g >= 0 && int(g) < len(gridNames) {
+		return gridNames[g]
+	}
+	return "Grid(" + strconv.Itoa(int(g)) + ")"
+}
+
+// An IsomorphicLayout gives the scale degrees of the keys of a grid
+type IsomorphicLayout struct {
+	Grid      Grid
+	RightStep int // the degrees from a key to the key to its right
+	UpStep    int // the degrees from a key to the key up and to its right on a hex grid, or above it on a square grid
+}
+
+// WickiHaydenLayout returns the Wicki-Hayden layout, with whole tones to the right and fifths
+// upwards, for the given steps of a scale. NearestDegree finds them for any scale.
+func WickiHaydenLayout(grid Grid, wholeTone int, fifth int) IsomorphicLayout {
+	return IsomorphicLayout{Grid: grid, RightStep: wholeTone, UpStep: fifth}
+}
+
+// BosanquetLayout returns the Bosanquet layout, with whole tones to the right and diatonic
+// semitones upwards, for the given steps of a scale
+func BosanquetLayout(grid Grid, wholeTone int, semitone int) IsomorphicLayout {
+	return IsomorphicLayout{Grid: grid, RightStep: wholeTone, UpStep: semitone}
+}
+
+// JankoLayout returns the Janko layout, with rows of whole tones a semitone apart,
+// for the given semitone step of a scale
+func JankoLayout(grid Grid, semitone int) IsomorphicLayout {
+	return IsomorphicLayout{Grid: grid, RightStep: 2 * semitone, UpStep: semitone}
+}
+
+// Degree returns the degree of the scale the key plays, counting periods, relative to
+// the key at row 0 and column 0
+func (l IsomorphicLayout) Degree(row int, column int) int {
+	if l.Grid == GridSquare {
+		return l.RightStep*column - l.UpStep*row
+	}
+	return l.RightStep*column + (l.RightStep-l.UpStep)*row
+}
+
+// Position returns the period of a scale with count notes, and the position 0..count-1 of
+// the scale within it, that the key plays
+func (l IsomorphicLayout) Position(count int, row int, column int) (period int, position int) {
+	period, position = periodAndPosition(l.Degree(row, column), count)
+	return
+}
+
+// periodAndPosition splits degree d of a scale with count notes into the period and the
+// position within it
+func periodAndPosition(d int, count int) (period int, position int) {
+	period, position = d/count, d%count
+	if position < 0 {
+		position += count
+		period--
+	}
+	return
+}
+
+// degreeCents returns the cents of degree d of s above degree 0, which may be in another period
+func degreeCents(s Scale, d int) float64 {
+	periods, i := periodAndPosition(d, s.Count)
+	cents := float64(periods) * s.Tones[s.Count-1].Cents
+	if i > 0 {
+		cents += s.Tones[i-1].Cents
+	}
+	return cents
+}
+
+// NearestDegree returns the degree of s, counting periods, nearest to cents above degree 0
+func NearestDegree(s Scale, cents float64) (d int) {
+	if s.Count <= 0 || s.Tones[s.Count-1].Cents <= 0 {
+		return
+	}
+	d = int(math.Floor(cents/s.Tones[s.Count-1].Cents)) * s.Count
+	for math.Abs(degreeCents(s, d+1)-cents) < math.Abs(degreeCents(s, d)-cents) {
+		d++
+	}
+	for math.Abs(degreeCents(s, d-1)-cents) < math.Abs(degreeCents(s, d)-cents) {
+		d--
+	}
+	return
+}
+
+// A GridKey is the position of a key on a grid
+type GridKey struct {
+	Row, Column int
+}
+
+// An IsomorphicKey is the assignment of one key of an IsomorphicMapping
+type IsomorphicKey struct {
+	GridKey
+	Degree    int // the degree of the scale, counting periods, relative to row 0 and column 0
+	Period    int // the period of the degree
+	Position  int // the position of the scale within the period, 0..Count-1
+	Channel   int // the MIDI channel 0..15 it sends on
+	Note      int // the MIDI note it sends
+	Frequency float64
+}
+
+// An IsomorphicMapping assigns a scale to the keys of a grid. Since it can span more than
+// 128 notes, it sends on as many MIDI channels as it needs: the lowest degree is note 0
+// of channel 0 and the degrees continue up through the notes of each channel in turn.
+type IsomorphicMapping struct {
+	Keys     []IsomorphicKey
+	Tunings  []Tuning // the tuning of the notes of each channel the mapping uses
+	channels ChannelTuning
+}
+
+// ChannelTuning returns the tunings of the channels the mapping uses as one ChannelTuning
+func (m IsomorphicMapping) ChannelTuning() ChannelTuning {
+	return m.channels
+}
+
+// Map lays s out on keys, with degree 0 at row 0 and column 0 tuned to frequency, or to
+// middle C of standard tuning if frequency is 0. s need not repeat at the octave.
+func (l IsomorphicLayout) Map(s Scale, frequency float64, keys []GridKey) (m IsomorphicMapping, err error) {
+	if s.Count <= 0 {
+		err = errors.Errorf("Unable to lay out a scale with no notes. Your scale provided %v notes.", s.Count)
+		return
+	}
+	if len(keys) == 0 {
+		err = errors.New("Unable to lay out a scale on no keys")
+		return
+	}
+	lowest := math.MaxInt32
+	m.Keys = make([]IsomorphicKey, len(keys))
+	for i, gk := range keys {
+		k := &m.Keys[i]
+		k.GridKey = gk
+		k.Degree = l.Degree(gk.Row, gk.Column)
+		k.Period, k.Position = periodAndPosition(k.Degree, s.Count)
+		lowest = imin(lowest, k.Degree)
+	}
+	channels := 0
+	for i := range m.Keys {
+		k := &m.Keys[i]
+		k.Channel, k.Note = (k.Degree-lowest)/128, (k.Degree-lowest)%128
+		channels = imax(channels, k.Channel+1)
+	}
+	if channels > 16 {
+		err = errors.Errorf("Layout spans %d notes, more than 16 MIDI channels can send", channels*128)
+		return
+	}
+	if m.channels, err = ChannelTuningFromOffsets(s, frequency, ContiguousChannelOffsets(lowest)); err != nil {
+		return
+	}
+	for ch := 0; ch < channels; ch++ {
+		m.Tunings = append(m.Tunings, m.channels.Channel(ch))
+	}
+	for i := range m.Keys {
+		k := &m.Keys[i]
+		k.Frequency = m.Tunings[k.Channel].FrequencyForMidiNote(k.Note)
+	}
+	return
+}
@@ -0,0 +1,115 @@
+package scala
+
+import (
+	"gotest.tools/v3/assert"
+	"math"
+	"testing"
+)
+
+// Isomorphic - degrees of the neighbours of a key
+func TestIsomorphicDegree(t *testing.T) {
+	hex := WickiHaydenLayout(GridHex, 2, 7)
+	assert.Equal(t, hex.Degree(0, 0), 0)
+	assert.Equal(t, hex.Degree(0, 1), 2)
+	assert.Equal(t, hex.Degree(-1, 1), 7)
+	assert.Equal(t, hex.Degree(-1, 0), 5)
+	assert.Equal(t, hex.Degree(1, 0), -5)
+	assert.Equal(t, hex.Degree(-2, 1), 12)
+
+	square := WickiHaydenLayout(GridSquare, 2, 7)
+	assert.Equal(t, square.Degree(-1, 0), 7)
+	assert.Equal(t, square.Degree(1, 1), -5)
+
+	janko := JankoLayout(GridHex, 1)
+	assert.Equal(t, janko.Degree(0, 1), 2)
+	assert.Equal(t, janko.Degree(-1, 1), 1)
+	assert.Equal(t, janko.Degree(-1, 0), -1)
+
+	assert.Equal(t, GridHex.String(), "hex")
+	assert.Equal(t, Grid(7).String(), "Grid(7)")
+}
+
+// Isomorphic - periods and positions, below degree 0 too
+func TestIsomorphicPosition(t *testing.T) {
+	l := BosanquetLayout(GridHex, 5, 3)
+	for _, c := range []struct {
+		row, column      int
+		period, position int
+	}{
+		{0, 0, 0, 0},
+		{0, 6, 0, 30},
+		{0, 7, 1, 4},
+		{0, -1, -1, 26},
+		{2, -1, -1, 30},
+	} {
+		period, position := l.Position(31, c.row, c.column)
+		assert.Equal(t, period, c.period, c)
+		assert.Equal(t, position, c.position, c)
+	}
+}
+
+// Isomorphic - nearest degrees
+func TestIsomorphicNearestDegree(t *testing.T) {
+	s31, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	assert.Equal(t, NearestDegree(s31, 701.955), 18)
+	assert.Equal(t, NearestDegree(s31, 203.91), 5)
+	assert.Equal(t, NearestDegree(s31, -701.955), -18)
+	assert.Equal(t, NearestDegree(s31, 1901.955), 49)
+
+	bp, err := ScaleEvenDivisionOfSpanByM(3, 13)
+	assert.NilError(t, err)
+	assert.Equal(t, NearestDegree(bp, 1200.0*math.Log2(3)), 13)
+	assert.Equal(t, NearestDegree(bp, 1200.0*math.Log2(5.0/3.0)), 6)
+	assert.Equal(t, NearestDegree(Scale{}, 100), 0)
+}
+
+// Isomorphic - a non-octave scale over many channels
+func TestIsomorphicMapBohlenPierce(t *testing.T) {
+	bp, err := ScaleEvenDivisionOfSpanByM(3, 13)
+	assert.NilError(t, err)
+	l := IsomorphicLayout{Grid: GridSquare, RightStep: 2, UpStep: 13}
+	var keys []GridKey
+	for row := -10; row < 10; row++ {
+		for column := -8; column < 8; column++ {
+			keys = append(keys, GridKey{Row: row, Column: column})
+		}
+	}
+	m, err := l.Map(bp, 220.0, keys)
+	assert.NilError(t, err)
+	assert.Equal(t, len(m.Keys), len(keys))
+	assert.Assert(t, len(m.Tunings) > 1)
+
+	lowest := m.Keys[0].Degree
+	for _, k := range m.Keys {
+		lowest = imin(lowest, k.Degree)
+	}
+	for _, k := range m.Keys {
+		assert.Equal(t, k.Degree, l.Degree(k.Row, k.Column))
+		assert.Equal(t, k.Period*13+k.Position, k.Degree)
+		assert.Equal(t, k.Channel*128+k.Note, k.Degree-lowest)
+		want := 220.0 * math.Pow(3.0, float64(k.Degree)/13.0)
+		assert.Equal(t, "", approxEqual(1e-6*want, k.Frequency, want), k)
+		assert.Equal(t, k.Frequency, m.Tunings[k.Channel].FrequencyForMidiNote(k.Note))
+		assert.Equal(t, m.Tunings[k.Channel].ScalePositionForMidiNote(k.Note), k.Position)
+	}
+	// the key below plays a tritave lower
+	assert.Equal(t, "", approxEqual(1e-9, m.Keys[16].Frequency/m.Keys[0].Frequency, 1.0/3.0))
+}
+
+// Isomorphic - errors
+func TestIsomorphicMapErrors(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("12-intune.scl"))
+	assert.NilError(t, err)
+	l := WickiHaydenLayout(GridHex, 2, 7)
+	_, err = l.Map(Scale{}, 0, []GridKey{{}})
+	assert.ErrorContains(t, err, "no notes")
+	_, err = l.Map(s, 0, nil)
+	assert.ErrorContains(t, err, "no keys")
+	_, err = l.Map(s, 0, []GridKey{{Row: 0, Column: -2000}, {Row: 0, Column: 2000}})
+	assert.ErrorContains(t, err, "16 MIDI channels")
+
+	m, err := l.Map(s, 0, []GridKey{{}})
+	assert.NilError(t, err)
+	assert.Equal(t, "", approxEqual(1e-6, m.Keys[0].Frequency, midi0Freq*32.0))
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"unicode"
@@ -30,10 +32,26 @@ type KeyboardMapping struct {
 	Keys               []int // rather than an 'x' we use a '-1' for skipped keys
 	RawText            string
 	Name               string
+	Encoding           Encoding // the character encoding of the KBM file; RawText is converted to UTF-8
 }
 
 // KeyboardMappingFromKBMStream returns a KeyboardMapping from a KBM input stream
 func KeyboardMappingFromKBMStream(rdr io.Reader) (kbm KeyboardMapping, err error) {
+	_, kbm, _, err = parseKBM(rdr, ParseOptions{})
+	return
+}
+
+// KeyboardMappingFromKBMStreamWithOptions returns a KeyboardMapping from a KBM
+// input stream, parsed according to opts. In ParseLenient mode, the problems
+// that were recovered from are returned as warnings.
+func KeyboardMappingFromKBMStreamWithOptions(rdr io.Reader, opts ParseOptions) (kbm KeyboardMapping, warnings []*ParseError, err error) {
+	_, kbm, warnings, err = parseKBM(rdr, opts)
+	return
+}
+
+// parseKBM reads a KBM stream, returning both the line by line document
+// and the KeyboardMapping it describes
+func parseKBM(rdr io.Reader, opts ParseOptions) (doc KBMDocument, kbm KeyboardMapping, warnings []*ParseError, err error) {
 	type stateType int
 	const (
 		mapSize stateType = iota
@@ -46,92 +64,167 @@ func KeyboardMappingFromKBMStream(rdr io.Reader) (kbm KeyboardMapping, err error
 		keys
 		trailing
 	)
+	// problem reports a parse error. In lenient mode it is recorded as a
+	// warning and parsing continues; otherwise it ends the parse.
+	problem := func(pe *ParseError) bool {
+		if opts.Mode == ParseLenient {
+			warnings = append(warnings, pe)
+			return true
+		}
+		err = pe
+		return false
+	}
+	// the values used in lenient mode for header fields that cannot be parsed
+	defaults := []float64{0, 0, 127, 60, 69, 440.0, 0}
+	// the range of values allowed in strict mode for each header field
+	minimums := []float64{0, 0, 0, 0, 0, math.SmallestNonzeroFloat64, 0}
+	maximums := []float64{math.MaxInt32, 127, 127, 127, 127, math.MaxFloat64, math.MaxInt32}
 
 	state := mapSize
-	scanner := bufio.NewScanner(rdr)
+	// RawText is built up as the lines are read, and set however the parse ends
+	var rawText strings.Builder
+	lines := opts.newLineReader(rdr)
+	defer func() {
+		kbm.RawText = rawText.String()
+		if lines.raw != nil {
+			kbm.RawText = lines.raw.String()
+		}
+		kbm.Encoding = lines.encoding
+		doc.Encoding = lines.encoding
+	}()
 	lineno := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-		if lineno == 0 {
+	for lines.Scan() {
+		line, eol := splitEOL(lines.Text())
+		if lineno > 0 {
 			// don't add a newline before the first character
-			kbm.RawText = line
-		} else {
-			kbm.RawText = kbm.RawText + "\n" + line
+			rawText.WriteString("\n")
 		}
+		rawText.WriteString(line)
 		lineno++
+		if err = opts.checkLineLength(line, lineno); err != nil {
+			return
+		}
+		docLine := DocumentLine{Text: line, EOL: eol}
 		line = strings.TrimRight(line, "\t ")
 		if len(line) > 0 && line[0] == '!' {
+			docLine.Role = LineComment
+			doc.Lines = append(doc.Lines, docLine)
+			continue
+		}
+		if state == trailing {
+			if len(line) == 0 {
+				docLine.Role = LineBlank
+			} else {
+				docLine.Role = LineTrailing
+				if opts.Mode != ParseDefault {
+					if !problem(newParseError(KindTrailing, lineno, line, line, nil, "Unexpected text after the last key")) {
+						return
+					}
+				}
+			}
+			doc.Lines = append(doc.Lines, docLine)
 			continue
 		}
+		kind := KindBadHeader
+		if state >= keys {
+			kind = KindBadKey
+		}
+		if len(line) == 0 && opts.Mode == ParseLenient {
+			warnings = append(warnings, &ParseError{Line: lineno, Kind: kind, Msg: "Blank line in the mapping"})
+			docLine.Role = LineBlank
+			doc.Lines = append(doc.Lines, docLine)
+			continue
+		}
+		if opts.Mode == ParseLenient {
+			// the value is the first field, and anything after it is a comment
+			if fields := strings.Fields(line); len(fields) > 0 {
+				line = fields[0]
+			}
+		}
 		if line == "x" {
 			line = "-1"
-		} else if state != trailing {
+		} else if opts.Mode != ParseLenient {
 			for i := 0; i < len(line); i++ {
 				r := rune(line[i])
-				// difference vs. C++ - the scanner strips line endings so no need to check for CR and LF
+				// difference vs. C++ - the line reader strips line endings so no need to check for CR and LF
 				if !(line[i] == ' ' || unicode.IsDigit(r) || line[i] == '.') {
-					err = errors.Errorf("Invalid line %d.  line=\"%s\". Bad character is '%c'/%d", lineno, line, line[i], line[i])
+					err = &ParseError{Line: lineno, Column: i + 1, Kind: KindBadCharacter, Text: line[i : i+1],
+						Msg: fmt.Sprintf("Invalid line. Bad character is '%c'/%d", line[i], line[i])}
 					return
 				}
 			}
 		}
-		asInt := func() (i int, err error) {
+		var value float64
+		var perr *ParseError
+		if state == freq {
+			if value, err = strconv.ParseFloat(line, 64); err != nil {
+				perr = newParseError(kind, lineno, docLine.Text, strings.TrimSpace(line), err, "Invalid line. Could not parse as a floating point number")
+			}
+		} else {
 			var v int64
 			if v, err = strconv.ParseInt(line, 10, 32); err != nil {
-				err = errors.Wrapf(err, "Invalid line %d.  line=\"%s\". Could not parse as a integer number", lineno, line)
-				return
+				perr = newParseError(kind, lineno, docLine.Text, strings.TrimSpace(line), err, "Invalid line. Could not parse as a integer number")
 			}
-			i = int(v)
-			return
+			value = float64(v)
+		}
+		err = nil
+		if perr == nil && state < keys && opts.Mode != ParseDefault && (value < minimums[state] || value > maximums[state]) {
+			msg := fmt.Sprintf("Value must be between %v and %v", minimums[state], maximums[state])
+			if state == freq {
+				msg = "Frequency must be a positive number"
+			}
+			perr = newParseError(KindRange, lineno, docLine.Text, strings.TrimSpace(line), nil, msg)
+		}
+		if perr == nil && state == keys && opts.Mode != ParseDefault && value < -1 {
+			perr = newParseError(KindRange, lineno, docLine.Text, strings.TrimSpace(line), nil, "Key must be a scale degree or x")
 		}
-		asFloat := func() (v float64, err error) {
-			if v, err = strconv.ParseFloat(line, 64); err != nil {
-				err = errors.Wrapf(err, "Invalid line %d.  line=\"%s\". Could not parse as a floating point number", lineno, line)
+		if perr != nil {
+			if !problem(perr) {
 				return
 			}
-			return
+			if state < keys {
+				value = defaults[state]
+				if state == degree {
+					value = float64(kbm.Count)
+				}
+			} else {
+				value = -1
+			}
+		}
+
+		if state < keys {
+			// the header states are in the same order as the KBMField constants
+			docLine.Role = LineHeader
+			docLine.Index = int(state)
 		}
 		switch state {
 		case mapSize:
-			if kbm.Count, err = asInt(); err != nil {
+			if err = opts.checkCount(int(value), lineno); err != nil {
 				return
 			}
+			kbm.Count = int(value)
 		case firstMidi:
-			if kbm.FirstMidi, err = asInt(); err != nil {
-				return
-			}
+			kbm.FirstMidi = int(value)
 		case lastMidi:
-			if kbm.LastMidi, err = asInt(); err != nil {
-				return
-			}
+			kbm.LastMidi = int(value)
 		case middle:
-			if kbm.MiddleNote, err = asInt(); err != nil {
-				return
-			}
+			kbm.MiddleNote = int(value)
 		case reference:
-			if kbm.TuningConstantNote, err = asInt(); err != nil {
-				return
-			}
+			kbm.TuningConstantNote = int(value)
 		case freq:
-			if kbm.TuningFrequency, err = asFloat(); err != nil {
-				return
-			}
+			kbm.TuningFrequency = value
 			kbm.TuningPitch = kbm.TuningFrequency / midi0Freq
 		case degree:
-			if kbm.OctaveDegrees, err = asInt(); err != nil {
-				return
-			}
+			kbm.OctaveDegrees = int(value)
 		case keys:
-			var i int
-			if i, err = asInt(); err != nil {
-				return
-			}
-			kbm.Keys = append(kbm.Keys, i)
+			docLine.Role = LineKey
+			docLine.Index = len(kbm.Keys)
+			kbm.Keys = append(kbm.Keys, int(value))
 			if len(kbm.Keys) == kbm.Count {
 				state = trailing
 			}
-		case trailing:
 		}
+		doc.Lines = append(doc.Lines, docLine)
 		if !(state == keys || state == trailing) {
 			state = state + 1
 		}
@@ -139,21 +232,42 @@ func KeyboardMappingFromKBMStream(rdr io.Reader) (kbm KeyboardMapping, err error
 			state = trailing
 		}
 	}
-	if err = scanner.Err(); err != nil {
+	if err = opts.scanError(lines.Err(), lineno); err != nil {
 		return
 	}
 	if !(state == keys || state == trailing) {
-		err = errors.Errorf("Incomplete KBM file.  Unable to get keys section of file.")
+		err = &ParseError{Line: lineno, Kind: KindIncomplete, Msg: "Incomplete KBM file.  Unable to get keys section of file."}
 		return
 	}
 	if len(kbm.Keys) != kbm.Count {
-		err = errors.Errorf("Different number of keys than mapping file indicates. Count is %d and we parsed %d keys",
-			kbm.Count, len(kbm.Keys))
-		return
+		if opts.Mode == ParseDefault || len(kbm.Keys) > kbm.Count {
+			err = &ParseError{Line: lineno, Kind: KindKeyCount,
+				Msg: fmt.Sprintf("Different number of keys than mapping file indicates. Count is %d and we parsed %d keys",
+					kbm.Count, len(kbm.Keys))}
+			return
+		}
+		if opts.Mode == ParseLenient {
+			warnings = append(warnings, &ParseError{Line: lineno, Kind: KindKeyCount,
+				Msg: fmt.Sprintf("Mapping of %d keys has only %d keys; the rest are unmapped", kbm.Count, len(kbm.Keys))})
+		}
+		// as in Scala, unmapped keys at the end of the mapping may be left out, but
+		// without a limit a short file could ask for any number of them
+		if opts.MaxTones == 0 && kbm.Count-len(kbm.Keys) > maxOmittedKeys {
+			err = &ParseError{Line: lineno, Kind: KindLimit,
+				Msg: fmt.Sprintf("Mapping of %d keys leaves out more than the limit of %d keys", kbm.Count, maxOmittedKeys)}
+			return
+		}
+		for len(kbm.Keys) < kbm.Count {
+			kbm.Keys = append(kbm.Keys, -1)
+		}
 	}
 	return
 }
 
+// maxOmittedKeys is the number of unmapped keys that may be left out of the end of a KBM file
+// read with ParseStrict or ParseLenient when ParseOptions.MaxTones is 0
+const maxOmittedKeys = 1 << 16
+
 // KeyboardMappingFromKBMFile returns a KeyboardMapping from a KBM file name
 func KeyboardMappingFromKBMFile(fname string) (kbm KeyboardMapping, err error) {
 	var file *os.File
@@ -163,7 +277,7 @@ func KeyboardMappingFromKBMFile(fname string) (kbm KeyboardMapping, err error) {
 	}
 	defer file.Close()
 	if kbm, err = KeyboardMappingFromKBMStream(file); err != nil {
-		err = errors.Wrapf(err, "Unable to parse file '%s'", fname)
+		err = errors.Wrapf(withFile(err, fname), "Unable to parse file '%s'", fname)
 		return
 	}
 	kbm.Name = fname
@@ -180,6 +294,124 @@ func KeyboardMappingFromKBMString(kbmContents string) (kbm KeyboardMapping, err
 	return
 }
 
+// WriteKBM writes the mapping to w in KBM format: the seven header fields
+// followed by the keys, with "x" for unmapped (-1) keys. When comments is true,
+// each field is preceded by an explanatory comment in the style of Scala's
+// KBM template.
+func (kbm KeyboardMapping) WriteKBM(w io.Writer, comments bool) (err error) {
+	header := ""
+	if kbm.Name != "" {
+		header = filepath.Base(kbm.Name)
+	}
+	err = kbm.writeKBM(w, header, comments)
+	return
+}
+
+// kbmField is an integer field of the KBM header, with the comment written before it
+type kbmField struct {
+	comment string
+	value   int
+}
+
+func (kbm KeyboardMapping) headerFields() []kbmField {
+	return []kbmField{
+		{"Size of map. The pattern repeats every so many keys:", kbm.Count},
+		{"First MIDI note number to retune:", kbm.FirstMidi},
+		{"Last MIDI note number to retune:", kbm.LastMidi},
+		{"Middle note where the first entry of the mapping is mapped to:", kbm.MiddleNote},
+		{"Reference note for which frequency is given:", kbm.TuningConstantNote},
+	}
+}
+
+func (kbm KeyboardMapping) writeKBM(w io.Writer, header string, comments bool) (err error) {
+	if kbm.Count != len(kbm.Keys) {
+		err = errors.Errorf("Different number of keys than mapping indicates. Count is %d and there are %d keys",
+			kbm.Count, len(kbm.Keys))
+		return
+	}
+	fields := kbm.headerFields()
+	for _, f := range fields {
+		if f.value < 0 {
+			err = errors.Errorf("Unable to write negative value %d for field \"%s\"", f.value, f.comment)
+			return
+		}
+	}
+	if kbm.OctaveDegrees < 0 {
+		err = errors.Errorf("Unable to write negative octave degree %d", kbm.OctaveDegrees)
+		return
+	}
+	if !(kbm.TuningFrequency > 0) || math.IsInf(kbm.TuningFrequency, 0) {
+		err = errors.Errorf("Unable to write tuning frequency %v: must be a positive number", kbm.TuningFrequency)
+		return
+	}
+	for i, key := range kbm.Keys {
+		if key < -1 {
+			err = errors.Errorf("Unable to write key %d: invalid scale degree %d", i, key)
+			return
+		}
+	}
+	err = kbm.formatKBM(w, header, comments)
+	return
+}
+
+// formatKBM writes the mapping in KBM format without checking that it can be read back
+func (kbm KeyboardMapping) formatKBM(w io.Writer, header string, comments bool) (err error) {
+	fields := kbm.headerFields()
+	bw := bufio.NewWriter(w)
+	comment := func(c string) {
+		if comments {
+			fmt.Fprintf(bw, "! %s\n", c)
+		}
+	}
+	if header != "" {
+		fmt.Fprintf(bw, "! %s\n", header)
+		fmt.Fprintf(bw, "!\n")
+	}
+	for _, f := range fields {
+		comment(f.comment)
+		fmt.Fprintf(bw, "%d\n", f.value)
+	}
+	comment("Frequency to tune the above note to (floating point e.g. 440.0):")
+	fmt.Fprintf(bw, "%s\n", strconv.FormatFloat(kbm.TuningFrequency, 'f', -1, 64))
+	comment("Scale degree to consider as formal octave:")
+	fmt.Fprintf(bw, "%d\n", kbm.OctaveDegrees)
+	comment("Mapping.")
+	if kbm.Count > 0 {
+		comment("The numbers represent scale degrees mapped to keys. The first entry is for")
+		comment("the given middle note, the next for subsequent higher keys.")
+		comment("For an unmapped key, put in an \"x\".")
+	}
+	for _, key := range kbm.Keys {
+		if key < 0 {
+			fmt.Fprintf(bw, "x\n")
+		} else {
+			fmt.Fprintf(bw, "%d\n", key)
+		}
+	}
+	err = bw.Flush()
+	return
+}
+
+// MarshalText returns the mapping in KBM format, with comments (see WriteKBM)
+func (kbm KeyboardMapping) MarshalText() (text []byte, err error) {
+	var buf strings.Builder
+	if err = kbm.WriteKBM(&buf, true); err != nil {
+		return
+	}
+	text = []byte(buf.String())
+	return
+}
+
+// UnmarshalText replaces the mapping with one parsed from KBM file contents
+func (kbm *KeyboardMapping) UnmarshalText(text []byte) (err error) {
+	var k KeyboardMapping
+	if k, err = KeyboardMappingFromKBMString(string(text)); err != nil {
+		return
+	}
+	*kbm = k
+	return
+}
+
 // KeyboardMappingTuneA69To creates a KeyboardMapping which keeps the midi note 69 (A4) set
 // to a constant frequency, given
 func KeyboardMappingTuneA69To(freq float64) (kbm KeyboardMapping, err error) {
@@ -197,23 +429,30 @@ func KeyboardMappingTuneNoteTo(midiNote int, freq float64) (kbm KeyboardMapping,
 // KeyboardMappingStartScaleOnAndTuneNoteTo generates a KBM where scaleStart is the note 0
 // of the scale, where midiNote is the tuned note, and where feq is the frequency
 func KeyboardMappingStartScaleOnAndTuneNoteTo(scaleStart int, midiNote int, freq float64) (kbm KeyboardMapping, err error) {
-	buf := "! Automatically generated mapping, tuning note " + strconv.Itoa(midiNote) + " to " + fmt.Sprintf("%f", freq) + " Hz\n"
-	buf += "!\n"
-	buf += "! Size of map\n"
-	buf += "0\n"
-	buf += "! First and last MIDI notes to map - map the entire keyboard\n"
-	buf += "0\n"
-	buf += "127\n"
-	buf += "! Middle note where the first entry in the scale is mapped.\n"
-	buf += strconv.Itoa(scaleStart) + "\n"
-	buf += "! Reference note where frequency is fixed\n"
-	buf += strconv.Itoa(midiNote) + "\n"
-	buf += "! Frequency for MIDI note " + strconv.Itoa(midiNote) + "\n"
-	buf += fmt.Sprintf("%f", freq) + "\n"
-	buf += "! Scale degree for formal octave. This is am empty mapping, so:\n"
-	buf += "0\n"
-	buf += "! Mapping. This is an empty mapping so list no keys\n"
-	kbm, err = KeyboardMappingFromKBMString(buf)
+	if scaleStart < 0 || midiNote < 0 {
+		err = errors.Errorf("Unable to generate mapping: notes must not be negative, not %d and %d", scaleStart, midiNote)
+		return
+	}
+	if !(freq >= 0) || math.IsInf(freq, 0) {
+		err = errors.Errorf("Unable to generate mapping: frequency %v must not be negative", freq)
+		return
+	}
+	kbm.Count = 0
+	kbm.FirstMidi = 0
+	kbm.LastMidi = 127
+	kbm.MiddleNote = scaleStart
+	kbm.TuningConstantNote = midiNote
+	kbm.TuningFrequency = freq
+	kbm.TuningPitch = kbm.TuningFrequency / midi0Freq
+	kbm.OctaveDegrees = 0
+	kbm.Name = "Mapping from patch"
+
+	var buf strings.Builder
+	header := "Automatically generated mapping, tuning note " + strconv.Itoa(midiNote) + " to " + fmt.Sprintf("%f", freq) + " Hz"
+	if err = kbm.formatKBM(&buf, header, true); err != nil {
+		return
+	}
+	kbm.RawText = strings.TrimSuffix(buf.String(), "\n")
 	return
 }
 
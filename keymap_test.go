@@ -4,6 +4,8 @@ import (
 	"gotest.tools/v3/assert"
 	"math"
 	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -81,3 +83,87 @@ func TestIssue42KBMs(tt *testing.T) {
 	assert.NilError(tt, err)
 	assert.Equal(tt, k.Count, 0)
 }
+
+// Writing KBM files - written mappings read back unchanged
+func TestWriteKBMRoundTrip(tt *testing.T) {
+	for _, fname := range append(testKBMs, "128.kbm", "piano.kbm") {
+		k, err := KeyboardMappingFromKBMFile(testFile(fname))
+		assert.NilError(tt, err)
+		for _, comments := range []bool{true, false} {
+			var buf strings.Builder
+			assert.NilError(tt, k.WriteKBM(&buf, comments), fname)
+
+			reread, err := KeyboardMappingFromKBMString(buf.String())
+			assert.NilError(tt, err, fname)
+			assert.Equal(tt, reread.Count, k.Count, fname)
+			assert.Equal(tt, reread.FirstMidi, k.FirstMidi, fname)
+			assert.Equal(tt, reread.LastMidi, k.LastMidi, fname)
+			assert.Equal(tt, reread.MiddleNote, k.MiddleNote, fname)
+			assert.Equal(tt, reread.TuningConstantNote, k.TuningConstantNote, fname)
+			assert.Equal(tt, reread.TuningFrequency, k.TuningFrequency, fname)
+			assert.Equal(tt, reread.OctaveDegrees, k.OctaveDegrees, fname)
+			assert.DeepEqual(tt, reread.Keys, k.Keys)
+		}
+	}
+}
+
+// Writing KBM files - unmapped keys and comments
+func TestWriteKBMUnmappedKeys(tt *testing.T) {
+	k, err := KeyboardMappingFromKBMFile(testFile("mapping-whitekeys-a440.kbm"))
+	assert.NilError(tt, err)
+	var buf strings.Builder
+	assert.NilError(tt, k.WriteKBM(&buf, false))
+	assert.Equal(tt, buf.String(), "! mapping-whitekeys-a440.kbm\n!\n12\n0\n127\n60\n69\n440\n7\n0\nx\n1\nx\n2\n3\nx\n4\nx\n5\nx\n6\n")
+
+	buf.Reset()
+	assert.NilError(tt, k.WriteKBM(&buf, true))
+	assert.Check(tt, strings.Contains(buf.String(), "! Reference note for which frequency is given:\n69\n"))
+
+	k.Keys = k.Keys[1:]
+	assert.ErrorContains(tt, k.WriteKBM(&buf, true), "Different number of keys")
+}
+
+// Built in Generators - KBM Generator arguments are checked
+func TestBuiltinGeneratorsKBMGeneratorChecked(tt *testing.T) {
+	k, err := KeyboardMappingStartScaleOnAndTuneNoteTo(60, 69, 0)
+	assert.NilError(tt, err)
+	assert.Equal(tt, k.TuningFrequency, 0.0)
+	assert.Check(tt, strings.Contains(k.RawText, "\n0\n"))
+
+	_, err = KeyboardMappingTuneNoteTo(-1, 440)
+	assert.ErrorContains(tt, err, "must not be negative")
+	_, err = KeyboardMappingStartScaleOnAndTuneNoteTo(-60, 69, 440)
+	assert.ErrorContains(tt, err, "must not be negative")
+	for _, freq := range []float64{-440, math.NaN(), math.Inf(1)} {
+		_, err = KeyboardMappingTuneNoteTo(69, freq)
+		assert.ErrorContains(tt, err, "frequency", freq)
+	}
+}
+
+// largeKBM returns a KBM file which maps n keys
+func largeKBM(n int) string {
+	var buf strings.Builder
+	buf.WriteString("! large.kbm\n" + strconv.Itoa(n) + "\n0\n127\n60\n69\n440.0\n" + strconv.Itoa(n) + "\n")
+	for i := 0; i < n; i++ {
+		buf.WriteString(strconv.Itoa(i) + "\n")
+	}
+	return buf.String()
+}
+
+func benchmarkKeyboardMappingFromKBMStream(b *testing.B, n int) {
+	text := largeKBM(n)
+	b.SetBytes(int64(len(text)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := KeyboardMappingFromKBMStream(strings.NewReader(text)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeyboardMappingFromKBMStream100(b *testing.B) {
+	benchmarkKeyboardMappingFromKBMStream(b, 100)
+}
+func BenchmarkKeyboardMappingFromKBMStream10000(b *testing.B) {
+	benchmarkKeyboardMappingFromKBMStream(b, 10000)
+}
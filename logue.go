@@ -0,0 +1,327 @@
+package scala
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Korg's logue series synths load user tunings from zip bundles made by their librarians.
+// A bundle has a FileInformation.xml listing its contents, and for each tuning a small
+// XML information file and a binary table. A user scale (TunS) table tunes all 128 notes
+// and a user octave (TunO) table tunes the 12 notes of the lowest octave, which the synth
+// repeats in every octave. Each note takes the three bytes of MTS frequency data, so the
+// error of each note is reported as for the MTS messages.
+
+// LogueProduct identifies a synth of the logue series
+type LogueProduct int
+
+const (
+	// LogueMinilogueXD for the minilogue xd, whose files are .mnlgtunes and .mnlgtuneo
+	LogueMinilogueXD LogueProduct = iota
+	// LoguePrologue for the prologue, whose files are .prlgtunes and .prlgtuneo
+	LoguePrologue
+	// LogueNTS1 for the NTS-1 digital kit, whose files are .ntkdigtunes and .ntkdigtuneo
+	LogueNTS1
+)
+
+var logueProducts = []struct {
+	name      string // the Product of FileInformation.xml
+	prefix    string // the start of the root element of the information files
+	extension string // the start of the file extensions
+}{
+	{"minilogue xd", "minilogue_xd", ".mnlgtune"},
+	{"prologue", "prologue", ".prlgtune"},
+	{"NTS-1 digital kit", "NTS-1_digital_kit", ".ntkdigtune"},
+}
+
+func (p LogueProduct) String() string {
+	if p >= 0 && int(p) < len(logueProducts) {
+		return logueProducts[p].name
+	}
+	return "LogueProduct(" + strconv.Itoa(int(p)) + ")"
+}
+
+// ScaleExtension returns the file extension of the product's user scale bundles, or "" for
+// an unknown product
+func (p LogueProduct) ScaleExtension() string {
+	if p.validate() != nil {
+		return ""
+	}
+	return logueProducts[p].extension + "s"
+}
+
+// OctaveExtension returns the file extension of the product's user octave bundles, or "" for
+// an unknown product
+func (p LogueProduct) OctaveExtension() string {
+	if p.validate() != nil {
+		return ""
+	}
+	return logueProducts[p].extension + "o"
+}
+
+func (p LogueProduct) validate() error {
+	if p < 0 || int(p) >= len(logueProducts) {
+		return errors.Errorf("Unknown logue product %d", int(p))
+	}
+	return nil
+}
+
+// LogueOptions controls the logue bundle writers
+type LogueOptions struct {
+	Product    LogueProduct
+	Programmer string         // the programmer in the information file
+	Comment    string         // the comment in the information file
+	Unmapped   UnmappedPolicy // the tuning of notes that the Tuning leaves unmapped
+}
+
+// logueFileInformation is FileInformation.xml
+type logueFileInformation struct {
+	XMLName  xml.Name `xml:"KorgMSLibrarian_Data"`
+	Product  string   `xml:"Product"`
+	Contents struct {
+		NumProgramData       int             `xml:"NumProgramData,attr"`
+		NumPresetInformation int             `xml:"NumPresetInformation,attr"`
+		NumTuneScaleData     int             `xml:"NumTuneScaleData,attr"`
+		NumTuneOctData       int             `xml:"NumTuneOctData,attr"`
+		TuneScaleData        []logueTuneData `xml:"TuneScaleData"`
+		TuneOctData          []logueTuneData `xml:"TuneOctData"`
+	} `xml:"Contents"`
+}
+
+type logueTuneData struct {
+	Information     string `xml:"Information"`
+	TuneScaleBinary string `xml:"TuneScaleBinary,omitempty"`
+	TuneOctBinary   string `xml:"TuneOctBinary,omitempty"`
+}
+
+// writeLogue writes a bundle holding one table. octave selects a user octave rather than a user scale.
+func writeLogue(w io.Writer, table []byte, octave bool, opts LogueOptions) (err error) {
+	if err = opts.Product.validate(); err != nil {
+		return
+	}
+	kind, element := "TunS", "TuneScale"
+	if octave {
+		kind, element = "TunO", "TuneOct"
+	}
+	var info logueFileInformation
+	info.Product = opts.Product.String()
+	data := logueTuneData{Information: kind + "_000." + kind + "_info"}
+	if octave {
+		data.TuneOctBinary = kind + "_000." + kind + "_bin"
+		info.Contents.NumTuneOctData = 1
+		info.Contents.TuneOctData = []logueTuneData{data}
+	} else {
+		data.TuneScaleBinary = kind + "_000." + kind + "_bin"
+		info.Contents.NumTuneScaleData = 1
+		info.Contents.TuneScaleData = []logueTuneData{data}
+	}
+	var fileInformation []byte
+	if fileInformation, err = xml.MarshalIndent(info, "", "  "); err != nil {
+		return
+	}
+
+	var tuneInformation bytes.Buffer
+	root := logueProducts[opts.Product].prefix + "_" + element + "Information"
+	fmt.Fprintf(&tuneInformation, "%s<%s>\n  <Programmer>", xml.Header, root)
+	if err = xml.EscapeText(&tuneInformation, []byte(opts.Programmer)); err != nil {
+		return
+	}
+	fmt.Fprintf(&tuneInformation, "</Programmer>\n  <Comment>")
+	if err = xml.EscapeText(&tuneInformation, []byte(opts.Comment)); err != nil {
+		return
+	}
+	fmt.Fprintf(&tuneInformation, "</Comment>\n</%s>\n", root)
+
+	zw := zip.NewWriter(w)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"FileInformation.xml", append([]byte(xml.Header), fileInformation...)},
+		{data.Information, tuneInformation.Bytes()},
+		{kind + "_000." + kind + "_bin", table},
+	} {
+		var fw io.Writer
+		if fw, err = zw.Create(f.name); err != nil {
+			return
+		}
+		if _, err = fw.Write(f.data); err != nil {
+			return
+		}
+	}
+	err = zw.Close()
+	return
+}
+
+// WriteLogueScale writes t to w as a user scale bundle of opts.Product, tuning all 128
+// notes, and returns the error in cents of each note
+func WriteLogueScale(w io.Writer, t Tuning, opts LogueOptions) (errs [128]float64, err error) {
+	table := make([]byte, 0, 3*128)
+	for n, f := range frequencyTable(t, opts.Unmapped) {
+		var data [3]byte
+		data, errs[n] = mtsFrequency(f)
+		table = append(table, data[:]...)
+	}
+	err = writeLogue(w, table, false, opts)
+	return
+}
+
+// WriteLogueOctave writes s, which must be a 12 tone scale repeating at the octave, to w as
+// a user octave bundle of opts.Product, and returns the error in cents of each of its notes.
+// The root of the scale is C and the other notes are tuned relative to it, as
+// pitch classes of a keyboard in 12-EDO.
+func WriteLogueOctave(w io.Writer, s Scale, opts LogueOptions) (errs [12]float64, err error) {
+	if s.Count != 12 || len(s.Tones) != 12 {
+		err = errors.Errorf("A logue user octave needs a scale of 12 notes. Your scale provided %v notes.", s.Count)
+		return
+	}
+	if math.Abs(s.Tones[11].Cents-1200.0) > periodTolerance {
+		err = errors.Errorf("A logue user octave needs a scale that repeats at the octave, not %v cents", s.Tones[11].Cents)
+		return
+	}
+	table := make([]byte, 0, 3*12)
+	for pc := 0; pc < 12; pc++ {
+		cents := 0.0
+		if pc > 0 {
+			cents = s.Tones[pc-1].Cents
+		}
+		var data [3]byte
+		data, errs[pc] = mtsFrequency(midi0Freq * math.Pow(2.0, cents/1200.0))
+		table = append(table, data[:]...)
+	}
+	err = writeLogue(w, table, true, opts)
+	return
+}
+
+// TuningFromLogueBytes returns the tuning of a logue user scale or user octave bundle held
+// in memory. A user scale gives the scale and mapping of ScaleAndMappingFromFrequencies,
+// with notes repeating to within the resolution of the format; a user octave gives a 12
+// tone scale starting on C and the standard mapping.
+func TuningFromLogueBytes(data []byte) (t Tuning, err error) {
+	var zr *zip.Reader
+	if zr, err = zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+		return
+	}
+	var info logueFileInformation
+	var raw []byte
+	if raw, err = readZipFile(zr, "FileInformation.xml", logueInformationLimit); err != nil {
+		return
+	}
+	if err = xml.Unmarshal(raw, &info); err != nil {
+		err = errors.Wrap(err, "Invalid FileInformation.xml")
+		return
+	}
+	switch {
+	case len(info.Contents.TuneScaleData) > 0:
+		if raw, err = readZipFile(zr, info.Contents.TuneScaleData[0].TuneScaleBinary, 3*128); err != nil {
+			return
+		}
+		if len(raw) != 3*128 {
+			err = errors.Errorf("User scale has %d bytes rather than %d", len(raw), 3*128)
+			return
+		}
+		var freqs [128]float64
+		for n := range freqs {
+			var ok bool
+			if freqs[n], ok = mtsDecodeFrequency(raw[3*n : 3*n+3]); !ok {
+				freqs[n] = midi0Freq * math.Pow(2.0, float64(n)/12.0)
+			}
+		}
+		var s Scale
+		var k KeyboardMapping
+		if s, k, err = scaleAndMappingFromFrequencies(freqs, 2*mtsResolution); err != nil {
+			return
+		}
+		t, err = TuningFromSCLAndKBM(s, k)
+	case len(info.Contents.TuneOctData) > 0:
+		if raw, err = readZipFile(zr, info.Contents.TuneOctData[0].TuneOctBinary, 3*12); err != nil {
+			return
+		}
+		if len(raw) != 3*12 {
+			err = errors.Errorf("User octave has %d bytes rather than %d", len(raw), 3*12)
+			return
+		}
+		var cents [12]float64
+		for pc := range cents {
+			f, ok := mtsDecodeFrequency(raw[3*pc : 3*pc+3])
+			if !ok {
+				f = midi0Freq * math.Pow(2.0, float64(pc)/12.0)
+			}
+			cents[pc] = 1200.0 * math.Log2(f/midi0Freq)
+		}
+		tones := make([]Tone, 12)
+		for i := 1; i < 12; i++ {
+			tones[i-1] = ToneFromCents(cents[i] - cents[0])
+		}
+		if tones[11], err = ToneFromRatio(2, 1); err != nil {
+			return
+		}
+		var s Scale
+		var k KeyboardMapping
+		if s, err = ScaleFromTones(info.Product+" user octave", tones); err != nil {
+			return
+		}
+		if k, err = KeyboardMappingTuneNoteTo(60, midi0Freq*32.0*math.Pow(2.0, cents[0]/1200.0)); err != nil {
+			return
+		}
+		t, err = TuningFromSCLAndKBM(s, k)
+	default:
+		err = errors.New("Bundle has no user scale or user octave")
+	}
+	return
+}
+
+// TuningFromLogueFile returns the tuning of the logue user scale or user octave bundle fname
+func TuningFromLogueFile(fname string) (t Tuning, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(fname); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", fname)
+		return
+	}
+	if t, err = TuningFromLogueBytes(data); err != nil {
+		err = errors.Wrapf(err, "Unable to parse file '%s'", fname)
+		return
+	}
+	return
+}
+
+// LogueProductFromExtension returns the product whose bundles have the extension of fname
+func LogueProductFromExtension(fname string) (p LogueProduct, ok bool) {
+	ext := strings.ToLower(path.Ext(fname))
+	for i := range logueProducts {
+		if ext == LogueProduct(i).ScaleExtension() || ext == LogueProduct(i).OctaveExtension() {
+			p, ok = LogueProduct(i), true
+			return
+		}
+	}
+	return
+}
+
+// logueInformationLimit is the largest information file read from a bundle
+const logueInformationLimit = 64 << 10
+
+// readZipFile returns the contents of the file name in zr, which may be no longer than max bytes
+func readZipFile(zr *zip.Reader, name string, max int64) (data []byte, err error) {
+	var f io.ReadCloser
+	if f, err = zr.Open(name); err != nil {
+		err = errors.Wrapf(err, "Bundle has no %s", name)
+		return
+	}
+	defer f.Close()
+	if data, err = ioutil.ReadAll(io.LimitReader(f, max+1)); err != nil {
+		return
+	}
+	if int64(len(data)) > max {
+		err = errors.Errorf("%s of the bundle is longer than %d bytes", name, max)
+	}
+	return
+}
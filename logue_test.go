@@ -0,0 +1,141 @@
+package scala
+
+import (
+	"archive/zip"
+	"bytes"
+	"gotest.tools/v3/assert"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Logue - a user scale round trips to within the resolution of the table
+func TestLogueScale(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingTuneA69To(432)
+	assert.NilError(t, err)
+	tuning, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+
+	var buf bytes.Buffer
+	errs, err := WriteLogueScale(&buf, tuning, LogueOptions{Product: LoguePrologue, Programmer: "R&D", Comment: "31 <edo>"})
+	assert.NilError(t, err)
+	for _, e := range errs {
+		assert.Assert(t, math.Abs(e) <= mtsResolution/2)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NilError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.DeepEqual(t, names, []string{"FileInformation.xml", "TunS_000.TunS_info", "TunS_000.TunS_bin"})
+	info, err := readZipFile(zr, "FileInformation.xml", logueInformationLimit)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(info), "<Product>prologue</Product>"), string(info))
+	assert.Assert(t, strings.Contains(string(info), `NumTuneScaleData="1"`), string(info))
+	info, err = readZipFile(zr, "TunS_000.TunS_info", logueInformationLimit)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(info), "<prologue_TuneScaleInformation>"), string(info))
+	assert.Assert(t, strings.Contains(string(info), "<Programmer>R&amp;D</Programmer>"), string(info))
+	assert.Assert(t, strings.Contains(string(info), "<Comment>31 &lt;edo&gt;</Comment>"), string(info))
+
+	back, err := TuningFromLogueBytes(buf.Bytes())
+	assert.NilError(t, err)
+	assert.Equal(t, back.Scale().Count, 31)
+	for n := 0; n < 128; n++ {
+		assert.Equal(t, "", approxEqual(mtsResolution, 1200*math.Log2(back.FrequencyForMidiNote(n)/tuning.FrequencyForMidiNote(n)), errs[n]))
+	}
+}
+
+// Logue - a user octave
+func TestLogueOctave(t *testing.T) {
+	ascl, err := AbletonScaleFromASCLFile(testFile("meantone.ascl"))
+	assert.NilError(t, err)
+	fname := filepath.Join(t.TempDir(), "meantone"+LogueNTS1.OctaveExtension())
+	file, err := os.Create(fname)
+	assert.NilError(t, err)
+	errs, err := WriteLogueOctave(file, ascl.Scale, LogueOptions{Product: LogueNTS1})
+	assert.NilError(t, err)
+	assert.NilError(t, file.Close())
+	assert.Assert(t, math.Abs(errs[4]) <= mtsResolution/2)
+
+	p, ok := LogueProductFromExtension(fname)
+	assert.Assert(t, ok)
+	assert.Equal(t, p, LogueNTS1)
+	data, err := ioutil.ReadFile(fname)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Contains(data, []byte("TunO_000.TunO_bin")))
+
+	back, err := TuningFromLogueFile(fname)
+	assert.NilError(t, err)
+	assert.Equal(t, back.Scale().Count, 12)
+	assert.Equal(t, back.Scale().Description, "NTS-1 digital kit user octave")
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	assert.Equal(t, "", approxEqual(1e-6, back.FrequencyForMidiNote(60), std.FrequencyForMidiNote(60)))
+	for n := 0; n < 12; n++ {
+		want := ascl.Scale.Tones[(n+11)%12].Cents
+		if n == 0 {
+			want = 0
+		}
+		got := 1200 * math.Log2(back.FrequencyForMidiNote(60+n)/back.FrequencyForMidiNote(60))
+		assert.Equal(t, "", approxEqual(mtsResolution, got, want), n)
+	}
+}
+
+// Logue - errors
+func TestLogueErrors(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	_, err = WriteLogueOctave(&bytes.Buffer{}, s, LogueOptions{})
+	assert.ErrorContains(t, err, "12 notes")
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	_, err = WriteLogueScale(&bytes.Buffer{}, std, LogueOptions{Product: 7})
+	assert.ErrorContains(t, err, "Unknown logue product")
+
+	p, ok := LogueProductFromExtension("scale.scl")
+	assert.Assert(t, !ok)
+	assert.Equal(t, p, LogueProduct(0))
+	assert.Equal(t, LogueProduct(7).ScaleExtension(), "")
+	assert.Equal(t, LogueProduct(-1).OctaveExtension(), "")
+	_, err = TuningFromLogueBytes([]byte("not a zip"))
+	assert.Assert(t, err != nil)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	_, err = zw.Create("readme.txt")
+	assert.NilError(t, err)
+	assert.NilError(t, zw.Close())
+	_, err = TuningFromLogueBytes(buf.Bytes())
+	assert.ErrorContains(t, err, "FileInformation.xml")
+
+	// a table longer than it should be is not read in full
+	var bundle bytes.Buffer
+	_, err = WriteLogueScale(&bundle, std, LogueOptions{})
+	assert.NilError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(bundle.Bytes()), int64(bundle.Len()))
+	assert.NilError(t, err)
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		data, err := readZipFile(zr, f.Name, logueInformationLimit)
+		assert.NilError(t, err)
+		if strings.HasSuffix(f.Name, "_bin") {
+			data = make([]byte, 10<<20)
+		}
+		w, err := zw.Create(f.Name)
+		assert.NilError(t, err)
+		_, err = w.Write(data)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, zw.Close())
+	_, err = TuningFromLogueBytes(buf.Bytes())
+	assert.ErrorContains(t, err, "longer than 384 bytes")
+}
@@ -0,0 +1,127 @@
+package scala
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// The Lumatone has 280 hexagonal keys on five boards of 56. Keys are placed here in axial
+// hex coordinates: Column counts keys to the right along a row, and Row counts rows down,
+// where the key at (Column, Row+1) is down and to the right of (Column, Row). Each board
+// has 11 rows, and each board sits 5 columns right of and 2 rows below the one before, so
+// that the boards tile without gaps.
+
+// LumatoneKeys is the number of keys of a Lumatone
+const LumatoneKeys = 5 * lumatoneBoardKeys
+
+const lumatoneBoardKeys = 56
+
+// lumatoneRows gives the number of keys and the column of the first key of each row of a board
+var lumatoneRows = [11]struct{ length, start int }{
+	{2, 0}, {5, 0}, {6, -1}, {6, -1}, {6, -2}, {6, -2}, {6, -3}, {6, -3}, {6, -4}, {5, -3}, {2, -1},
+}
+
+// lumatonePosition returns the row and column of key (0..55) of board (0..4)
+func lumatonePosition(board int, key int) (row int, column int) {
+	for r, rl := range lumatoneRows {
+		if key < rl.length {
+			return r + 2*board, rl.start + key + 5*board
+		}
+		key -= rl.length
+	}
+	return
+}
+
+// LumatoneOptions controls LumatoneLayoutFromScale
+type LumatoneOptions struct {
+	RightStep     int     // the scale degrees from a key to the next key to its right
+	DownRightStep int     // the scale degrees from a key to the key down and to its right
+	Origin        int     // the key, board*56 + key, which plays degree 0 of the scale
+	Frequency     float64 // the frequency of degree 0 in Hz; 0 for middle C in standard tuning
+	// Colours gives the colour of each scale position as 0xRRGGBB, repeating if there
+	// are fewer colours than notes in the scale. If empty, the root is white and the
+	// other notes are grey.
+	Colours []uint32
+}
+
+// A LumatoneKey is the assignment of one key of a Lumatone
+type LumatoneKey struct {
+	Board, Key  int // Key within the board, 0..55
+	Row, Column int // the position of the key, in the hex coordinates of all five boards
+	Degree      int // the scale degree it plays, counting periods, relative to the origin
+	Channel     int // the MIDI channel 0..15 it sends on
+	Note        int // the MIDI note it sends
+	Colour      uint32
+}
+
+// A LumatoneLayout assigns a scale to the keys of a Lumatone. Like an IsomorphicMapping,
+// it sends on as many MIDI channels as it needs.
+type LumatoneLayout struct {
+	Keys     [LumatoneKeys]LumatoneKey
+	Tunings  []Tuning // the tuning of the notes of each channel the layout uses
+	channels ChannelTuning
+}
+
+// ChannelTuning returns the tunings of the channels the layout uses as one ChannelTuning
+func (layout LumatoneLayout) ChannelTuning() ChannelTuning {
+	return layout.channels
+}
+
+// LumatoneLayoutFromScale lays s out on a Lumatone with the IsomorphicLayout of the given
+// steps, with the degree of each key counted from the origin key
+func LumatoneLayoutFromScale(s Scale, opts LumatoneOptions) (layout LumatoneLayout, err error) {
+	if s.Count <= 0 {
+		err = errors.Errorf("Unable to lay out a scale with no notes. Your scale provided %v notes.", s.Count)
+		return
+	}
+	if opts.Origin < 0 || opts.Origin >= LumatoneKeys {
+		err = errors.Errorf("Lumatone origin key must be in 0..%d: %d", LumatoneKeys-1, opts.Origin)
+		return
+	}
+	colours := opts.Colours
+	if len(colours) == 0 {
+		colours = make([]uint32, s.Count)
+		for i := range colours {
+			colours[i] = 0x404040
+		}
+		colours[0] = 0xFFFFFF
+	}
+
+	originRow, originColumn := lumatonePosition(opts.Origin/lumatoneBoardKeys, opts.Origin%lumatoneBoardKeys)
+	keys := make([]GridKey, LumatoneKeys)
+	for i := range layout.Keys {
+		k := &layout.Keys[i]
+		k.Board, k.Key = i/lumatoneBoardKeys, i%lumatoneBoardKeys
+		k.Row, k.Column = lumatonePosition(k.Board, k.Key)
+		keys[i] = GridKey{Row: k.Row - originRow, Column: k.Column - originColumn}
+	}
+	iso := IsomorphicLayout{Grid: GridHex, RightStep: opts.RightStep, UpStep: opts.RightStep - opts.DownRightStep}
+	var m IsomorphicMapping
+	if m, err = iso.Map(s, opts.Frequency, keys); err != nil {
+		return
+	}
+	layout.Tunings, layout.channels = m.Tunings, m.channels
+	for i, mk := range m.Keys {
+		k := &layout.Keys[i]
+		k.Degree, k.Channel, k.Note = mk.Degree, mk.Channel, mk.Note
+		k.Colour = colours[layout.Tunings[k.Channel].ScalePositionForMidiNote(k.Note)%len(colours)]
+	}
+	return
+}
+
+// WriteLTN writes the layout to w as a Lumatone .ltn preset, with the note, channel
+// and colour of every key
+func (layout LumatoneLayout) WriteLTN(w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+	for board := 0; board < 5; board++ {
+		fmt.Fprintf(bw, "[Board%d]\n", board)
+		for key := 0; key < lumatoneBoardKeys; key++ {
+			k := layout.Keys[board*lumatoneBoardKeys+key]
+			fmt.Fprintf(bw, "Key_%d=%d\nChan_%d=%d\nCol_%d=%06x\n", key, k.Note, key, k.Channel+1, key, k.Colour&0xFFFFFF)
+		}
+	}
+	err = bw.Flush()
+	return
+}
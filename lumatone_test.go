@@ -0,0 +1,111 @@
+package scala
+
+import (
+	"bytes"
+	"gotest.tools/v3/assert"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Lumatone - key positions
+func TestLumatonePosition(t *testing.T) {
+	seen := map[[2]int]bool{}
+	for b := 0; b < 5; b++ {
+		for k := 0; k < lumatoneBoardKeys; k++ {
+			r, c := lumatonePosition(b, k)
+			assert.Assert(t, !seen[[2]int{r, c}], "board %d key %d", b, k)
+			seen[[2]int{r, c}] = true
+		}
+	}
+	assert.Equal(t, len(seen), LumatoneKeys)
+
+	r, c := lumatonePosition(0, 0)
+	assert.Equal(t, r, 0)
+	assert.Equal(t, c, 0)
+	r, c = lumatonePosition(0, 55)
+	assert.Equal(t, r, 10)
+	assert.Equal(t, c, 0)
+	r, c = lumatonePosition(3, 2)
+	assert.Equal(t, r, 7)
+	assert.Equal(t, c, 15)
+}
+
+// Lumatone - degrees, channels and frequencies of 31-EDO in a Bosanquet layout
+func TestLumatoneLayout31EDO(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	layout, err := LumatoneLayoutFromScale(s, LumatoneOptions{RightStep: 5, DownRightStep: -2, Origin: 2*56 + 27})
+	assert.NilError(t, err)
+
+	lowest := layout.Keys[0].Degree
+	for _, k := range layout.Keys {
+		lowest = imin(lowest, k.Degree)
+	}
+	for i, k := range layout.Keys {
+		assert.Equal(t, k.Board*56+k.Key, i)
+		assert.Equal(t, k.Channel*128+k.Note, k.Degree-lowest)
+		f := layout.Tunings[k.Channel].FrequencyForMidiNote(k.Note)
+		assert.Equal(t, "", approxEqual(1e-4, f, midi0Freq*32.0*math.Pow(2.0, float64(k.Degree)/31.0)), i)
+		pos := ((k.Degree % 31) + 31) % 31
+		assert.Equal(t, layout.Tunings[k.Channel].ScalePositionForMidiNote(k.Note), pos, i)
+		if pos == 0 {
+			assert.Equal(t, k.Colour, uint32(0xFFFFFF))
+		} else {
+			assert.Equal(t, k.Colour, uint32(0x404040))
+		}
+	}
+	origin := layout.Keys[2*56+27]
+	assert.Equal(t, origin.Degree, 0)
+	assert.Equal(t, origin.Colour, uint32(0xFFFFFF))
+}
+
+// Lumatone - notes spread over channels tune continuously across channel boundaries
+func TestLumatoneLayoutChannels(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("12-intune.scl"))
+	assert.NilError(t, err)
+	layout, err := LumatoneLayoutFromScale(s, LumatoneOptions{RightStep: 7, DownRightStep: 4, Frequency: 440.0,
+		Colours: []uint32{0xFF0000, 0x00FF00, 0x0000FF}})
+	assert.NilError(t, err)
+	assert.Assert(t, len(layout.Tunings) > 1)
+	t0, t1 := layout.Tunings[0], layout.Tunings[1]
+	assert.Equal(t, "", approxEqual(1e-6, t1.FrequencyForMidiNote(0), t0.FrequencyForMidiNote(127)*math.Pow(2.0, 1.0/12.0)))
+	for _, k := range layout.Keys {
+		pos := layout.Tunings[k.Channel].ScalePositionForMidiNote(k.Note)
+		assert.Equal(t, k.Colour, []uint32{0xFF0000, 0x00FF00, 0x0000FF}[pos%3])
+	}
+	assert.Equal(t, layout.Keys[0].Degree, 0)
+	assert.Equal(t, "", approxEqual(1e-6, layout.Tunings[layout.Keys[0].Channel].FrequencyForMidiNote(layout.Keys[0].Note), 440.0))
+}
+
+// Lumatone - the .ltn preset
+func TestLumatoneWriteLTN(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("12-intune.scl"))
+	assert.NilError(t, err)
+	layout, err := LumatoneLayoutFromScale(s, LumatoneOptions{RightStep: 2, DownRightStep: -1, Origin: 2*56 + 27})
+	assert.NilError(t, err)
+	var buf bytes.Buffer
+	assert.NilError(t, layout.WriteLTN(&buf))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, len(lines), 5*(1+3*56))
+	assert.Equal(t, lines[0], "[Board0]")
+	assert.Equal(t, lines[1+3*56], "[Board1]")
+	k := layout.Keys[2*56+27]
+	base := 2*(1+3*56) + 1 + 3*27
+	assert.Equal(t, lines[base], "Key_27="+strconv.Itoa(k.Note))
+	assert.Equal(t, lines[base+1], "Chan_27="+strconv.Itoa(k.Channel+1))
+	assert.Equal(t, lines[base+2], "Col_27=ffffff")
+}
+
+// Lumatone - errors
+func TestLumatoneErrors(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("12-intune.scl"))
+	assert.NilError(t, err)
+	_, err = LumatoneLayoutFromScale(s, LumatoneOptions{RightStep: 1, Origin: LumatoneKeys})
+	assert.ErrorContains(t, err, "origin key")
+	_, err = LumatoneLayoutFromScale(s, LumatoneOptions{RightStep: 100, DownRightStep: 100})
+	assert.ErrorContains(t, err, "16 MIDI channels")
+	_, err = LumatoneLayoutFromScale(Scale{}, LumatoneOptions{RightStep: 1})
+	assert.ErrorContains(t, err, "no notes")
+}
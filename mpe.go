@@ -0,0 +1,264 @@
+package scala
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+)
+
+// Synths without MTS can still play a tuning if each note has a MIDI channel to itself:
+// the note is sent as the nearest note of 12-EDO, and the channel's pitch bend moves it the
+// rest of the way. MPE (MIDI Polyphonic Expression) standardizes this: a zone has a manager
+// channel for messages that affect every note, and member channels, one per sounding note.
+// The lower zone is managed on channel 1 with members from channel 2 upwards; the upper zone
+// is managed on channel 16 with members from channel 15 downwards. Channels here are
+// numbered 0..15.
+
+// MPEZone selects the channels of an MPE zone
+type MPEZone int
+
+const (
+	// MPELowerZone for the zone managed on channel 0, with members from channel 1 upwards
+	MPELowerZone MPEZone = iota
+	// MPEUpperZone for the zone managed on channel 15, with members from channel 14 downwards
+	MPEUpperZone
+)
+
+var mpeZoneNames = []string{"lower", "upper"}
+
+func (z MPEZone) String() string {
+	if z >= 0 && int(z) < len(mpeZoneNames) {
+		return mpeZoneNames[z]
+	}
+	return "MPEZone(" + strconv.Itoa(int(z)) + ")"
+}
+
+// MPEDefaultBendRange is the pitch bend range of MPE member channels, in semitones
+const MPEDefaultBendRange = 48
+
+// MPEOptions controls an MPEAllocator
+type MPEOptions struct {
+	Zone           MPEZone
+	MemberChannels int // the number of member channels 1..15; 0 for all 15
+	BendRange      int // the pitch bend range of the member channels in semitones; 0 for MPEDefaultBendRange
+	// ReleaseTail is how long a note goes on sounding after its note off, in the units of
+	// the times given to the allocator. A channel is not reused within it unless every
+	// other channel is busy, since a new pitch bend would bend the end of the old note.
+	ReleaseTail int64
+}
+
+// An MPEVoice is a note sounding on a member channel
+type MPEVoice struct {
+	Part    int     // the part the note belongs to, such as the channel it was played on; 0 for NoteOn
+	Key     int     // the note that was played
+	Channel int     // the member channel 0..15
+	Note    int     // the nearest note of 12-EDO to the tuned frequency
+	Bend    int     // the 14-bit pitch bend 0..16383, where 8192 is no bend
+	Cents   float64 // the error in cents of Note and Bend against the tuning, when the bend range is too small
+	Time    int64   // the time of the note on
+}
+
+type mpeChannel struct {
+	voice    MPEVoice
+	active   bool
+	released int64 // the time of the last note off
+	used     bool
+}
+
+// An MPEAllocator assigns the notes of a Tuning to the member channels of an MPE zone
+type MPEAllocator struct {
+	tuning   Tuning
+	opts     MPEOptions
+	members  []int // the member channels in order of preference
+	channels [16]mpeChannel
+}
+
+// MPEAllocatorFromTuning returns an allocator which plays t on the zone of opts
+func MPEAllocatorFromTuning(t Tuning, opts MPEOptions) (a *MPEAllocator, err error) {
+	if opts.Zone != MPELowerZone && opts.Zone != MPEUpperZone {
+		err = errors.Errorf("Unknown MPE zone %d", int(opts.Zone))
+		return
+	}
+	if opts.MemberChannels == 0 {
+		opts.MemberChannels = 15
+	}
+	if opts.MemberChannels < 1 || opts.MemberChannels > 15 {
+		err = errors.Errorf("MPE zone must have 1..15 member channels: %d", opts.MemberChannels)
+		return
+	}
+	if opts.BendRange == 0 {
+		opts.BendRange = MPEDefaultBendRange
+	}
+	if opts.BendRange < 1 || opts.BendRange > 96 {
+		err = errors.Errorf("MPE pitch bend range must be 1..96 semitones: %d", opts.BendRange)
+		return
+	}
+	a = &MPEAllocator{tuning: t, opts: opts}
+	for i := 1; i <= opts.MemberChannels; i++ {
+		if opts.Zone == MPELowerZone {
+			a.members = append(a.members, i)
+		} else {
+			a.members = append(a.members, 15-i)
+		}
+	}
+	return
+}
+
+// ManagerChannel returns the manager channel of the zone
+func (a *MPEAllocator) ManagerChannel() int {
+	if a.opts.Zone == MPEUpperZone {
+		return 15
+	}
+	return 0
+}
+
+// MemberChannels returns the member channels of the zone
+func (a *MPEAllocator) MemberChannels() []int {
+	return append([]int(nil), a.members...)
+}
+
+// SetTuning changes the tuning of the notes that follow. Sounding notes keep their pitch.
+func (a *MPEAllocator) SetTuning(t Tuning) {
+	a.tuning = t
+}
+
+// Tuning returns the tuning of the allocator
+func (a *MPEAllocator) Tuning() Tuning {
+	return a.tuning
+}
+
+// pitch returns the note, bend and error in cents that play frequency
+func (a *MPEAllocator) pitch(frequency float64) (note int, bend int, cents float64) {
+	semitones := 69.0 + 12.0*math.Log2(frequency/440.0)
+	note = int(math.Round(semitones))
+	note = imin(imax(note, 0), 127)
+	bend = 8192 + int(math.Round((semitones-float64(note))/float64(a.opts.BendRange)*8192.0))
+	bend = imin(imax(bend, 0), 16383)
+	cents = 100.0 * (float64(note) + float64(bend-8192)/8192.0*float64(a.opts.BendRange) - semitones)
+	return
+}
+
+// NoteOn allocates a member channel to key at time, and returns its voice. If every member
+// channel is busy, or key is already sounding, the oldest such voice is stolen, and is
+// returned in stolen so that it can be sent a note off first. ok is false if the tuning
+// leaves key unmapped, when no voice is allocated.
+func (a *MPEAllocator) NoteOn(key int, time int64) (v MPEVoice, stolen []MPEVoice, ok bool) {
+	v, stolen, ok = a.NoteOnPart(0, key, time)
+	return
+}
+
+// NoteOnPart is NoteOn for one of several parts sharing the zone, such as the channels of
+// a multi-part input. The same key may sound in different parts at once.
+func (a *MPEAllocator) NoteOnPart(part int, key int, time int64) (v MPEVoice, stolen []MPEVoice, ok bool) {
+	if !a.tuning.IsMidiNoteMapped(key) {
+		return
+	}
+	ch := -1
+	for _, c := range a.members {
+		if a.channels[c].active && a.channels[c].voice.Part == part && a.channels[c].voice.Key == key {
+			ch = c
+		}
+	}
+	if ch < 0 {
+		ch = a.freeChannel(time)
+	}
+	if ch < 0 {
+		for _, c := range a.members {
+			if ch < 0 || a.channels[c].voice.Time < a.channels[ch].voice.Time {
+				ch = c
+			}
+		}
+	}
+	if a.channels[ch].active {
+		stolen = []MPEVoice{a.channels[ch].voice}
+	}
+	v.Part, v.Key, v.Channel, v.Time = part, key, ch, time
+	v.Note, v.Bend, v.Cents = a.pitch(a.tuning.FrequencyForMidiNote(key))
+	a.channels[ch] = mpeChannel{voice: v, active: true, used: true}
+	ok = true
+	return
+}
+
+// freeChannel returns the member channel with no note that has been free the longest,
+// preferring those past their release tail, or -1 if every channel has a note
+func (a *MPEAllocator) freeChannel(time int64) (ch int) {
+	ch = -1
+	inTail := -1
+	for _, c := range a.members {
+		mc := a.channels[c]
+		switch {
+		case mc.active:
+		case !mc.used || time-mc.released >= a.opts.ReleaseTail:
+			if ch < 0 || (a.channels[ch].used && (!mc.used || mc.released < a.channels[ch].released)) {
+				ch = c
+			}
+		default:
+			if inTail < 0 || mc.released < a.channels[inTail].released {
+				inTail = c
+			}
+		}
+	}
+	if ch < 0 {
+		ch = inTail
+	}
+	return
+}
+
+// NoteOff releases the voice of key at time, and returns it. ok is false if key is not sounding.
+func (a *MPEAllocator) NoteOff(key int, time int64) (v MPEVoice, ok bool) {
+	v, ok = a.NoteOffPart(0, key, time)
+	return
+}
+
+// NoteOffPart is NoteOff for the key of one part, as allocated by NoteOnPart
+func (a *MPEAllocator) NoteOffPart(part int, key int, time int64) (v MPEVoice, ok bool) {
+	for _, c := range a.members {
+		if a.channels[c].active && a.channels[c].voice.Part == part && a.channels[c].voice.Key == key {
+			a.channels[c].active = false
+			a.channels[c].released = time
+			v, ok = a.channels[c].voice, true
+			return
+		}
+	}
+	return
+}
+
+// Voices returns the sounding voices in the order of the member channels
+func (a *MPEAllocator) Voices() (voices []MPEVoice) {
+	for _, c := range a.members {
+		if a.channels[c].active {
+			voices = append(voices, a.channels[c].voice)
+		}
+	}
+	return
+}
+
+// ConfigurationMessages returns the MIDI messages that set up the zone on a synth: the MPE
+// Configuration Message on the manager channel, and the pitch bend range of each member
+// channel, as RPN 0
+func (a *MPEAllocator) ConfigurationMessages() (msgs [][]byte) {
+	mgr := byte(0xB0 | a.ManagerChannel())
+	msgs = append(msgs, []byte{mgr, 0x65, 0x00}, []byte{mgr, 0x64, 0x06}, []byte{mgr, 0x06, byte(len(a.members))})
+	for _, c := range a.members {
+		cc := byte(0xB0 | c)
+		msgs = append(msgs, []byte{cc, 0x65, 0x00}, []byte{cc, 0x64, 0x00},
+			[]byte{cc, 0x06, byte(a.opts.BendRange)}, []byte{cc, 0x26, 0x00},
+			[]byte{cc, 0x65, 0x7F}, []byte{cc, 0x64, 0x7F})
+	}
+	return
+}
+
+// PitchBendMessage returns the pitch bend message that tunes the voice
+func (v MPEVoice) PitchBendMessage() []byte {
+	return []byte{byte(0xE0 | v.Channel), byte(v.Bend & 0x7F), byte(v.Bend >> 7)}
+}
+
+// NoteOnMessage returns the note on message of the voice, to follow its PitchBendMessage
+func (v MPEVoice) NoteOnMessage(velocity int) []byte {
+	return []byte{byte(0x90 | v.Channel), byte(v.Note), byte(velocity & 0x7F)}
+}
+
+// NoteOffMessage returns the note off message of the voice
+func (v MPEVoice) NoteOffMessage(velocity int) []byte {
+	return []byte{byte(0x80 | v.Channel), byte(v.Note), byte(velocity & 0x7F)}
+}
@@ -0,0 +1,146 @@
+package scala
+
+import (
+	"gotest.tools/v3/assert"
+	"math"
+	"testing"
+)
+
+func mpeTestTuning(t *testing.T) Tuning {
+	t.Helper()
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	tun, err := TuningFromSCL(s)
+	assert.NilError(t, err)
+	return tun
+}
+
+// MPE - the note and bend of each voice play the tuned frequency
+func TestMPEPitch(t *testing.T) {
+	tun := mpeTestTuning(t)
+	a, err := MPEAllocatorFromTuning(tun, MPEOptions{})
+	assert.NilError(t, err)
+	for key := 40; key < 90; key++ {
+		v, stolen, ok := a.NoteOn(key, int64(key))
+		assert.Assert(t, ok)
+		assert.Equal(t, len(stolen), 0)
+		a.NoteOff(key, int64(key))
+		played := 440.0 * math.Pow(2.0, (float64(v.Note)-69.0+float64(v.Bend-8192)/8192.0*48.0)/12.0)
+		assert.Equal(t, "", approxEqual(0.3, 1200.0*math.Log2(played/tun.FrequencyForMidiNote(key)), 0), key)
+		assert.Equal(t, "", approxEqual(1e-9, v.Cents, 1200.0*math.Log2(played/tun.FrequencyForMidiNote(key))), key)
+	}
+
+	// a small bend range runs out
+	a, err = MPEAllocatorFromTuning(tun, MPEOptions{BendRange: 1})
+	assert.NilError(t, err)
+	note, bend, cents := a.pitch(440.0 * math.Pow(2.0, 0.4/12.0))
+	assert.Equal(t, note, 69)
+	assert.Equal(t, bend, 8192+int(math.Round(0.4*8192)))
+	assert.Equal(t, "", approxEqual(0.1, cents, 0))
+	_, bend, cents = a.pitch(20000.0)
+	assert.Equal(t, bend, 16383)
+	assert.Assert(t, cents < -100)
+}
+
+// MPE - the channels of the zones
+func TestMPEZones(t *testing.T) {
+	tun := mpeTestTuning(t)
+	a, err := MPEAllocatorFromTuning(tun, MPEOptions{MemberChannels: 3})
+	assert.NilError(t, err)
+	assert.Equal(t, a.ManagerChannel(), 0)
+	assert.DeepEqual(t, a.MemberChannels(), []int{1, 2, 3})
+
+	a, err = MPEAllocatorFromTuning(tun, MPEOptions{Zone: MPEUpperZone, MemberChannels: 3, BendRange: 24})
+	assert.NilError(t, err)
+	assert.Equal(t, a.ManagerChannel(), 15)
+	assert.DeepEqual(t, a.MemberChannels(), []int{14, 13, 12})
+	msgs := a.ConfigurationMessages()
+	assert.Equal(t, len(msgs), 3+3*6)
+	assert.DeepEqual(t, msgs[:3], [][]byte{{0xBF, 0x65, 0}, {0xBF, 0x64, 6}, {0xBF, 0x06, 3}})
+	assert.DeepEqual(t, msgs[3:7], [][]byte{{0xBE, 0x65, 0}, {0xBE, 0x64, 0}, {0xBE, 0x06, 24}, {0xBE, 0x26, 0}})
+
+	v, _, ok := a.NoteOn(60, 0)
+	assert.Assert(t, ok)
+	assert.Equal(t, v.Channel, 14)
+	assert.DeepEqual(t, v.PitchBendMessage(), []byte{0xEE, byte(v.Bend & 0x7F), byte(v.Bend >> 7)})
+	assert.DeepEqual(t, v.NoteOnMessage(100), []byte{0x9E, byte(v.Note), 100})
+	assert.DeepEqual(t, v.NoteOffMessage(64), []byte{0x8E, byte(v.Note), 64})
+
+	for _, opts := range []MPEOptions{{Zone: 2}, {MemberChannels: 16}, {BendRange: 97}} {
+		_, err = MPEAllocatorFromTuning(tun, opts)
+		assert.Assert(t, err != nil, opts)
+	}
+	assert.Equal(t, MPEUpperZone.String(), "upper")
+}
+
+// MPE - voice stealing and release tails
+func TestMPEAllocation(t *testing.T) {
+	tun := mpeTestTuning(t)
+	a, err := MPEAllocatorFromTuning(tun, MPEOptions{MemberChannels: 3, ReleaseTail: 100})
+	assert.NilError(t, err)
+
+	v1, _, _ := a.NoteOn(60, 0)
+	v2, _, _ := a.NoteOn(62, 10)
+	v3, _, _ := a.NoteOn(64, 20)
+	assert.Equal(t, v1.Channel, 1)
+	assert.Equal(t, v2.Channel, 2)
+	assert.Equal(t, v3.Channel, 3)
+
+	// every channel is busy: the oldest voice is stolen
+	v4, stolen, ok := a.NoteOn(65, 30)
+	assert.Assert(t, ok)
+	assert.Equal(t, v4.Channel, 1)
+	assert.Equal(t, len(stolen), 1)
+	assert.Equal(t, stolen[0].Key, 60)
+	_, ok = a.NoteOff(60, 35)
+	assert.Assert(t, !ok)
+
+	// a channel in its release tail is reused only when no other is free
+	v, ok := a.NoteOff(62, 40)
+	assert.Assert(t, ok)
+	assert.Equal(t, v.Channel, 2)
+	a.NoteOff(64, 50)
+	v5, stolen, _ := a.NoteOn(67, 60)
+	assert.Equal(t, len(stolen), 0)
+	assert.Equal(t, v5.Channel, 2)
+	a.NoteOff(67, 70)
+	v6, _, _ := a.NoteOn(69, 160)
+	assert.Equal(t, v6.Channel, 3)
+	v7, _, _ := a.NoteOn(71, 165)
+	assert.Equal(t, v7.Channel, 2)
+
+	// retriggering a sounding key steals its voice
+	v8, stolen, _ := a.NoteOn(69, 170)
+	assert.Equal(t, v8.Channel, 3)
+	assert.Equal(t, len(stolen), 1)
+	assert.Equal(t, stolen[0].Time, int64(160))
+
+	voices := a.Voices()
+	assert.Equal(t, len(voices), 3)
+	assert.Equal(t, voices[0].Key, 65)
+}
+
+// MPE - unmapped notes and changing tunings
+func TestMPETuningChanges(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("12-intune.scl"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingFromKBMFile(testFile("mapping-whitekeys-c261.kbm"))
+	assert.NilError(t, err)
+	whiteKeys, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+	a, err := MPEAllocatorFromTuning(whiteKeys, MPEOptions{})
+	assert.NilError(t, err)
+	_, _, ok := a.NoteOn(61, 0)
+	assert.Assert(t, !ok)
+	v, _, ok := a.NoteOn(62, 0)
+	assert.Assert(t, ok)
+	assert.Equal(t, v.Note, 61)
+	assert.Equal(t, v.Bend, 8192)
+
+	a.SetTuning(mpeTestTuning(t))
+	assert.Equal(t, a.Tuning().Scale().Count, 31)
+	v, _, ok = a.NoteOn(61, 1)
+	assert.Assert(t, ok)
+	assert.Assert(t, v.Bend != 8192)
+	assert.Equal(t, a.Voices()[0].Note, 61)
+}
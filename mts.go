@@ -0,0 +1,475 @@
+package scala
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+// MIDI Tuning Standard (MTS) messages retune a synth over MIDI. A note's frequency is
+// sent as three bytes: the 12-EDO semitone at or below it (MIDI note numbers, A440 at
+// 69) followed by a 14 bit fraction of a semitone, so that each step is 100/16384 cents.
+// Scale/octave messages instead detune each of the 12 pitch classes from 12-EDO.
+//
+// The functions that build the messages also return the error in cents of each note:
+// the encoded pitch less the pitch of the Tuning, so a positive error means the synth
+// will play the note sharp. Frequencies outside the range of the format are clamped.
+
+// MTSAllDevices is the SysEx device ID that addresses every device
+const MTSAllDevices = 0x7F
+
+// MTSOptions controls the MTS messages. Fields that a message has no use for are ignored.
+type MTSOptions struct {
+	DeviceID int            // 0..127, or MTSAllDevices
+	Program  int            // the tuning program 0..127
+	Bank     int            // the tuning bank 0..127 of MTSSingleNoteChangeBank
+	Name     string         // the name in a bulk dump; the Description of the tuning's Scale if empty
+	RealTime bool           // send the real-time rather than non-real-time form, where there are both
+	Channels uint16         // bit n selects MIDI channel n+1 for scale/octave messages; 0 for all channels
+	Unmapped UnmappedPolicy // the tuning of notes that the Tuning leaves unmapped
+}
+
+func (opts MTSOptions) validate() (err error) {
+	if opts.DeviceID < 0 || opts.DeviceID > 127 {
+		err = errors.Errorf("MTS device ID must be in 0..127: %d", opts.DeviceID)
+		return
+	}
+	if opts.Program < 0 || opts.Program > 127 {
+		err = errors.Errorf("MTS tuning program must be in 0..127: %d", opts.Program)
+		return
+	}
+	if opts.Bank < 0 || opts.Bank > 127 {
+		err = errors.Errorf("MTS tuning bank must be in 0..127: %d", opts.Bank)
+		return
+	}
+	return
+}
+
+// header returns the start of a SysEx message of the MIDI Tuning Standard
+func (opts MTSOptions) header(realTime bool, subID2 byte) []byte {
+	universal := byte(0x7E)
+	if realTime {
+		universal = 0x7F
+	}
+	return []byte{0xF0, universal, byte(opts.DeviceID), 0x08, subID2}
+}
+
+// mtsMaxSemitones is the highest pitch that MTS frequency data can give, since 7F 7F 7F means no change
+const mtsMaxSemitones = 127.0 + 16382.0/16384.0
+
+// mtsFrequency returns the MTS frequency data nearest to freq, and the error in cents
+func mtsFrequency(freq float64) (data [3]byte, errCents float64) {
+	semitones := 69.0 + 12.0*math.Log2(freq/440.0)
+	target := semitones
+	if !(semitones > 0) {
+		semitones = 0
+	}
+	if semitones > mtsMaxSemitones {
+		semitones = mtsMaxSemitones
+	}
+	note := math.Floor(semitones)
+	frac := math.Round((semitones - note) * 16384.0)
+	if frac >= 16384 {
+		note++
+		frac = 0
+	}
+	data = [3]byte{byte(note), byte(int(frac) >> 7), byte(int(frac) & 0x7F)}
+	errCents = 100.0 * (note + frac/16384.0 - target)
+	return
+}
+
+// mtsName returns name as the 16 ASCII characters of a bulk dump, padded with spaces.
+// Characters outside printable ASCII become '?'.
+func mtsName(name string) (b []byte) {
+	for _, c := range name {
+		if len(b) == 16 {
+			break
+		}
+		if c < 0x20 || c > 0x7E {
+			c = '?'
+		}
+		b = append(b, byte(c))
+	}
+	for len(b) < 16 {
+		b = append(b, ' ')
+	}
+	return
+}
+
+// MTSBulkDump returns a non-real-time bulk tuning dump of all 128 notes of t, for
+// opts.Program and named opts.Name, and the error in cents of each note
+func MTSBulkDump(t Tuning, opts MTSOptions) (msg []byte, errs [128]float64, err error) {
+	if err = opts.validate(); err != nil {
+		return
+	}
+	name := opts.Name
+	if name == "" {
+		name = t.Scale().Description
+	}
+	msg = append(opts.header(false, 0x01), byte(opts.Program))
+	msg = append(msg, mtsName(name)...)
+	for n, f := range frequencyTable(t, opts.Unmapped) {
+		var data [3]byte
+		data, errs[n] = mtsFrequency(f)
+		msg = append(msg, data[:]...)
+	}
+	// the checksum is the XOR of everything after F0
+	var sum byte
+	for _, b := range msg[1:] {
+		sum ^= b
+	}
+	msg = append(msg, sum&0x7F, 0xF7)
+	return
+}
+
+// noteChanges appends the note number and frequency data of each of notes
+func noteChanges(msg []byte, t Tuning, notes []int, policy UnmappedPolicy) (out []byte, errs []float64, err error) {
+	if len(notes) == 0 || len(notes) > 127 {
+		err = errors.Errorf("A single note tuning change must have 1..127 notes: %d", len(notes))
+		return
+	}
+	freqs := frequencyTable(t, policy)
+	out = append(msg, byte(len(notes)))
+	errs = make([]float64, len(notes))
+	for i, n := range notes {
+		if n < 0 || n > 127 {
+			err = errors.Errorf("MIDI note must be in 0..127: %d", n)
+			return
+		}
+		var data [3]byte
+		data, errs[i] = mtsFrequency(freqs[n])
+		out = append(out, byte(n))
+		out = append(out, data[:]...)
+	}
+	out = append(out, 0xF7)
+	return
+}
+
+// MTSSingleNoteChange returns a real-time single note tuning change of opts.Program that
+// retunes each of notes to t, and the error in cents of each of them
+func MTSSingleNoteChange(t Tuning, notes []int, opts MTSOptions) (msg []byte, errs []float64, err error) {
+	if err = opts.validate(); err != nil {
+		return
+	}
+	msg, errs, err = noteChanges(append(opts.header(true, 0x02), byte(opts.Program)), t, notes, opts.Unmapped)
+	return
+}
+
+// MTSSingleNoteChangeBank returns a single note tuning change of opts.Program in opts.Bank,
+// real-time if opts.RealTime is set, that retunes each of notes to t, and the error in
+// cents of each of them
+func MTSSingleNoteChangeBank(t Tuning, notes []int, opts MTSOptions) (msg []byte, errs []float64, err error) {
+	if err = opts.validate(); err != nil {
+		return
+	}
+	msg = append(opts.header(opts.RealTime, 0x07), byte(opts.Bank), byte(opts.Program))
+	msg, errs, err = noteChanges(msg, t, notes, opts.Unmapped)
+	return
+}
+
+// scaleOctave returns a scale/octave tuning message. Each pitch class takes its
+// detuning from the octave starting at middle C, quantized to steps of resolution
+// cents around 0 in the range lo..hi.
+func scaleOctave(t Tuning, opts MTSOptions, subID2 byte, resolution float64, lo int, hi int, encode func(v int) []byte) (msg []byte, errs [128]float64, err error) {
+	if err = opts.validate(); err != nil {
+		return
+	}
+	channels := opts.Channels
+	if channels == 0 {
+		channels = 0xFFFF
+	}
+	msg = append(opts.header(opts.RealTime, subID2), byte(channels>>14)&0x03, byte(channels>>7)&0x7F, byte(channels)&0x7F)
+
+	freqs := frequencyTable(t, opts.Unmapped)
+	var detune [128]float64 // cents from 12-EDO
+	for n, f := range freqs {
+		detune[n] = 1200.0 * math.Log2(f/(midi0Freq*math.Pow(2.0, float64(n)/12.0)))
+	}
+	var sent [12]float64
+	for pc := 0; pc < 12; pc++ {
+		v := int(math.Round(detune[60+pc] / resolution))
+		v = imin(imax(v, lo), hi)
+		sent[pc] = float64(v) * resolution
+		msg = append(msg, encode(v)...)
+	}
+	msg = append(msg, 0xF7)
+	for n := range errs {
+		errs[n] = sent[n%12] - detune[n]
+	}
+	return
+}
+
+// MTSScaleOctave1Byte returns a scale/octave tuning message, real-time if opts.RealTime is
+// set, for the channels of opts.Channels. It detunes each pitch class in whole cents from
+// -64 to +63, as t tunes the octave from middle C. It also returns the error in cents of
+// every note, which is large where t does not repeat at the octave.
+func MTSScaleOctave1Byte(t Tuning, opts MTSOptions) (msg []byte, errs [128]float64, err error) {
+	msg, errs, err = scaleOctave(t, opts, 0x08, 1.0, -64, 63, func(v int) []byte {
+		return []byte{byte(v + 0x40)}
+	})
+	return
+}
+
+// MTSScaleOctave2Byte returns a scale/octave tuning message like MTSScaleOctave1Byte
+// but which detunes each pitch class by -100 to +100 cents in steps of 100/8192 cents
+func MTSScaleOctave2Byte(t Tuning, opts MTSOptions) (msg []byte, errs [128]float64, err error) {
+	msg, errs, err = scaleOctave(t, opts, 0x09, 100.0/8192.0, -0x2000, 0x1FFF, func(v int) []byte {
+		v += 0x2000
+		return []byte{byte(v >> 7), byte(v & 0x7F)}
+	})
+	return
+}
+
+// WriteSYX writes SysEx messages to w as a .syx file, which is simply the messages one
+// after the other
+func WriteSYX(w io.Writer, msgs ...[]byte) (err error) {
+	for _, msg := range msgs {
+		if len(msg) < 2 || msg[0] != 0xF0 || msg[len(msg)-1] != 0xF7 {
+			err = errors.Errorf("Not a SysEx message: % X", msg)
+			return
+		}
+		if _, err = w.Write(msg); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ErrNotMTS is returned by MTSDecoder.Apply for a message that is not part of the MIDI Tuning Standard
+var ErrNotMTS = errors.New("Not an MTS message")
+
+// An MTSDecoder follows the tuning that a sequence of MTS messages sets up, starting
+// from standard 12-EDO tuning. Bulk dumps, single note tuning changes and scale/octave
+// messages all change the one tuning: their device IDs, tuning banks, programs and
+// channels are not tracked. The zero value is ready to use.
+type MTSDecoder struct {
+	Name        string // the name of the last bulk dump applied
+	freqs       [128]float64
+	initialized bool
+}
+
+func (d *MTSDecoder) init() {
+	if !d.initialized {
+		for n := range d.freqs {
+			d.freqs[n] = midi0Freq * math.Pow(2.0, float64(n)/12.0)
+		}
+		d.initialized = true
+	}
+}
+
+// mtsDecodeFrequency returns the frequency of MTS frequency data, and false for 7F 7F 7F, which leaves a note unchanged
+func mtsDecodeFrequency(data []byte) (freq float64, ok bool) {
+	if data[0] == 0x7F && data[1] == 0x7F && data[2] == 0x7F {
+		return
+	}
+	semitones := float64(data[0]&0x7F) + float64(int(data[1]&0x7F)<<7|int(data[2]&0x7F))/16384.0
+	freq = 440.0 * math.Pow(2.0, (semitones-69.0)/12.0)
+	ok = true
+	return
+}
+
+// Apply changes the tuning as msg, a complete SysEx message from F0 to F7, directs.
+// It returns ErrNotMTS for a message that is not part of the MIDI Tuning Standard,
+// and leaves the tuning unchanged if msg is malformed or its checksum is wrong.
+// MTS messages which do not carry a tuning, such as dump requests, are ignored.
+func (d *MTSDecoder) Apply(msg []byte) (err error) {
+	if len(msg) < 6 || msg[0] != 0xF0 || (msg[1] != 0x7E && msg[1] != 0x7F) || msg[3] != 0x08 {
+		err = ErrNotMTS
+		return
+	}
+	if msg[len(msg)-1] != 0xF7 {
+		err = errors.Errorf("MTS message does not end with F7: % X", msg)
+		return
+	}
+	d.init()
+	body := msg[5 : len(msg)-1]
+	wrongLength := func(want int) error {
+		return errors.Errorf("MTS message of type %02X has %d bytes of data rather than %d", msg[4], len(body), want)
+	}
+	checksum := func() error {
+		var sum byte
+		for _, b := range msg[1 : len(msg)-2] {
+			sum ^= b
+		}
+		if sum&0x7F != msg[len(msg)-2] {
+			return errors.Errorf("MTS message of type %02X has checksum %02X rather than %02X", msg[4], msg[len(msg)-2], sum&0x7F)
+		}
+		return nil
+	}
+	// dumps with a bank number have one more byte before the name
+	bank := 0
+	switch msg[4] {
+	case 0x04, 0x05, 0x06:
+		bank = 1
+	}
+
+	switch msg[4] {
+	case 0x01, 0x04:
+		// bulk dump: [bank] program name[16] data[3*128] checksum
+		if len(body) != bank+1+16+3*128+1 {
+			return wrongLength(bank + 1 + 16 + 3*128 + 1)
+		}
+		if err = checksum(); err != nil {
+			return
+		}
+		d.Name = string(body[bank+1 : bank+17])
+		data := body[bank+17:]
+		for n := 0; n < 128; n++ {
+			if f, ok := mtsDecodeFrequency(data[3*n : 3*n+3]); ok {
+				d.freqs[n] = f
+			}
+		}
+	case 0x02, 0x07:
+		// single note tuning change: [bank] program count (note data[3])*count
+		first := 2
+		if msg[4] == 0x07 {
+			first = 3
+		}
+		if len(body) < first {
+			return wrongLength(first)
+		}
+		count := int(body[first-1])
+		if len(body) != first+4*count {
+			return wrongLength(first + 4*count)
+		}
+		changes := body[first:]
+		for i := 0; i < count; i++ {
+			if f, ok := mtsDecodeFrequency(changes[4*i+1 : 4*i+4]); ok {
+				d.freqs[changes[4*i]&0x7F] = f
+			}
+		}
+	case 0x05, 0x06, 0x08, 0x09:
+		// scale/octave dump: bank program name[16] detune[12] checksum
+		// scale/octave tuning: channels[3] detune[12]
+		size := 1
+		if msg[4] == 0x06 || msg[4] == 0x09 {
+			size = 2
+		}
+		start, want := 3, 3+12*size
+		if msg[4] == 0x05 || msg[4] == 0x06 {
+			start, want = 18, 18+12*size+1
+		}
+		if len(body) != want {
+			return wrongLength(want)
+		}
+		if start == 18 {
+			if err = checksum(); err != nil {
+				return
+			}
+			d.Name = string(body[2:18])
+		}
+		var detune [12]float64
+		for pc := range detune {
+			if size == 1 {
+				detune[pc] = float64(int(body[start+pc]) - 0x40)
+			} else {
+				v := int(body[start+2*pc])<<7 | int(body[start+2*pc+1])
+				detune[pc] = float64(v-0x2000) * 100.0 / 8192.0
+			}
+		}
+		for n := range d.freqs {
+			d.freqs[n] = midi0Freq * math.Pow(2.0, (float64(n)+detune[n%12]/100.0)/12.0)
+		}
+	}
+	return
+}
+
+// Frequencies returns the frequency in Hz of each MIDI note
+func (d *MTSDecoder) Frequencies() [128]float64 {
+	d.init()
+	return d.freqs
+}
+
+// mtsResolution is the step in cents of MTS frequency data
+const mtsResolution = 100.0 / 16384.0
+
+// ScaleAndMapping returns a scale and mapping for the current tuning, so that it can be saved
+// as SCL and KBM files. They are those of ScaleAndMappingFromFrequencies, except that the
+// frequencies need only repeat to within the resolution of MTS for the scale to be shorter
+// than 127 tones. The scale's Description is the Name of the last bulk dump, if there has been one.
+func (d *MTSDecoder) ScaleAndMapping() (s Scale, k KeyboardMapping, err error) {
+	// each note may be half a step out, so the interval between two notes a period apart
+	// may vary by two steps
+	if s, k, err = scaleAndMappingFromFrequencies(d.Frequencies(), 2*mtsResolution); err != nil {
+		return
+	}
+	if name := strings.TrimRight(d.Name, " "); name != "" {
+		if s, err = ScaleFromTones(name, s.Tones); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Tuning returns the current tuning
+func (d *MTSDecoder) Tuning() (t Tuning, err error) {
+	var s Scale
+	var k KeyboardMapping
+	if s, k, err = d.ScaleAndMapping(); err != nil {
+		return
+	}
+	if t, err = TuningFromSCLAndKBM(s, k); err != nil {
+		return
+	}
+	return
+}
+
+// ReadSYX returns the SysEx messages of a .syx file. Bytes between messages are skipped.
+func ReadSYX(rdr io.Reader) (msgs [][]byte, err error) {
+	var data []byte
+	if data, err = ioutil.ReadAll(rdr); err != nil {
+		return
+	}
+	for {
+		start := bytes.IndexByte(data, 0xF0)
+		if start < 0 {
+			return
+		}
+		end := bytes.IndexByte(data[start:], 0xF7)
+		if end < 0 {
+			err = errors.Errorf("SysEx message at byte %d has no F7", start)
+			return
+		}
+		msgs = append(msgs, data[start:start+end+1])
+		data = data[start+end+1:]
+	}
+}
+
+// TuningFromSYXStream returns the tuning that the MTS messages of a .syx file set up.
+// Other SysEx messages are ignored.
+func TuningFromSYXStream(rdr io.Reader) (t Tuning, err error) {
+	var msgs [][]byte
+	if msgs, err = ReadSYX(rdr); err != nil {
+		return
+	}
+	var d MTSDecoder
+	for i, msg := range msgs {
+		if err = d.Apply(msg); err == ErrNotMTS {
+			err = nil
+		} else if err != nil {
+			err = errors.Wrapf(err, "SysEx message %d", i+1)
+			return
+		}
+	}
+	t, err = d.Tuning()
+	return
+}
+
+// TuningFromSYXFile returns the tuning that the MTS messages of the .syx file fname set up
+func TuningFromSYXFile(fname string) (t Tuning, err error) {
+	var file *os.File
+	if file, err = os.Open(fname); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", fname)
+		return
+	}
+	defer file.Close()
+	if t, err = TuningFromSYXStream(file); err != nil {
+		err = errors.Wrapf(err, "Unable to parse file '%s'", fname)
+		return
+	}
+	return
+}
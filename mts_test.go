@@ -0,0 +1,254 @@
+package scala
+
+import (
+	"bytes"
+	"gotest.tools/v3/assert"
+	"math"
+	"testing"
+)
+
+// MTS - frequency data
+func TestMTSFrequency(t *testing.T) {
+	for _, c := range []struct {
+		freq float64
+		data [3]byte
+		err  float64
+	}{
+		{440, [3]byte{0x45, 0x00, 0x00}, 0},
+		{261.6255653005986, [3]byte{0x3C, 0x00, 0x00}, 0},
+		{8.175798915643707, [3]byte{0x00, 0x00, 0x00}, 0},
+		{440 * math.Pow(2, 0.5/12), [3]byte{0x45, 0x40, 0x00}, 0},
+		{440 * math.Pow(2, 1.0/1200), [3]byte{0x45, 0x01, 0x24}, 0.0003},
+		{440 * math.Pow(2, 99.9999/1200), [3]byte{0x46, 0x00, 0x00}, 0.0001},
+		{4, [3]byte{0x00, 0x00, 0x00}, 1237.6},
+		{20000, [3]byte{0x7F, 0x7F, 0x7E}, -707.6},
+	} {
+		data, errCents := mtsFrequency(c.freq)
+		assert.Equal(t, data, c.data, c.freq)
+		assert.Equal(t, "", approxEqual(0.1, errCents, c.err))
+		assert.Assert(t, c.err != 0 || math.Abs(errCents) <= 100.0/16384/2, c.freq)
+	}
+}
+
+// MTS - bulk dump of standard tuning
+func TestMTSBulkDump(t *testing.T) {
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	msg, errs, err := MTSBulkDump(std, MTSOptions{DeviceID: MTSAllDevices, Program: 5, Name: "Standard tuning with a long name"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(msg), 408)
+	assert.DeepEqual(t, msg[:6], []byte{0xF0, 0x7E, 0x7F, 0x08, 0x01, 0x05})
+	assert.Equal(t, string(msg[6:22]), "Standard tuning ")
+	for n := 0; n < 128; n++ {
+		assert.DeepEqual(t, msg[22+3*n:25+3*n], []byte{byte(n), 0, 0})
+		assert.Assert(t, math.Abs(errs[n]) < 0.001)
+	}
+	var sum byte
+	for _, b := range msg[1 : len(msg)-2] {
+		sum ^= b
+	}
+	assert.Equal(t, msg[406], sum&0x7F)
+	assert.Equal(t, msg[407], byte(0xF7))
+
+	msg, _, err = MTSBulkDump(std, MTSOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, string(msg[6:22]), "12 Tone Equal Te")
+
+	_, _, err = MTSBulkDump(std, MTSOptions{Program: 128})
+	assert.ErrorContains(t, err, "program")
+}
+
+// MTS - single note changes
+func TestMTSSingleNoteChange(t *testing.T) {
+	k, err := KeyboardMappingTuneA69To(432)
+	assert.NilError(t, err)
+	a432, err := TuningFromKBM(k)
+	assert.NilError(t, err)
+
+	msg, errs, err := MTSSingleNoteChange(a432, []int{69, 81}, MTSOptions{DeviceID: 3, Program: 1})
+	assert.NilError(t, err)
+	// 432 Hz is 31.77 cents below A440, 0x44 + 11179/16384
+	assert.DeepEqual(t, msg, []byte{0xF0, 0x7F, 0x03, 0x08, 0x02, 0x01, 0x02,
+		69, 0x44, 0x57, 0x2B, 81, 0x50, 0x57, 0x2B, 0xF7})
+	assert.Equal(t, len(errs), 2)
+	assert.Assert(t, math.Abs(errs[0]) <= 100.0/16384/2)
+
+	msg, _, err = MTSSingleNoteChangeBank(a432, []int{69}, MTSOptions{Bank: 2, Program: 1})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, msg, []byte{0xF0, 0x7E, 0x00, 0x08, 0x07, 0x02, 0x01, 0x01, 69, 0x44, 0x57, 0x2B, 0xF7})
+	msg, _, err = MTSSingleNoteChangeBank(a432, []int{69}, MTSOptions{RealTime: true})
+	assert.NilError(t, err)
+	assert.Equal(t, msg[1], byte(0x7F))
+
+	_, _, err = MTSSingleNoteChange(a432, nil, MTSOptions{})
+	assert.ErrorContains(t, err, "1..127 notes")
+	_, _, err = MTSSingleNoteChange(a432, []int{128}, MTSOptions{})
+	assert.ErrorContains(t, err, "MIDI note")
+}
+
+// MTS - scale/octave tuning
+func TestMTSScaleOctave(t *testing.T) {
+	k, err := KeyboardMappingTuneA69To(442)
+	assert.NilError(t, err)
+	a442, err := TuningFromKBM(k)
+	assert.NilError(t, err)
+	detune := 1200 * math.Log2(442.0/440.0)
+
+	msg, errs, err := MTSScaleOctave1Byte(a442, MTSOptions{Channels: 1<<0 | 1<<9 | 1<<15})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, msg[:8], []byte{0xF0, 0x7E, 0x00, 0x08, 0x08, 0x02, 0x04, 0x01})
+	assert.Equal(t, len(msg), 21)
+	for _, ss := range msg[8:20] {
+		assert.Equal(t, ss, byte(0x40+8))
+	}
+	assert.Equal(t, "", approxEqual(1e-6, errs[0], 8-detune))
+
+	msg, errs, err = MTSScaleOctave2Byte(a442, MTSOptions{RealTime: true})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, msg[:8], []byte{0xF0, 0x7F, 0x00, 0x08, 0x09, 0x03, 0x7F, 0x7F})
+	assert.Equal(t, len(msg), 33)
+	v := 0x2000 + int(math.Round(detune*8192/100))
+	assert.DeepEqual(t, msg[8:10], []byte{byte(v >> 7), byte(v & 0x7F)})
+	for n := range errs {
+		assert.Assert(t, math.Abs(errs[n]) <= 100.0/8192/2)
+	}
+
+	// a scale that does not repeat at the octave cannot be sent exactly
+	s, err := ScaleEvenDivisionOfSpanByM(3, 13)
+	assert.NilError(t, err)
+	bp, err := TuningFromSCL(s)
+	assert.NilError(t, err)
+	_, errs, err = MTSScaleOctave2Byte(bp, MTSOptions{})
+	assert.NilError(t, err)
+	assert.Assert(t, math.Abs(errs[100]) > 10)
+}
+
+// MTS - .syx files
+func TestWriteSYX(t *testing.T) {
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	m1, _, err := MTSBulkDump(std, MTSOptions{})
+	assert.NilError(t, err)
+	m2, _, err := MTSScaleOctave1Byte(std, MTSOptions{})
+	assert.NilError(t, err)
+	var buf bytes.Buffer
+	assert.NilError(t, WriteSYX(&buf, m1, m2))
+	assert.DeepEqual(t, buf.Bytes(), append(append([]byte(nil), m1...), m2...))
+	assert.ErrorContains(t, WriteSYX(&buf, []byte{0x90, 0x40, 0x7F}), "Not a SysEx message")
+}
+
+// MTS decoding - a bulk dump round trips to within the resolution of MTS
+func TestMTSDecodeBulkDump(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingTuneA69To(432)
+	assert.NilError(t, err)
+	tuning, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+	msg, _, err := MTSBulkDump(tuning, MTSOptions{Name: "31-EDO"})
+	assert.NilError(t, err)
+
+	var d MTSDecoder
+	assert.NilError(t, d.Apply(msg))
+	assert.Equal(t, d.Name, "31-EDO          ")
+	back, err := d.Tuning()
+	assert.NilError(t, err)
+	for n := 0; n < 128; n++ {
+		f := tuning.FrequencyForMidiNote(n)
+		assert.Equal(t, "", approxEqual(f*1e-5, back.FrequencyForMidiNote(n), f))
+	}
+	s, k, err = d.ScaleAndMapping()
+	assert.NilError(t, err)
+	assert.Equal(t, s.Description, "31-EDO")
+	assert.Equal(t, s.Count, 31)
+	assert.Equal(t, "", approxEqual(1e-3, k.TuningFrequency, tuning.FrequencyForMidiNote(60)))
+
+	msg[100] ^= 1
+	assert.ErrorContains(t, d.Apply(msg), "checksum")
+	assert.ErrorContains(t, d.Apply(msg[:300]), "F7")
+	assert.ErrorContains(t, d.Apply(append(msg[:300:300], 0xF7)), "bytes of data")
+}
+
+// MTS decoding - single note changes and scale/octave messages
+func TestMTSDecodeChanges(t *testing.T) {
+	var d MTSDecoder
+	std := d.Frequencies()
+	assert.Equal(t, "", approxEqual(1e-9, std[69], 440))
+
+	assert.NilError(t, d.Apply([]byte{0xF0, 0x7F, 0x7F, 0x08, 0x02, 0x00, 0x02, 69, 0x44, 0x57, 0x2B, 70, 0x7F, 0x7F, 0x7F, 0xF7}))
+	freqs := d.Frequencies()
+	assert.Equal(t, "", approxEqual(0.01, freqs[69], 432))
+	assert.Equal(t, freqs[70], std[70])
+	assert.Equal(t, freqs[68], std[68])
+
+	assert.NilError(t, d.Apply([]byte{0xF0, 0x7E, 0x00, 0x08, 0x07, 0x01, 0x02, 0x01, 60, 0x3C, 0x40, 0x00, 0xF7}))
+	assert.Equal(t, "", approxEqual(1e-9, d.Frequencies()[60], std[60]*math.Pow(2, 0.5/12)))
+
+	k, err := KeyboardMappingTuneA69To(442)
+	assert.NilError(t, err)
+	a442, err := TuningFromKBM(k)
+	assert.NilError(t, err)
+	for _, encode := range []func(Tuning, MTSOptions) ([]byte, [128]float64, error){MTSScaleOctave1Byte, MTSScaleOctave2Byte} {
+		msg, errs, err := encode(a442, MTSOptions{})
+		assert.NilError(t, err)
+		assert.NilError(t, d.Apply(msg))
+		for n, f := range d.Frequencies() {
+			assert.Equal(t, "", approxEqual(1e-6, 1200*math.Log2(f/a442.FrequencyForMidiNote(n)), errs[n]))
+		}
+	}
+
+	assert.Equal(t, d.Apply([]byte{0xF0, 0x43, 0x10, 0x7E, 0x00, 0x00, 0xF7}), ErrNotMTS)
+	// a dump request
+	assert.NilError(t, d.Apply([]byte{0xF0, 0x7E, 0x00, 0x08, 0x00, 0x00, 0xF7}))
+}
+
+// MTS decoding - scale/octave dumps
+func TestMTSDecodeScaleOctaveDump(t *testing.T) {
+	msg := []byte{0xF0, 0x7E, 0x00, 0x08, 0x05, 0x00, 0x01}
+	msg = append(msg, mtsName("Detuned")...)
+	for pc := 0; pc < 12; pc++ {
+		msg = append(msg, byte(0x40+pc))
+	}
+	var sum byte
+	for _, b := range msg[1:] {
+		sum ^= b
+	}
+	msg = append(msg, sum&0x7F, 0xF7)
+	var d MTSDecoder
+	assert.NilError(t, d.Apply(msg))
+	assert.Equal(t, d.Name, "Detuned         ")
+	freqs := d.Frequencies()
+	for n, f := range freqs {
+		assert.Equal(t, "", approxEqual(1e-9, 1200*math.Log2(f/440)-100*float64(n-69), float64(n%12)))
+	}
+}
+
+// MTS decoding - .syx files
+func TestTuningFromSYX(t *testing.T) {
+	k, err := KeyboardMappingTuneA69To(442)
+	assert.NilError(t, err)
+	a442, err := TuningFromKBM(k)
+	assert.NilError(t, err)
+	dump, _, err := MTSBulkDump(a442, MTSOptions{})
+	assert.NilError(t, err)
+	change, _, err := MTSSingleNoteChange(a442, []int{60}, MTSOptions{})
+	assert.NilError(t, err)
+
+	// (at A432 note 0 would be below the range of MTS, so the dump would not repeat exactly)
+	var buf bytes.Buffer
+	assert.NilError(t, WriteSYX(&buf, []byte{0xF0, 0x43, 0x00, 0x01, 0xF7}, dump, change))
+	msgs, err := ReadSYX(bytes.NewReader(buf.Bytes()))
+	assert.NilError(t, err)
+	assert.Equal(t, len(msgs), 3)
+	assert.DeepEqual(t, msgs[2], change)
+
+	back, err := TuningFromSYXStream(&buf)
+	assert.NilError(t, err)
+	assert.Equal(t, "", approxEqual(0.01, back.FrequencyForMidiNote(69), 442))
+	assert.Equal(t, back.Scale().Count, 12)
+
+	_, err = ReadSYX(bytes.NewReader(dump[:100]))
+	assert.ErrorContains(t, err, "no F7")
+	_, err = TuningFromSYXFile(testFile("missing.syx"))
+	assert.ErrorContains(t, err, "Unable to open file")
+}
@@ -0,0 +1,180 @@
+package scala
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// ParseMode selects how closely the loaders hold an SCL or KBM file to the format
+type ParseMode int
+
+const (
+	// ParseDefault is the behavior of ScaleFromSCLStream and KeyboardMappingFromKBMStream
+	ParseDefault ParseMode = iota
+	// ParseStrict accepts only what Scala itself accepts: no text after the last
+	// tone or key, no blank lines among the tones, positive ratios and MIDI notes
+	// in 0..127. As in Scala, trailing unmapped keys may be left out of a KBM file;
+	// with no MaxTones, at most 65536 of them.
+	ParseStrict
+	// ParseLenient recovers from errors where it can and reports them as warnings.
+	// Bad tones are skipped, bad keys are unmapped, bad header fields take a default
+	// value, and the count follows the tones actually found. Signed values and text
+	// after a KBM value are accepted.
+	ParseLenient
+)
+
+// ParseOptions controls the ...WithOptions loaders. The zero value gives the
+// default behavior with no limits.
+type ParseOptions struct {
+	Mode          ParseMode
+	MaxFileSize   int64 // the maximum number of bytes to read; 0 for no limit
+	MaxLineLength int   // the maximum length of a line in bytes; 0 for no limit
+	MaxTones      int   // the maximum SCL count or KBM map size; 0 for no limit
+
+	// Text is always converted to UTF-8 (see Encoding). Set PreserveRawText to
+	// have RawText hold the bytes of the file exactly as they were read instead.
+	PreserveRawText bool
+}
+
+var errFileTooLarge = errors.New("file too large")
+
+// limitReader reads from r but fails once more than remaining bytes have been read
+type limitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitReader) Read(p []byte) (n int, err error) {
+	if l.remaining < 0 {
+		return 0, errFileTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err = l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		n += int(l.remaining)
+		err = errFileTooLarge
+	}
+	return
+}
+
+// lineReader splits a stream into lines, keeping their line endings so that
+// a file can be reproduced byte for byte. Unlike bufio.Scanner it has no limit
+// on the length of a line other than ParseOptions.MaxLineLength.
+//
+// Lines are returned as UTF-8. A byte order mark selects the encoding of the
+// whole stream; otherwise a stream whose start is not valid UTF-8 is read as
+// Windows-1252. The encoding is decided once for the whole stream, so that a file
+// can be written back in it, and the stream is converted as it is read, so that
+// the limits apply without reading more of it than they allow.
+type lineReader struct {
+	r        *bufio.Reader
+	max      int // the longest line allowed, including its ending; 0 for no limit
+	buf      []byte
+	line     string
+	err      error
+	encoding Encoding
+	raw      *strings.Builder // the bytes read, before conversion, when PreserveRawText is set
+}
+
+// newLineReader returns a reader of the lines of rdr which enforces the file size and line length limits
+func (opts ParseOptions) newLineReader(rdr io.Reader) *lineReader {
+	if opts.MaxFileSize > 0 {
+		rdr = &limitReader{r: rdr, remaining: opts.MaxFileSize}
+	}
+	lr := &lineReader{}
+	if opts.PreserveRawText {
+		lr.raw = &strings.Builder{}
+		rdr = io.TeeReader(rdr, lr.raw)
+	}
+	rdr, lr.encoding = decodeBOM(rdr)
+	if lr.encoding == EncodingUTF8 {
+		rdr, lr.encoding = decodeLegacy(rdr)
+	}
+	lr.r = bufio.NewReader(rdr)
+	if opts.MaxLineLength > 0 {
+		// leave room for a CR LF line ending
+		lr.max = opts.MaxLineLength + 2
+	}
+	return lr
+}
+
+// Scan advances to the next line, which is then available through Text. It
+// returns false at the end of the input or on an error.
+func (lr *lineReader) Scan() bool {
+	if lr.err != nil {
+		return false
+	}
+	lr.buf = lr.buf[:0]
+	for {
+		chunk, err := lr.r.ReadSlice('\n')
+		lr.buf = append(lr.buf, chunk...)
+		if lr.max > 0 && len(lr.buf) > lr.max {
+			lr.err = bufio.ErrTooLong
+			return false
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			lr.err = err
+			if err != io.EOF || len(lr.buf) == 0 {
+				return false
+			}
+		}
+		lr.line = string(lr.buf)
+		return true
+	}
+}
+
+// Text returns the current line, with its line ending
+func (lr *lineReader) Text() string {
+	return lr.line
+}
+
+// Err returns the error that stopped the reader, or nil at the end of the input
+func (lr *lineReader) Err() error {
+	if lr.err == io.EOF {
+		return nil
+	}
+	return lr.err
+}
+
+// scanError converts the errors from a reader made by newLineReader into a ParseError
+func (opts ParseOptions) scanError(err error, lineno int) error {
+	switch err {
+	case nil:
+		return nil
+	case errFileTooLarge:
+		return &ParseError{Line: lineno, Kind: KindLimit, Err: err,
+			Msg: fmt.Sprintf("File is longer than the limit of %d bytes", opts.MaxFileSize)}
+	case bufio.ErrTooLong:
+		return &ParseError{Line: lineno + 1, Kind: KindLimit, Err: err,
+			Msg: fmt.Sprintf("Line is longer than the limit of %d bytes", opts.MaxLineLength)}
+	}
+	return err
+}
+
+// checkLineLength enforces MaxLineLength on lines that fit within the reader's limit
+// only because of the room left for their line ending
+func (opts ParseOptions) checkLineLength(line string, lineno int) error {
+	if opts.MaxLineLength > 0 && len(line) > opts.MaxLineLength {
+		return &ParseError{Line: lineno, Kind: KindLimit, Err: bufio.ErrTooLong,
+			Msg: fmt.Sprintf("Line is longer than the limit of %d bytes", opts.MaxLineLength)}
+	}
+	return nil
+}
+
+// checkCount enforces MaxTones
+func (opts ParseOptions) checkCount(count int, lineno int) error {
+	if opts.MaxTones > 0 && count > opts.MaxTones {
+		return &ParseError{Line: lineno, Kind: KindLimit,
+			Msg: fmt.Sprintf("Count of %d is more than the limit of %d", count, opts.MaxTones)}
+	}
+	return nil
+}
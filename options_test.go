@@ -0,0 +1,197 @@
+package scala
+
+import (
+	"gotest.tools/v3/assert"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func sclWithOptions(t *testing.T, fname string, opts ParseOptions) (Scale, []*ParseError, error) {
+	file, err := os.Open(testFile(fname))
+	assert.NilError(t, err)
+	defer file.Close()
+	return ScaleFromSCLStreamWithOptions(file, opts)
+}
+
+func kbmWithOptions(t *testing.T, fname string, opts ParseOptions) (KeyboardMapping, []*ParseError, error) {
+	file, err := os.Open(testFile(fname))
+	assert.NilError(t, err)
+	defer file.Close()
+	return KeyboardMappingFromKBMStreamWithOptions(file, opts)
+}
+
+// Parse options - strict SCL
+func TestParseStrictSCL(t *testing.T) {
+	strict := ParseOptions{Mode: ParseStrict}
+	for _, fname := range testSCLs {
+		_, warnings, err := sclWithOptions(t, fname, strict)
+		assert.NilError(t, err, fname)
+		assert.Equal(t, len(warnings), 0)
+	}
+	_, _, err := sclWithOptions(t, "bad/extraline.scl", strict)
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindTrailing)
+	assert.Equal(t, parseErrorOf(t, err).Line, 24)
+
+	_, _, err = sclWithOptions(t, "bad/blanknote.scl", strict)
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindBadTone)
+	assert.Equal(t, parseErrorOf(t, err).Line, 12)
+
+	_, _, err = ScaleFromSCLStreamWithOptions(strings.NewReader("neg\n1\n-3/2\n"), strict)
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindBadTone)
+}
+
+// Parse options - lenient SCL
+func TestParseLenientSCL(t *testing.T) {
+	lenient := ParseOptions{Mode: ParseLenient}
+	scale, warnings, err := sclWithOptions(t, "bad/badnote.scl", lenient)
+	assert.NilError(t, err)
+	assert.Equal(t, scale.Count, 16)
+	assert.Equal(t, len(scale.Tones), 16)
+	assert.Equal(t, len(warnings), 2)
+	assert.Equal(t, warnings[0].Kind, KindBadTone)
+	assert.Equal(t, warnings[0].Line, 12)
+	assert.Equal(t, warnings[1].Kind, KindToneCount)
+
+	_, warnings, err = sclWithOptions(t, "bad/extraline.scl", lenient)
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 1)
+	assert.Equal(t, warnings[0].Kind, KindTrailing)
+
+	scale, warnings, err = ScaleFromSCLStreamWithOptions(strings.NewReader("desc\ntwelve\n100.0\n\n2/1\n"), lenient)
+	assert.NilError(t, err)
+	assert.Equal(t, scale.Count, 2)
+	assert.Equal(t, len(warnings), 1)
+	assert.Equal(t, warnings[0].Kind, KindBadCount)
+
+	_, _, err = ScaleFromSCLStreamWithOptions(strings.NewReader("desc\n3\nnothing\n"), lenient)
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindToneCount)
+}
+
+// Parse options - strict KBM
+func TestParseStrictKBM(t *testing.T) {
+	strict := ParseOptions{Mode: ParseStrict}
+	for _, fname := range testKBMs {
+		_, _, err := kbmWithOptions(t, fname, strict)
+		assert.NilError(t, err, fname)
+	}
+	_, _, err := kbmWithOptions(t, "bad/extraline-long.kbm", strict)
+	assert.NilError(t, err)
+	_, _, err = KeyboardMappingFromKBMStreamWithOptions(strings.NewReader("0\n0\n127\n60\n69\n440.0\n0\nextra\n"), strict)
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindTrailing)
+
+	// unmapped keys at the end may be left out
+	k, _, err := kbmWithOptions(t, "bad/missing-note.kbm", strict)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, k.Keys, []int{0, 1, 2, 3, 4, 5, 6, 8, 9, 10, 11, -1})
+
+	_, _, err = KeyboardMappingFromKBMStreamWithOptions(strings.NewReader("0\n0\n127\n60\n200\n440.0\n0\n"), strict)
+	pe := parseErrorOf(t, err)
+	assert.Equal(t, pe.Kind, KindRange)
+	assert.Equal(t, pe.Line, 5)
+}
+
+// Parse options - lenient KBM
+func TestParseLenientKBM(t *testing.T) {
+	lenient := ParseOptions{Mode: ParseLenient}
+	k, warnings, err := KeyboardMappingFromKBMStreamWithOptions(strings.NewReader(
+		"2 ! size\n+0\n127 last\n60\n69\n440.0 Hz\n\n2\n0\n1 the fifth\n"), lenient)
+	assert.NilError(t, err)
+	assert.Equal(t, k.Count, 2)
+	assert.Equal(t, k.TuningFrequency, 440.0)
+	assert.DeepEqual(t, k.Keys, []int{0, 1})
+	assert.Equal(t, len(warnings), 1)
+
+	k, warnings, err = kbmWithOptions(t, "bad/garbage-key.kbm", lenient)
+	assert.NilError(t, err)
+	assert.Equal(t, k.Keys[4], -1)
+	assert.Equal(t, len(warnings), 1)
+	assert.Equal(t, warnings[0].Kind, KindBadKey)
+	assert.Equal(t, warnings[0].Line, 26)
+
+	k, warnings, err = KeyboardMappingFromKBMStreamWithOptions(strings.NewReader("0\n0\n127\n60\n69\nfour forty\n0\n"), lenient)
+	assert.NilError(t, err)
+	assert.Equal(t, k.TuningFrequency, 440.0)
+	assert.Equal(t, len(warnings), 1)
+	assert.Equal(t, warnings[0].Kind, KindBadHeader)
+
+	_, _, err = kbmWithOptions(t, "bad/empty-bad.kbm", lenient)
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindIncomplete)
+}
+
+// Parse options - resource limits
+func TestParseLimits(t *testing.T) {
+	_, _, err := sclWithOptions(t, "31edo.scl", ParseOptions{MaxFileSize: 100})
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindLimit)
+	_, _, err = sclWithOptions(t, "31edo.scl", ParseOptions{MaxTones: 12})
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindLimit)
+	_, _, err = sclWithOptions(t, "31edo.scl", ParseOptions{MaxFileSize: 1000, MaxTones: 31, MaxLineLength: 80})
+	assert.NilError(t, err)
+
+	long := "desc\n1\n" + strings.Repeat(" ", 100) + "2/1\n"
+	_, _, err = ScaleFromSCLStreamWithOptions(strings.NewReader(long), ParseOptions{MaxLineLength: 50})
+	pe := parseErrorOf(t, err)
+	assert.Equal(t, pe.Kind, KindLimit)
+	assert.Equal(t, pe.Line, 3)
+	_, _, err = ScaleFromSCLStreamWithOptions(strings.NewReader(long), ParseOptions{MaxLineLength: 103})
+	assert.NilError(t, err)
+
+	// a long line stops the read however the file is encoded
+	for _, c := range []string{"x", "\x80"} {
+		huge := &countingReader{r: io.LimitReader(repeatReader(c), 50<<20)}
+		_, _, err = ScaleFromSCLStreamWithOptions(huge, ParseOptions{MaxLineLength: 100})
+		assert.Equal(t, parseErrorOf(t, err).Kind, KindLimit)
+		assert.Assert(t, huge.n < 1<<20, huge.n)
+	}
+
+	// a lenient parse with an unknown count is still limited
+	_, _, err = ScaleFromSCLStreamWithOptions(strings.NewReader("d\nx\n1.0\n2.0\n3.0\n"), ParseOptions{Mode: ParseLenient, MaxTones: 2})
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindLimit)
+
+	_, _, err = kbmWithOptions(t, "mapping-whitekeys-a440.kbm", ParseOptions{MaxTones: 8})
+	assert.Equal(t, parseErrorOf(t, err).Kind, KindLimit)
+	// the unmapped keys a file leaves out are limited even with no MaxTones
+	for _, mode := range []ParseMode{ParseStrict, ParseLenient} {
+		_, _, err = KeyboardMappingFromKBMStreamWithOptions(strings.NewReader("100000000\n0\n127\n60\n69\n440.0\n12\n"), ParseOptions{Mode: mode})
+		assert.Equal(t, parseErrorOf(t, err).Kind, KindLimit)
+	}
+	k, _, err := KeyboardMappingFromKBMStreamWithOptions(strings.NewReader("1000\n0\n127\n60\n69\n440.0\n12\n0\n"), ParseOptions{Mode: ParseStrict})
+	assert.NilError(t, err)
+	assert.Equal(t, len(k.Keys), 1000)
+}
+
+// repeatReader is an endless stream of s
+type repeatReader string
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r[i%len(r)]
+	}
+	return len(p), nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return
+}
+
+// Parse options - lines longer than bufio.Scanner's 64 KiB limit
+func TestParseLongLines(t *testing.T) {
+	label := strings.Repeat("very long label ", 10000)
+	scale, err := ScaleFromSCLString("desc\n2\n100.0 " + label + "\r\n2/1\n")
+	assert.NilError(t, err)
+	assert.Equal(t, scale.Tones[0].Label, strings.TrimSpace(label))
+	assert.Equal(t, len(scale.RawText), len("desc\n2\n100.0 "+label+"\n2/1"))
+
+	doc, err := SCLDocumentFromString("desc\n2\n100.0 " + label + "\r\n2/1")
+	assert.NilError(t, err)
+	assert.Equal(t, doc.String(), "desc\n2\n100.0 "+label+"\r\n2/1")
+}
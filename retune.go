@@ -0,0 +1,364 @@
+package scala
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// RetuneOptions controls RetuneSMF
+type RetuneOptions struct {
+	// MPE gives the zone the notes are played on. Its ReleaseTail is in ticks.
+	MPE MPEOptions
+	// PassThrough has bit n set to keep the messages of MIDI channel n+1 unchanged, such as
+	// 1<<9 for General MIDI drums. These channels must be outside the zone.
+	PassThrough uint16
+}
+
+// RetuneWarningKind is the reason for a RetuneWarning
+type RetuneWarningKind int
+
+const (
+	// RetuneStolen when a note was cut short because more notes were sounding than
+	// there are member channels, or because the same note was played again
+	RetuneStolen RetuneWarningKind = iota
+	// RetuneUnmapped when a note was dropped because the tuning leaves it unmapped
+	RetuneUnmapped
+)
+
+var retuneWarningKindNames = []string{"stolen", "unmapped"}
+
+func (k RetuneWarningKind) String() string {
+	if k >= 0 && int(k) < len(retuneWarningKindNames) {
+		return retuneWarningKindNames[k]
+	}
+	return "RetuneWarningKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// A RetuneWarning reports a note that RetuneSMF could not play as written
+type RetuneWarning struct {
+	Kind    RetuneWarningKind
+	Track   int   // the track of the note on
+	Tick    int64 // the time of the note on
+	Channel int   // the channel of the note in the input, 0..15
+	Key     int   // the note in the input
+}
+
+// smfEventRef is an event of a track, for merging tracks in time
+type smfEventRef struct {
+	track int
+	event SMFEvent
+}
+
+// mergedEvents returns the events of all tracks in order of time, keeping the order of
+// events at the same time within each track, and putting earlier tracks first
+func mergedEvents(smf SMF) (events []smfEventRef) {
+	for i, track := range smf.Tracks {
+		for _, e := range track {
+			events = append(events, smfEventRef{i, e})
+		}
+	}
+	sort.SliceStable(events, func(a, b int) bool {
+		return events[a].event.Tick < events[b].event.Tick
+	})
+	return
+}
+
+// RetuneSMF returns smf played in t by pitch bend, with the same tracks, timing and
+// velocities. Each note is sent on a member channel of an MPE zone with its own pitch bend,
+// as by an MPEAllocator; since the time of every note is known in advance, the whole file
+// is allocated in order of time across all tracks. The channels of smf are parts sharing
+// the zone: the controllers, program changes, channel pressure and pitch bend of each are
+// sent to the member channels playing its notes, and to each member channel before it
+// starts one of its notes. Polyphonic aftertouch goes to the channel of its note. System
+// exclusive and meta events, and the messages of the channels of opts.PassThrough, are
+// unchanged. The MPE configuration messages are added at the start of the first track.
+//
+// The result is a format 1 SMF, except that the tracks of a format 2 SMF are independent
+// patterns, so each is retuned on its own, starting with the configuration messages, and
+// the result is format 2.
+//
+// Notes that the tuning leaves unmapped are dropped, and notes cut short because there
+// are too few member channels for the polyphony are still played; both are reported in
+// warnings.
+func RetuneSMF(smf SMF, t Tuning, opts RetuneOptions) (out SMF, warnings []RetuneWarning, err error) {
+	out.Format = 1
+	out.Division = smf.Division
+	out.Tracks = make([][]SMFEvent, len(smf.Tracks))
+	if len(out.Tracks) == 0 {
+		out.Tracks = make([][]SMFEvent, 1)
+	}
+	patterns := [][]smfEventRef{mergedEvents(smf)}
+	if smf.Format == 2 {
+		out.Format = 2
+		patterns = nil
+		for i, track := range smf.Tracks {
+			var events []smfEventRef
+			for _, e := range track {
+				events = append(events, smfEventRef{i, e})
+			}
+			patterns = append(patterns, events)
+		}
+	}
+	for i, events := range patterns {
+		var a *MPEAllocator
+		if a, err = MPEAllocatorFromTuning(t, opts.MPE); err != nil {
+			return
+		}
+		var r *bendRetuner
+		if r, err = newBendRetuner(a, opts.PassThrough); err != nil {
+			return
+		}
+		for _, msg := range a.ConfigurationMessages() {
+			out.Tracks[i] = append(out.Tracks[i], SMFEvent{Data: msg})
+		}
+		for _, ref := range events {
+			e := ref.event
+			warnings = append(warnings, r.message(e.Data, ref.track, e.Tick, func(data []byte) {
+				out.Tracks[ref.track] = append(out.Tracks[ref.track], SMFEvent{Tick: e.Tick, Data: data})
+			})...)
+		}
+	}
+	return
+}
+
+// voiceKey is the input channel and key of a note
+type voiceKey struct{ channel, key int }
+
+// voiceStart is the track and time of the note on of a voice
+type voiceStart struct {
+	track int
+	time  int64
+}
+
+// channelState is the state of the controllers of a MIDI channel that a note is played with
+type channelState struct {
+	controllers [120]byte
+	program     byte
+	pressure    byte
+	bend        int // the pitch bend of the channel's part, 0..16383
+}
+
+// defaultChannelState is the state of a channel after a reset, as General MIDI gives it
+func defaultChannelState() (cs channelState) {
+	cs.controllers[7] = 100  // volume
+	cs.controllers[8] = 64   // balance
+	cs.controllers[10] = 64  // pan
+	cs.controllers[11] = 127 // expression
+	cs.bend = 8192
+	return
+}
+
+// isStateController reports whether a controller is part of channelState. The controllers
+// of registered and non-registered parameters set values, such as the pitch bend range,
+// that are not kept, and channel mode messages are not controllers.
+func isStateController(cc int) bool {
+	switch cc {
+	case 6, 38, 96, 97, 98, 99, 100, 101:
+		return false
+	}
+	return cc < 120
+}
+
+// retunePart is a channel of the input of a bendRetuner
+type retunePart struct {
+	state     channelState
+	bendRange float64 // in semitones, as set by RPN 0; 2 until then
+	rpn       int     // the registered parameter selected, or -1
+}
+
+// bendRetuner plays the channel messages of its input on the zone of an MPEAllocator, with
+// each channel of the input a part of its own
+type bendRetuner struct {
+	a       *MPEAllocator
+	pass    uint16 // the channels passed through, as RetuneOptions.PassThrough
+	parts   [16]retunePart
+	members [16]channelState        // what each member channel was last sent
+	starts  map[voiceKey]voiceStart // the sounding notes of the input
+}
+
+func newBendRetuner(a *MPEAllocator, pass uint16) (r *bendRetuner, err error) {
+	for _, ch := range append(a.MemberChannels(), a.ManagerChannel()) {
+		if pass&(1<<uint(ch)) != 0 {
+			err = errors.Errorf("MIDI channel %d is passed through but is in the MPE zone", ch+1)
+			return
+		}
+	}
+	r = &bendRetuner{a: a, pass: pass, starts: map[voiceKey]voiceStart{}}
+	for i := range r.parts {
+		r.parts[i] = retunePart{state: defaultChannelState(), bendRange: 2, rpn: -1}
+	}
+	for i := range r.members {
+		r.members[i] = defaultChannelState()
+	}
+	return
+}
+
+// bendMessage returns the pitch bend of v, with the pitch bend of its part added
+func (r *bendRetuner) bendMessage(v MPEVoice) []byte {
+	p := r.parts[v.Part]
+	bend := v.Bend + int(math.Round(float64(p.state.bend-8192)*p.bendRange/float64(r.a.opts.BendRange)))
+	v.Bend = imin(imax(bend, 0), 16383)
+	return v.PitchBendMessage()
+}
+
+// sync sends member channel ch the messages that bring it to the state of part
+func (r *bendRetuner) sync(ch int, part int, emit func([]byte)) {
+	want, have := r.parts[part].state, &r.members[ch]
+	for cc, value := range want.controllers {
+		if value != have.controllers[cc] {
+			emit([]byte{0xB0 | byte(ch), byte(cc), value})
+		}
+	}
+	if want.program != have.program {
+		emit([]byte{0xC0 | byte(ch), want.program})
+	}
+	if want.pressure != have.pressure {
+		emit([]byte{0xD0 | byte(ch), want.pressure})
+	}
+	*have = want
+}
+
+// partVoices returns the sounding voices of part
+func (r *bendRetuner) partVoices(part int) (voices []MPEVoice) {
+	for _, v := range r.a.Voices() {
+		if v.Part == part {
+			voices = append(voices, v)
+		}
+	}
+	return
+}
+
+// message retunes one complete MIDI message of track at time, passing the messages that
+// play it to emit. Messages other than channel messages, and those of the channels passed
+// through, are passed on unchanged.
+func (r *bendRetuner) message(msg []byte, track int, time int64, emit func([]byte)) (warnings []RetuneWarning) {
+	status := msg[0]
+	if status >= 0xF0 {
+		emit(msg)
+		return
+	}
+	ch := int(status & 0x0F)
+	if r.pass&(1<<uint(ch)) != 0 {
+		emit(msg)
+		return
+	}
+	p := &r.parts[ch]
+	switch status & 0xF0 {
+	case 0x90, 0x80:
+		key, velocity := int(msg[1]), int(msg[2])
+		vk := voiceKey{ch, key}
+		if status&0xF0 == 0x90 && velocity > 0 {
+			if !r.a.Tuning().IsMidiNoteMapped(key) {
+				warnings = append(warnings, RetuneWarning{RetuneUnmapped, track, time, ch, key})
+				return
+			}
+			v, stolen, _ := r.a.NoteOnPart(ch, key, time)
+			for _, sv := range stolen {
+				emit(sv.NoteOffMessage(0))
+				svk := voiceKey{sv.Part, sv.Key}
+				st := r.starts[svk]
+				warnings = append(warnings, RetuneWarning{RetuneStolen, st.track, st.time, svk.channel, svk.key})
+				delete(r.starts, svk)
+			}
+			r.starts[vk] = voiceStart{track, time}
+			r.sync(v.Channel, ch, emit)
+			emit(r.bendMessage(v))
+			emit(v.NoteOnMessage(velocity))
+		} else {
+			if _, sounding := r.starts[vk]; !sounding {
+				return
+			}
+			if v, ok := r.a.NoteOffPart(ch, key, time); ok {
+				delete(r.starts, vk)
+				emit(v.NoteOffMessage(velocity))
+			}
+		}
+	case 0xA0:
+		for _, v := range r.partVoices(ch) {
+			if v.Key == int(msg[1]) {
+				emit([]byte{0xA0 | byte(v.Channel), byte(v.Note), msg[2]})
+			}
+		}
+	case 0xE0:
+		p.state.bend = int(msg[1]) | int(msg[2])<<7
+		for _, v := range r.partVoices(ch) {
+			emit(r.bendMessage(v))
+		}
+	case 0xB0:
+		r.controller(ch, int(msg[1]), msg[2], time, emit)
+	default:
+		// program change and channel pressure
+		if status&0xF0 == 0xC0 {
+			p.state.program = msg[1]
+		} else {
+			p.state.pressure = msg[1]
+		}
+		for _, v := range r.partVoices(ch) {
+			r.sync(v.Channel, ch, emit)
+		}
+	}
+	return
+}
+
+// controller plays a control change of part
+func (r *bendRetuner) controller(part int, cc int, value byte, time int64, emit func([]byte)) {
+	p := &r.parts[part]
+	switch {
+	case cc == 101:
+		p.rpn = int(value)<<7 | p.rpn&0x7F
+	case cc == 100:
+		p.rpn = p.rpn&^0x7F | int(value)
+	case cc == 98 || cc == 99:
+		// a non-registered parameter replaces the registered one
+		p.rpn = -1
+	case (cc == 6 || cc == 38) && p.rpn == 0:
+		// the pitch bend range of the part, which is kept here since the member channels
+		// have the range of the zone
+		semitones, cents := math.Trunc(p.bendRange), math.Round(100*(p.bendRange-math.Trunc(p.bendRange)))
+		if cc == 6 {
+			semitones = float64(value)
+		} else {
+			cents = float64(value)
+		}
+		p.bendRange = semitones + cents/100
+		return
+	case cc == 120 || cc == 123:
+		// all sound off and all notes off end the notes of the part only
+		for _, v := range r.partVoices(part) {
+			if _, ok := r.a.NoteOffPart(part, v.Key, time); ok {
+				delete(r.starts, voiceKey{part, v.Key})
+				emit(v.NoteOffMessage(0))
+			}
+		}
+		return
+	case cc == 121:
+		// reset all controllers, keeping those General MIDI says it leaves alone
+		reset := defaultChannelState()
+		for _, keep := range []int{0, 7, 8, 10, 32, 91, 93} {
+			reset.controllers[keep] = p.state.controllers[keep]
+		}
+		reset.program = p.state.program
+		p.state = reset
+		for _, v := range r.partVoices(part) {
+			r.sync(v.Channel, part, emit)
+			emit(r.bendMessage(v))
+		}
+		return
+	case cc > 121:
+		// channel mode messages would change how the member channels respond, not the notes
+		return
+	}
+	if isStateController(cc) {
+		p.state.controllers[cc] = value
+		for _, v := range r.partVoices(part) {
+			r.sync(v.Channel, part, emit)
+		}
+		return
+	}
+	// the data of other parameters is not kept, and goes only to the sounding notes
+	for _, v := range r.partVoices(part) {
+		emit([]byte{0xB0 | byte(v.Channel), byte(cc), value})
+	}
+}
@@ -0,0 +1,230 @@
+package scala
+
+import (
+	"bytes"
+	"gotest.tools/v3/assert"
+	"math"
+	"testing"
+)
+
+// Retune - notes are played on member channels with pitch bend, and other messages kept
+func TestRetuneSMF(t *testing.T) {
+	tun := mpeTestTuning(t)
+	smf := SMF{Format: 1, Division: 480, Tracks: [][]SMFEvent{
+		{SMFMetaEvent(0, SMFMetaTempo, []byte{0x07, 0xA1, 0x20})},
+		{
+			{0, []byte{0xC0, 0x05}},
+			{0, []byte{0x90, 60, 100}},
+			{10, []byte{0x90, 64, 90}},
+			{20, []byte{0xB0, 0x40, 0x7F}},
+			{30, []byte{0xA0, 64, 33}},
+			{40, []byte{0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7}},
+			{480, []byte{0x80, 60, 0}},
+			{490, []byte{0x90, 64, 0}},
+			SMFMetaEvent(500, SMFMetaEndOfTrack, nil),
+		},
+	}}
+	out, warnings, err := RetuneSMF(smf, tun, RetuneOptions{MPE: MPEOptions{MemberChannels: 4}})
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 0)
+	assert.Equal(t, out.Format, 1)
+	assert.Equal(t, out.Division, uint16(480))
+	assert.Equal(t, len(out.Tracks), 2)
+
+	config := len(mustMPEAllocator(t, tun, MPEOptions{MemberChannels: 4}).ConfigurationMessages())
+	assert.Equal(t, len(out.Tracks[0]), config+1)
+	assert.DeepEqual(t, out.Tracks[0][config], smf.Tracks[0][0])
+
+	v60 := MPEVoice{Key: 60, Channel: 1}
+	v60.Note, v60.Bend, _ = mustMPEAllocator(t, tun, MPEOptions{}).pitch(tun.FrequencyForMidiNote(60))
+	v64 := MPEVoice{Key: 64, Channel: 2}
+	v64.Note, v64.Bend, _ = mustMPEAllocator(t, tun, MPEOptions{}).pitch(tun.FrequencyForMidiNote(64))
+	assert.DeepEqual(t, out.Tracks[1], []SMFEvent{
+		{0, []byte{0xC1, 0x05}},
+		{0, v60.PitchBendMessage()},
+		{0, v60.NoteOnMessage(100)},
+		{10, []byte{0xC2, 0x05}},
+		{10, v64.PitchBendMessage()},
+		{10, v64.NoteOnMessage(90)},
+		{20, []byte{0xB1, 0x40, 0x7F}},
+		{20, []byte{0xB2, 0x40, 0x7F}},
+		{30, []byte{0xA2, byte(v64.Note), 33}},
+		{40, []byte{0xF0, 0x7E, 0x7F, 0x09, 0x01, 0xF7}},
+		{480, v60.NoteOffMessage(0)},
+		{490, v64.NoteOffMessage(0)},
+		SMFMetaEvent(500, SMFMetaEndOfTrack, nil),
+	})
+
+	var buf bytes.Buffer
+	assert.NilError(t, out.WriteSMF(&buf))
+	again, err := SMFFromStream(&buf)
+	assert.NilError(t, err)
+	assert.Equal(t, len(again.Tracks), 2)
+}
+
+func mustMPEAllocator(t *testing.T, tun Tuning, opts MPEOptions) *MPEAllocator {
+	t.Helper()
+	a, err := MPEAllocatorFromTuning(tun, opts)
+	assert.NilError(t, err)
+	return a
+}
+
+// Retune - the pitch of every note across tracks
+func TestRetuneSMFPitches(t *testing.T) {
+	tun := mpeTestTuning(t)
+	var tracks [][]SMFEvent
+	for tr := 0; tr < 3; tr++ {
+		var track []SMFEvent
+		for i := 0; i < 20; i++ {
+			key := 40 + 3*i + tr
+			track = append(track, SMFEvent{int64(100 * i), []byte{0x93, byte(key), 64}},
+				SMFEvent{int64(100*i + 90), []byte{0x83, byte(key), 64}})
+		}
+		tracks = append(tracks, track)
+	}
+	out, warnings, err := RetuneSMF(SMF{Format: 1, Division: 96, Tracks: tracks}, tun, RetuneOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 0)
+
+	var bends [16]int
+	notes := 0
+	for _, ref := range mergedEvents(out) {
+		d := ref.event.Data
+		switch d[0] & 0xF0 {
+		case 0xE0:
+			bends[d[0]&0x0F] = int(d[1]) | int(d[2])<<7
+		case 0x90:
+			notes++
+			ch := int(d[0] & 0x0F)
+			assert.Assert(t, ch != 0)
+			key := 40 + 3*int(ref.event.Tick/100) + ref.track
+			played := 440.0 * math.Pow(2.0, (float64(d[1])-69.0+float64(bends[ch]-8192)/8192.0*48.0)/12.0)
+			assert.Equal(t, "", approxEqual(0.3, 1200.0*math.Log2(played/tun.FrequencyForMidiNote(key)), 0), key)
+		}
+	}
+	assert.Equal(t, notes, 60)
+}
+
+// Retune - too much polyphony, repeated and unmapped notes
+func TestRetuneSMFWarnings(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("12-intune.scl"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingFromKBMFile(testFile("mapping-whitekeys-c261.kbm"))
+	assert.NilError(t, err)
+	whiteKeys, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+
+	smf := SMF{Format: 0, Division: 96, Tracks: [][]SMFEvent{{
+		{0, []byte{0x90, 60, 100}},
+		{0, []byte{0x90, 61, 100}},
+		{1, []byte{0x90, 62, 100}},
+		{2, []byte{0x90, 64, 100}},
+		{3, []byte{0x90, 64, 100}},
+		{10, []byte{0x80, 60, 0}},
+		{10, []byte{0x80, 61, 0}},
+		{10, []byte{0x80, 62, 0}},
+		{10, []byte{0x80, 64, 0}},
+		{10, []byte{0x80, 64, 0}},
+	}}}
+	out, warnings, err := RetuneSMF(smf, whiteKeys, RetuneOptions{MPE: MPEOptions{MemberChannels: 2}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, warnings, []RetuneWarning{
+		{RetuneUnmapped, 0, 0, 0, 61},
+		{RetuneStolen, 0, 0, 0, 60},
+		{RetuneStolen, 0, 2, 0, 64},
+	})
+	assert.Equal(t, RetuneUnmapped.String(), "unmapped")
+
+	var ons, offs int
+	for _, e := range out.Tracks[0] {
+		switch e.Data[0] & 0xF0 {
+		case 0x90:
+			ons++
+		case 0x80:
+			offs++
+		}
+	}
+	assert.Equal(t, ons, 4)
+	assert.Equal(t, offs, 4)
+
+	_, _, err = RetuneSMF(smf, whiteKeys, RetuneOptions{MPE: MPEOptions{BendRange: 100}})
+	assert.ErrorContains(t, err, "bend range")
+}
+
+// Retune - each channel is a part with its own controllers, and others may be passed through
+func TestRetuneSMFChannels(t *testing.T) {
+	tun := mpeTestTuning(t)
+	smf := SMF{Format: 0, Division: 96, Tracks: [][]SMFEvent{{
+		{0, []byte{0xC0, 0x05}},
+		{0, []byte{0xC9, 0x00}},
+		{0, []byte{0x90, 60, 100}},
+		{0, []byte{0x91, 60, 100}},
+		{0, []byte{0x99, 60, 100}},
+		{10, []byte{0xB9, 0x07, 0x40}},
+		{10, []byte{0xB1, 0x07, 0x50}},
+		{15, []byte{0xE1, 0x00, 0x60}},
+		{20, []byte{0x89, 60, 0}},
+		{20, []byte{0x80, 60, 0}},
+		{30, []byte{0x81, 60, 0}},
+	}}}
+	_, _, err := RetuneSMF(smf, tun, RetuneOptions{PassThrough: 1 << 9})
+	assert.ErrorContains(t, err, "MIDI channel 10 is passed through but is in the MPE zone")
+
+	out, warnings, err := RetuneSMF(smf, tun, RetuneOptions{MPE: MPEOptions{MemberChannels: 8}, PassThrough: 1 << 9})
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 0)
+	a := mustMPEAllocator(t, tun, MPEOptions{MemberChannels: 8})
+	v0, _, _ := a.NoteOnPart(0, 60, 0)
+	v1, _, _ := a.NoteOnPart(1, 60, 0)
+	assert.Equal(t, v0.Channel, 1)
+	assert.Equal(t, v1.Channel, 2)
+	// the pitch bend of the part is added to that of its note, over the bend range of each
+	bent := v1
+	bent.Bend += int(math.Round((0x3000 - 8192) * 2 / 48.0))
+	config := len(a.ConfigurationMessages())
+	assert.DeepEqual(t, out.Tracks[0][config:], []SMFEvent{
+		{0, []byte{0xC9, 0x00}},
+		{0, []byte{0xC1, 0x05}},
+		{0, v0.PitchBendMessage()},
+		{0, v0.NoteOnMessage(100)},
+		{0, v1.PitchBendMessage()},
+		{0, v1.NoteOnMessage(100)},
+		{0, []byte{0x99, 60, 100}},
+		{10, []byte{0xB9, 0x07, 0x40}},
+		{10, []byte{0xB2, 0x07, 0x50}},
+		{15, bent.PitchBendMessage()},
+		{20, []byte{0x89, 60, 0}},
+		{20, v0.NoteOffMessage(0)},
+		{30, v1.NoteOffMessage(0)},
+	})
+
+	// a later note of a part on a channel used by another takes on its controllers
+	r, err := newBendRetuner(mustMPEAllocator(t, tun, MPEOptions{MemberChannels: 1}), 0)
+	assert.NilError(t, err)
+	var played [][]byte
+	emit := func(data []byte) {
+		played = append(played, data)
+	}
+	r.message([]byte{0xB0, 0x07, 0x20}, 0, 0, emit)
+	r.message([]byte{0x90, 60, 100}, 0, 0, emit)
+	r.message([]byte{0x80, 60, 0}, 0, 1, emit)
+	r.message([]byte{0x91, 62, 100}, 0, 2, emit)
+	r.message([]byte{0xB1, 0x7B, 0x00}, 0, 3, emit)
+	assert.DeepEqual(t, played[0], []byte{0xB1, 0x07, 0x20})
+	assert.DeepEqual(t, played[4], []byte{0xB1, 0x07, 100})
+	assert.Equal(t, played[len(played)-1][0], byte(0x81))
+	assert.Equal(t, len(r.a.Voices()), 0)
+}
+
+// Retune - the tracks of a format 2 SMF are retuned on their own
+func TestRetuneSMFFormat2(t *testing.T) {
+	tun := mpeTestTuning(t)
+	pattern := []SMFEvent{{0, []byte{0x90, 60, 100}}, {10, []byte{0x80, 60, 0}}}
+	out, warnings, err := RetuneSMF(SMF{Format: 2, Division: 96, Tracks: [][]SMFEvent{pattern, pattern}}, tun,
+		RetuneOptions{MPE: MPEOptions{MemberChannels: 1}})
+	assert.NilError(t, err)
+	assert.Equal(t, len(warnings), 0)
+	assert.Equal(t, out.Format, 2)
+	assert.Equal(t, len(out.Tracks), 2)
+	assert.DeepEqual(t, out.Tracks[0], out.Tracks[1])
+}
@@ -6,7 +6,10 @@ import (
 	"github.com/pkg/errors"
 	"io"
 	"math"
+	"math/big"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -26,6 +29,10 @@ const (
 // A Tone is a single entry in an SCL file. It is expressed either in cents or in
 // a ratio, as described in the SCL documentation.
 //
+// Ratios may have terms of any size. RatioN and RatioD hold the terms when
+// they fit in an int and are both 0 otherwise; Rat always returns the exact value.
+// Setting RatioN and RatioD replaces terms that did not fit.
+//
 // In most normal use, you will not use this interface, and it will be internal to a Scale
 type Tone struct {
 	Type       ToneType
@@ -34,6 +41,11 @@ type Tone struct {
 	RatioN     int
 	StringRep  string
 	FloatValue float64 // cents / 1200 + 1.
+	Label      string  // any text following the pitch value on the line, e.g. "perfect fifth"
+
+	// the exact terms of a ratio that does not fit in RatioN and RatioD, as written
+	// (not reduced), in decimal so that Tones stay comparable
+	bigN, bigD string
 }
 
 // The Scale is the representation of the SCL file. It contains several key
@@ -44,62 +56,92 @@ type Tone struct {
 // or inspect this class yourself. Especially if you are displaying this
 // object to your end users, you may want to use the rawText or count methods.
 type Scale struct {
-	Name        string // The name in the SCL file. Informational only
-	Description string // The description in the SCL file. Informational only
-	RawText     string // The raw text of the SCL file used to create this Scale
-	Count       int    // The number of tones.
-	Tones       []Tone // The tones
+	Name        string   // The name in the SCL file. Informational only
+	Description string   // The description in the SCL file. Informational only
+	RawText     string   // The raw text of the SCL file used to create this Scale
+	Count       int      // The number of tones.
+	Tones       []Tone   // The tones
+	Encoding    Encoding // The character encoding of the SCL file. Description and RawText are converted to UTF-8
+}
+
+var ratioPitch = regexp.MustCompile(`^([0-9+-]+[ \t]*/[ \t]*[0-9+-]+)(?:[ \t]|$)`)
+
+// splitPitch separates the pitch value at the start of an SCL tone line from
+// the text that may follow it. The SCL format allows anything after the pitch
+// value, and many files use it to name the interval.
+func splitPitch(line string) (pitch string, label string) {
+	rest := strings.TrimLeft(line, " \t")
+	if m := ratioPitch.FindStringSubmatch(rest); m != nil {
+		// a ratio, possibly written with spaces around the '/'
+		pitch = m[1]
+	} else if end := strings.IndexAny(rest, " \t"); end >= 0 {
+		pitch = rest[:end]
+	} else {
+		pitch = rest
+	}
+	label = strings.TrimSpace(rest[len(pitch):])
+	return
 }
 
 func toneFromString(line string, lineno int) (tone Tone, err error) {
-	if strings.Contains(line, ".") {
+	pitch, label := splitPitch(line)
+	if strings.Contains(pitch, ".") {
 		tone.Type = ToneCents
-		if tone.Cents, err = strconv.ParseFloat(strings.TrimSpace(line), 64); err != nil {
-			err = errors.Wrapf(err, "Error parsing scale cent: \"%s\", line %d", line, lineno)
+		if tone.Cents, err = strconv.ParseFloat(pitch, 64); err != nil {
+			err = newParseError(KindBadTone, lineno, line, pitch, err, "Error parsing scale cent")
 			return
 		}
 	} else {
-		var v int64
 		tone.Type = ToneRatio
-		split := strings.Split(line, "/")
+		n, d := new(big.Int), big.NewInt(1)
+		split := strings.Split(pitch, "/")
 		if split != nil && len(split) == 1 {
-			if v, err = strconv.ParseInt(strings.TrimSpace(split[0]), 10, 32); err != nil {
-				err = errors.Errorf("Error parsing scale ratio numerator: \"%s\", line %d", split[0], lineno)
+			if _, ok := n.SetString(strings.TrimSpace(split[0]), 10); !ok {
+				err = newParseError(KindBadTone, lineno, line, strings.TrimSpace(split[0]), nil, "Error parsing scale ratio numerator")
 				return
 			}
-			tone.RatioN = int(v)
-			tone.RatioD = 1
 		} else if split == nil || len(split) != 2 {
-			err = errors.Errorf("Error parsing scale ratio: \"%s\", line %d", line, lineno)
+			err = newParseError(KindBadTone, lineno, line, pitch, nil, "Error parsing scale ratio")
 			return
 		} else {
-			if v, err = strconv.ParseInt(strings.TrimSpace(split[0]), 10, 32); err != nil {
-				err = errors.Errorf("Error parsing scale ratio numerator: \"%s\", line %d", split[0], lineno)
+			if _, ok := n.SetString(strings.TrimSpace(split[0]), 10); !ok {
+				err = newParseError(KindBadTone, lineno, line, strings.TrimSpace(split[0]), nil, "Error parsing scale ratio numerator")
 				return
 			}
-			tone.RatioN = int(v)
-			if v, err = strconv.ParseInt(strings.TrimSpace(split[1]), 10, 32); err != nil {
-				err = errors.Errorf("Error parsing scale ratio numerator: \"%s\", line %d", split[1], lineno)
+			if _, ok := d.SetString(strings.TrimSpace(split[1]), 10); !ok {
+				err = newParseError(KindBadTone, lineno, line, strings.TrimSpace(split[1]), nil, "Error parsing scale ratio denominator")
 				return
 			}
-			tone.RatioD = int(v)
 		}
-		if tone.RatioD == 0 || tone.RatioN == 0 {
-			err = errors.Errorf("Error parsing scale ratio - numerator or denominator is zero: \"%s\", line %d", line, lineno)
+		if n.Sign() == 0 || d.Sign() == 0 {
+			err = newParseError(KindBadTone, lineno, line, pitch, nil, "Error parsing scale ratio - numerator or denominator is zero")
 			return
 		}
-
-		// 2^(cents/1200) = n/d
-		// cents = 1200 * log(n/d) / log(2)
-		tone.Cents = 1200 * math.Log(float64(tone.RatioN)/float64(tone.RatioD)) / math.Log(2.0)
+		tone.setRatio(n, d)
 	}
 	tone.FloatValue = (tone.Cents / 1200.0) + 1.0
 	tone.StringRep = line
+	tone.Label = label
 	return
 }
 
 // ScaleFromSCLStream returns a Scale from the SCL input stream
 func ScaleFromSCLStream(rdr io.Reader) (scale Scale, err error) {
+	_, scale, _, err = parseSCL(rdr, ParseOptions{})
+	return
+}
+
+// ScaleFromSCLStreamWithOptions returns a Scale from the SCL input stream,
+// parsed according to opts. In ParseLenient mode, the problems that were
+// recovered from are returned as warnings.
+func ScaleFromSCLStreamWithOptions(rdr io.Reader, opts ParseOptions) (scale Scale, warnings []*ParseError, err error) {
+	_, scale, warnings, err = parseSCL(rdr, opts)
+	return
+}
+
+// parseSCL reads an SCL stream, returning both the line by line document
+// and the Scale it describes
+func parseSCL(rdr io.Reader, opts ParseOptions) (doc SCLDocument, scale Scale, warnings []*ParseError, err error) {
 	type stateType int
 	const (
 		readHeader stateType = iota
@@ -107,63 +149,148 @@ func ScaleFromSCLStream(rdr io.Reader) (scale Scale, err error) {
 		readNote
 		trailing
 	)
+	// problem reports a parse error. In lenient mode it is recorded as a
+	// warning and parsing continues; otherwise it ends the parse.
+	problem := func(pe *ParseError) bool {
+		if opts.Mode == ParseLenient {
+			warnings = append(warnings, pe)
+			return true
+		}
+		err = pe
+		return false
+	}
+	// in lenient mode, a bad count means reading tones until the end of the file
+	countKnown := true
+
 	state := readHeader
-	scanner := bufio.NewScanner(rdr)
+	// RawText is built up as the lines are read, and set however the parse ends
+	var rawText strings.Builder
+	lines := opts.newLineReader(rdr)
+	defer func() {
+		scale.RawText = rawText.String()
+		if lines.raw != nil {
+			scale.RawText = lines.raw.String()
+		}
+		scale.Encoding = lines.encoding
+		doc.Encoding = lines.encoding
+	}()
 	lineno := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-		if lineno == 0 {
+	for lines.Scan() {
+		line, eol := splitEOL(lines.Text())
+		if lineno > 0 {
 			// don't add a newline before the first character
-			scale.RawText = line
-		} else {
-			scale.RawText = scale.RawText + "\n" + line
+			rawText.WriteString("\n")
 		}
+		rawText.WriteString(line)
 		lineno++
+		if err = opts.checkLineLength(line, lineno); err != nil {
+			return
+		}
+		docLine := DocumentLine{Text: line, EOL: eol}
 		line = strings.TrimRight(line, "\t ")
 
 		//fmt.Printf("DEBUG: l:%d state:%d line:\"%s\":  %#v",lineno,state,line,scale)
 
-		if (state == readNote && len(line) == 0) || (len(line) > 0 && line[0] == '!') {
+		if len(line) > 0 && line[0] == '!' {
+			docLine.Role = LineComment
+			doc.Lines = append(doc.Lines, docLine)
+			continue
+		}
+		if state == readNote && len(line) == 0 {
+			if opts.Mode == ParseStrict {
+				err = &ParseError{Line: lineno, Kind: KindBadTone, Msg: "Blank line in the notes section"}
+				return
+			}
+			docLine.Role = LineBlank
+			doc.Lines = append(doc.Lines, docLine)
 			continue
 		}
 		var v int64
 		switch state {
 		case readHeader:
+			docLine.Role = LineDescription
 			scale.Description = line
 			state = readCount
 		case readCount:
+			docLine.Role = LineCount
+			state = readNote
 			if v, err = strconv.ParseInt(strings.TrimSpace(line), 10, 32); err != nil {
-				err = errors.Wrapf(err, "Error parsing Count: \"%s\", line %d", line, lineno)
-				return
+				if !problem(newParseError(KindBadCount, lineno, line, strings.TrimSpace(line), err, "Error parsing Count")) {
+					return
+				}
+				err = nil
+				countKnown = false
+				break
 			}
 			if v < 1 {
-				err = errors.Wrapf(err, "Error parsing Count: must be > 0: \"%s\", line %d", line, lineno)
+				if !problem(newParseError(KindBadCount, lineno, line, strings.TrimSpace(line), nil, "Error parsing Count: must be > 0")) {
+					return
+				}
+				countKnown = false
+				break
+			}
+			if err = opts.checkCount(int(v), lineno); err != nil {
 				return
 			}
 			scale.Count = int(v)
-			state = readNote
 		case readNote:
+			docLine.Role = LineTone
+			docLine.Index = len(scale.Tones)
 			var tone Tone
-			if tone, err = toneFromString(line, lineno); err != nil {
-				return
+			if tone, err = toneFromString(line, lineno); err == nil && opts.Mode == ParseStrict &&
+				tone.Type == ToneRatio && tone.Rat().Sign() <= 0 {
+				err = newParseError(KindBadTone, lineno, line, strings.TrimSpace(line), nil, "Scale ratio must be positive")
+			}
+			if err != nil {
+				var pe *ParseError
+				if !errors.As(err, &pe) || !problem(pe) {
+					return
+				}
+				err = nil
+				docLine.Role = LineInvalid
+				docLine.Index = 0
+				break
 			}
 			scale.Tones = append(scale.Tones, tone)
-			if len(scale.Tones) == scale.Count {
+			if !countKnown {
+				if err = opts.checkCount(len(scale.Tones), lineno); err != nil {
+					return
+				}
+			} else if len(scale.Tones) == scale.Count {
 				state = trailing
 				break
 			}
+		case trailing:
+			if len(line) == 0 {
+				docLine.Role = LineBlank
+				break
+			}
+			docLine.Role = LineTrailing
+			if opts.Mode != ParseDefault {
+				if !problem(newParseError(KindTrailing, lineno, line, line, nil, "Unexpected text after the last note")) {
+					return
+				}
+			}
 		}
+		doc.Lines = append(doc.Lines, docLine)
 	}
-	if err = scanner.Err(); err != nil {
+	if err = opts.scanError(lines.Err(), lineno); err != nil {
 		return
 	}
 	if !(state == readNote || state == trailing) {
-		err = errors.Errorf("Incomplete SCL file. Found no notes section in the file.")
+		err = &ParseError{Line: lineno, Kind: KindIncomplete, Msg: "Incomplete SCL file. Found no notes section in the file."}
 		return
 	}
 	if len(scale.Tones) != scale.Count {
-		err = errors.Errorf("Read fewer notes (%d) than count (%d)", len(scale.Tones), scale.Count)
-		return
+		if countKnown && !problem(&ParseError{Line: lineno, Kind: KindToneCount,
+			Msg: fmt.Sprintf("Read fewer notes (%d) than count (%d)", len(scale.Tones), scale.Count)}) {
+			return
+		}
+		if len(scale.Tones) == 0 {
+			err = &ParseError{Line: lineno, Kind: KindToneCount, Msg: "Found no notes in the file"}
+			return
+		}
+		scale.Count = len(scale.Tones)
 	}
 	return
 }
@@ -177,7 +304,7 @@ func ScaleFromSCLFile(fname string) (scale Scale, err error) {
 	}
 	defer file.Close()
 	if scale, err = ScaleFromSCLStream(file); err != nil {
-		err = errors.Wrapf(err, "Unable to parse file '%s'", fname)
+		err = errors.Wrapf(withFile(err, fname), "Unable to parse file '%s'", fname)
 		return
 	}
 	scale.Name = fname
@@ -194,6 +321,208 @@ func ScaleFromSCLString(sclContents string) (scale Scale, err error) {
 	return
 }
 
+// ToneFromCents returns a Tone expressed as a number of cents
+func ToneFromCents(cents float64) (tone Tone) {
+	tone.Type = ToneCents
+	tone.Cents = cents
+	tone.FloatValue = (tone.Cents / 1200.0) + 1.0
+	tone.StringRep = tone.sclString()
+	return
+}
+
+// ToneFromRatio returns a Tone expressed as the ratio n/d
+func ToneFromRatio(n int, d int) (tone Tone, err error) {
+	tone, err = ToneFromBigRatio(big.NewInt(int64(n)), big.NewInt(int64(d)))
+	return
+}
+
+// ToneFromBigRatio returns a Tone expressed as the ratio n/d, for terms of any size.
+// The terms are kept as given rather than reduced.
+func ToneFromBigRatio(n *big.Int, d *big.Int) (tone Tone, err error) {
+	if n.Sign() <= 0 || d.Sign() <= 0 {
+		err = errors.Errorf("Ratio numerator and denominator must be positive: %s/%s", n, d)
+		return
+	}
+	tone.Type = ToneRatio
+	tone.setRatio(n, d)
+	tone.FloatValue = (tone.Cents / 1200.0) + 1.0
+	tone.StringRep = tone.sclString()
+	return
+}
+
+// setRatio records the terms of a ratio tone and computes its cents
+func (tone *Tone) setRatio(n *big.Int, d *big.Int) {
+	tone.RatioN, tone.RatioD, tone.bigN, tone.bigD = 0, 0, "", ""
+	if n.IsInt64() && d.IsInt64() && int64(int(n.Int64())) == n.Int64() && int64(int(d.Int64())) == d.Int64() {
+		tone.RatioN = int(n.Int64())
+		tone.RatioD = int(d.Int64())
+	} else {
+		tone.bigN, tone.bigD = n.String(), d.String()
+	}
+	if n.IsInt64() && d.IsInt64() && abs64(n.Int64()) <= 1<<53 && abs64(d.Int64()) <= 1<<53 {
+		// both terms are exact as float64
+		// 2^(cents/1200) = n/d
+		// cents = 1200 * log(n/d) / log(2)
+		tone.Cents = 1200 * math.Log(float64(n.Int64())/float64(d.Int64())) / math.Log(2.0)
+	} else {
+		tone.Cents = 1200 * log2Ratio(n, d)
+	}
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// log2Ratio returns log base 2 of n/d for positive integers of any size. The
+// division is done at high precision so that ratios very close to a power of
+// two, such as those of high harmonic segments, keep their tiny distance from it.
+func log2Ratio(n *big.Int, d *big.Int) float64 {
+	if n.Sign() <= 0 || d.Sign() <= 0 {
+		return math.NaN()
+	}
+	prec := uint(n.BitLen() + d.BitLen() + 64)
+	q := new(big.Float).SetPrec(prec).Quo(new(big.Float).SetPrec(prec).SetInt(n), new(big.Float).SetPrec(prec).SetInt(d))
+	m := new(big.Float).SetPrec(prec)
+	exp := q.MantExp(m) // q = m * 2^exp with 0.5 <= m < 1
+	if m.Cmp(big.NewFloat(0.75)) < 0 {
+		// log2(q) = exp - 1 + log2(2m), with 2m-1 small when q is just above a power of two
+		r, _ := m.Mul(m, big.NewFloat(2)).Sub(m, big.NewFloat(1)).Float64()
+		return float64(exp-1) + math.Log1p(r)/math.Ln2
+	}
+	// log2(q) = exp + log2(m), with m-1 small when q is just below a power of two
+	r, _ := m.Sub(m, big.NewFloat(1)).Float64()
+	return float64(exp) + math.Log1p(r)/math.Ln2
+}
+
+// Rat returns the exact value of a ratio tone, reduced to lowest terms, or nil for a cents tone
+// or a ratio whose denominator is 0
+func (tone Tone) Rat() *big.Rat {
+	if tone.Type != ToneRatio {
+		return nil
+	}
+	n, d := tone.ratioTerms()
+	if d.Sign() == 0 {
+		return nil
+	}
+	return new(big.Rat).SetFrac(n, d)
+}
+
+// ratioTerms returns the terms of a ratio tone, as written. The terms that did not fit in
+// RatioN and RatioD are used only while both are still 0, so that tones edited by callers
+// are honored.
+func (tone Tone) ratioTerms() (n *big.Int, d *big.Int) {
+	if tone.RatioN == 0 && tone.RatioD == 0 && tone.bigN != "" && tone.bigD != "" {
+		n, _ = new(big.Int).SetString(tone.bigN, 10)
+		d, _ = new(big.Int).SetString(tone.bigD, 10)
+		return
+	}
+	return big.NewInt(int64(tone.RatioN)), big.NewInt(int64(tone.RatioD))
+}
+
+// sclString returns the text used for the pitch of the tone in an SCL file.  Ratios keep
+// their n/d form. Cents reuse the original text when it still represents the
+// tone's value, and otherwise use the shortest representation that reads back
+// as the same value. Cents always contain a '.' since that is how the SCL
+// format tells them apart from ratios.
+func (tone Tone) sclString() string {
+	if tone.Type == ToneRatio {
+		n, d := tone.ratioTerms()
+		return n.String() + "/" + d.String()
+	}
+	rep, _ := splitPitch(tone.StringRep)
+	if strings.Contains(rep, ".") {
+		if v, err := strconv.ParseFloat(rep, 64); err == nil && v == tone.Cents {
+			return rep
+		}
+	}
+	rep = strconv.FormatFloat(tone.Cents, 'f', -1, 64)
+	if !strings.Contains(rep, ".") {
+		rep += ".0"
+	}
+	return rep
+}
+
+// ScaleFromTones returns a Scale built from a description and a list of tones.
+// The RawText of the scale is generated from the tones.
+func ScaleFromTones(description string, tones []Tone) (scale Scale, err error) {
+	scale.Name = "Generated scale"
+	scale.Description = description
+	scale.Count = len(tones)
+	scale.Tones = append([]Tone(nil), tones...)
+	var text []byte
+	if text, err = scale.MarshalText(); err != nil {
+		return
+	}
+	scale.RawText = strings.TrimSuffix(string(text), "\n")
+	return
+}
+
+// WriteSCL writes the scale to w in SCL format. The output has a comment
+// line with the scale's name, the description, the count and one line per
+// tone, followed by its label if it has one. Ratio tones keep their n/d form
+// and cents tones keep their precision, so the output reads back through
+// ScaleFromSCLStream unchanged. Spaces and tabs at the end of the description
+// and labels are left out, as the reader ignores them.
+func (s Scale) WriteSCL(w io.Writer) (err error) {
+	if s.Count <= 0 {
+		err = errors.Errorf("Unable to write a scale with no notes. Your scale provided %v notes.", s.Count)
+		return
+	}
+	if s.Count != len(s.Tones) {
+		err = errors.Errorf("Scale count (%d) does not match the number of tones (%d)", s.Count, len(s.Tones))
+		return
+	}
+	if strings.ContainsAny(s.Description, "\r\n") {
+		err = errors.Errorf("Scale description must be a single line: \"%s\"", s.Description)
+		return
+	}
+	if strings.HasPrefix(s.Description, "!") {
+		err = errors.Errorf("Scale description must not start with '!': \"%s\"", s.Description)
+		return
+	}
+	bw := bufio.NewWriter(w)
+	if s.Name != "" {
+		fmt.Fprintf(bw, "! %s\n", filepath.Base(s.Name))
+	}
+	fmt.Fprintf(bw, "!\n%s\n %d\n!\n", strings.TrimRight(s.Description, "\t "), s.Count)
+	for _, tone := range s.Tones {
+		if strings.ContainsAny(tone.Label, "\r\n") {
+			err = errors.Errorf("Tone label must be a single line: \"%s\"", tone.Label)
+			return
+		}
+		if label := strings.TrimRight(tone.Label, "\t "); label != "" {
+			fmt.Fprintf(bw, " %s %s\n", tone.sclString(), label)
+		} else {
+			fmt.Fprintf(bw, " %s\n", tone.sclString())
+		}
+	}
+	err = bw.Flush()
+	return
+}
+
+// MarshalText returns the scale in SCL format (see WriteSCL)
+func (s Scale) MarshalText() (text []byte, err error) {
+	var buf strings.Builder
+	if err = s.WriteSCL(&buf); err != nil {
+		return
+	}
+	text = []byte(buf.String())
+	return
+}
+
+// UnmarshalText replaces the scale with one parsed from SCL file contents
+func (s *Scale) UnmarshalText(text []byte) (err error) {
+	var scale Scale
+	if scale, err = ScaleFromSCLString(string(text)); err != nil {
+		return
+	}
+	*s = scale
+	return
+}
+
 // ScaleEvenTemperment12NoteScale provides a utility scale which is
 // the "standard tuning" scale
 func ScaleEvenTemperment12NoteScale() (scale Scale, err error) {
@@ -2,6 +2,9 @@ package scala
 
 import (
 	"gotest.tools/v3/assert"
+	"math/big"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -20,3 +23,170 @@ func TestLoadStandardTuningNoDesc(t *testing.T) {
 	assert.Equal(t, scale.Count, 12)
 	// FIXME - write a lot more here obviously
 }
+
+// Writing SCL files - written scales read back unchanged
+func TestWriteSCLRoundTrip(t *testing.T) {
+	for _, fname := range testSCLs {
+		scale, err := ScaleFromSCLFile(testFile(fname))
+		assert.NilError(t, err)
+		text, err := scale.MarshalText()
+		assert.NilError(t, err, fname)
+
+		reread, err := ScaleFromSCLString(string(text))
+		assert.NilError(t, err, fname)
+		assert.Equal(t, reread.Description, scale.Description, fname)
+		assert.Equal(t, reread.Count, scale.Count, fname)
+		for i, tone := range scale.Tones {
+			assert.Equal(t, reread.Tones[i].Type, tone.Type, "%s: tone %d", fname, i)
+			assert.Equal(t, reread.Tones[i].Cents, tone.Cents, "%s: tone %d", fname, i)
+			assert.Equal(t, reread.Tones[i].RatioN, tone.RatioN, "%s: tone %d", fname, i)
+			assert.Equal(t, reread.Tones[i].RatioD, tone.RatioD, "%s: tone %d", fname, i)
+		}
+	}
+}
+
+// Writing SCL files - trailing spaces are left out of what is written
+func TestWriteSCLTrailingSpaces(t *testing.T) {
+	octave, err := ToneFromRatio(2, 1)
+	assert.NilError(t, err)
+	octave.Label = "octave \t"
+	scale := Scale{Description: "spaced out \t ", Count: 1, Tones: []Tone{octave}}
+	var buf strings.Builder
+	assert.NilError(t, scale.WriteSCL(&buf))
+	assert.Equal(t, buf.String(), "!\nspaced out\n 1\n!\n 2/1 octave\n")
+
+	reread, err := ScaleFromSCLString(buf.String())
+	assert.NilError(t, err)
+	assert.Equal(t, reread.Description, "spaced out")
+	assert.Equal(t, reread.Tones[0].Label, "octave")
+	var again strings.Builder
+	assert.NilError(t, reread.WriteSCL(&again))
+	assert.Assert(t, strings.HasSuffix(again.String(), buf.String()), again.String())
+}
+
+// Writing SCL files - generated tones keep their precision
+func TestScaleFromTones(t *testing.T) {
+	fifth, err := ToneFromRatio(3, 2)
+	assert.NilError(t, err)
+	octave, err := ToneFromRatio(4, 2)
+	assert.NilError(t, err)
+	third := ToneFromCents(386.3137138648348)
+	scale, err := ScaleFromTones("generated", []Tone{third, fifth, octave})
+	assert.NilError(t, err)
+	assert.Equal(t, scale.RawText, "! Generated scale\n!\ngenerated\n 3\n!\n 386.3137138648348\n 3/2\n 4/2")
+
+	reread, err := ScaleFromSCLString(scale.RawText)
+	assert.NilError(t, err)
+	assert.Equal(t, reread.Tones[0].Cents, third.Cents)
+	assert.Equal(t, reread.Tones[2].RatioN, 4)
+	assert.Equal(t, reread.Tones[2].RatioD, 2)
+
+	_, err = ScaleFromTones("two\nlines", []Tone{octave})
+	assert.ErrorContains(t, err, "single line")
+	_, err = ToneFromRatio(0, 2)
+	assert.ErrorContains(t, err, "must be positive")
+}
+
+// Labelled tones - labels are read, written and kept by documents
+func TestToneLabels(t *testing.T) {
+	scale, err := ScaleFromSCLString("! labels\nJust fifths\n 3\n!\n 9/8  major whole tone\n 701.955 fifth\n 2/1\n")
+	assert.NilError(t, err)
+	assert.Equal(t, scale.Tones[0].Label, "major whole tone")
+	assert.Equal(t, scale.Tones[1].Label, "fifth")
+	assert.Equal(t, scale.Tones[2].Label, "")
+
+	text, err := scale.MarshalText()
+	assert.NilError(t, err)
+	assert.Equal(t, string(text), "! Scale from patch\n!\nJust fifths\n 3\n!\n 9/8 major whole tone\n 701.955 fifth\n 2/1\n")
+
+	doc, err := SCLDocumentFromString("! labels\nJust fifths\n 3\n!\n 9/8  major whole tone\n 701.955 fifth\n 2/1\n")
+	assert.NilError(t, err)
+	fifth, err := ToneFromRatio(3, 2)
+	assert.NilError(t, err)
+	fifth.Label = "just fifth"
+	assert.NilError(t, doc.SetTone(1, fifth))
+	tone := scale.Tones[0]
+	tone.Label = "whole tone"
+	assert.NilError(t, doc.SetTone(0, tone))
+	octave := scale.Tones[2]
+	octave.Label = "octave"
+	assert.NilError(t, doc.SetTone(2, octave))
+	assert.Equal(t, doc.String(), "! labels\nJust fifths\n 3\n!\n 9/8  whole tone\n 3/2 just fifth\n 2/1 octave\n")
+}
+
+// Big ratios - terms beyond 64 bits are exact
+func TestBigRatioTones(t *testing.T) {
+	scale, err := ScaleFromSCLString(`! big
+High harmonics
+ 3
+!
+ 4294967297/4294967296
+ 36893488147419103233/36893488147419103232 one more than 2^65
+ 4/2
+`)
+	assert.NilError(t, err)
+	assert.Equal(t, scale.Tones[0].RatioN, 4294967297)
+	assert.Equal(t, scale.Tones[0].RatioD, 4294967296)
+	assert.Equal(t, scale.Tones[1].RatioN, 0)
+	assert.Equal(t, scale.Tones[1].Label, "one more than 2^65")
+	assert.Equal(t, scale.Tones[1].Rat().String(), "36893488147419103233/36893488147419103232")
+	assert.Assert(t, scale.Tones[1].Cents > 0 && scale.Tones[1].Cents < 1e-15, scale.Tones[1].Cents)
+	assert.Equal(t, scale.Tones[2].Rat().String(), "2/1")
+	assert.Assert(t, ToneFromCents(100.0).Rat() == nil)
+
+	text, err := scale.MarshalText()
+	assert.NilError(t, err)
+	reread, err := ScaleFromSCLString(string(text))
+	assert.NilError(t, err)
+	for i := range scale.Tones {
+		assert.Equal(t, reread.Tones[i].Rat().Cmp(scale.Tones[i].Rat()), 0)
+	}
+	assert.Check(t, strings.Contains(string(text), " 4/2\n"))
+
+	n, ok := new(big.Int).SetString("3000000000000000000000000000000", 10)
+	assert.Assert(t, ok)
+	d, ok := new(big.Int).SetString("1000000000000000000000000000000", 10)
+	assert.Assert(t, ok)
+	tone, err := ToneFromBigRatio(n, d)
+	assert.NilError(t, err)
+	three, err := ToneFromRatio(3, 1)
+	assert.NilError(t, err)
+	assert.Equal(t, "", approxEqual(1e-9, tone.Cents, three.Cents))
+	assert.Equal(t, tone.Rat().String(), "3/1")
+
+	// tones parsed separately are equal, and edits replace terms that did not fit
+	again, err := ScaleFromSCLString(string(text))
+	assert.NilError(t, err)
+	assert.Assert(t, again.Tones[1] == reread.Tones[1])
+	edited := scale.Tones[1]
+	edited.RatioN = 5
+	assert.Assert(t, edited.Rat() == nil)
+	edited.RatioD = 4
+	assert.Equal(t, edited.Rat().String(), "5/4")
+	assert.Assert(t, Tone{Type: ToneRatio}.Rat() == nil)
+}
+
+// largeSCL returns an SCL file with n tones, one per line
+func largeSCL(n int) string {
+	var buf strings.Builder
+	buf.WriteString("! large.scl\n!\nA large scale\n " + strconv.Itoa(n) + "\n!\n")
+	for i := 1; i <= n; i++ {
+		buf.WriteString(" " + strconv.FormatFloat(float64(i)*1200.0/float64(n), 'f', 5, 64) + "\n")
+	}
+	return buf.String()
+}
+
+func benchmarkScaleFromSCLStream(b *testing.B, n int) {
+	text := largeSCL(n)
+	b.SetBytes(int64(len(text)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ScaleFromSCLStream(strings.NewReader(text)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScaleFromSCLStream100(b *testing.B)   { benchmarkScaleFromSCLStream(b, 100) }
+func BenchmarkScaleFromSCLStream1000(b *testing.B)  { benchmarkScaleFromSCLStream(b, 1000) }
+func BenchmarkScaleFromSCLStream10000(b *testing.B) { benchmarkScaleFromSCLStream(b, 10000) }
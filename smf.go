@@ -0,0 +1,331 @@
+package scala
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SMF is a Standard MIDI File. Each track is a list of events in order of time.
+type SMF struct {
+	Format   int    // 0 for a single track, 1 for tracks played together, 2 for independent patterns
+	Division uint16 // ticks per quarter note, or SMPTE frames and ticks per frame if the top bit is set
+	Tracks   [][]SMFEvent
+}
+
+// An SMFEvent is an event of an SMF track at an absolute time in ticks. Data is the whole
+// event as a MIDI message, without running status:
+//
+//	channel messages: the status byte and data bytes
+//	system exclusive: F0 followed by the data of the event, usually ending with F7
+//	escapes:          F7 followed by the data of the event
+//	meta events:      FF, the type, and the data of the event, without its length
+type SMFEvent struct {
+	Tick int64
+	Data []byte
+}
+
+// Meta event types
+const (
+	SMFMetaTrackName  = 0x03
+	SMFMetaEndOfTrack = 0x2F
+	SMFMetaTempo      = 0x51
+)
+
+// IsMeta reports whether the event is a meta event
+func (e SMFEvent) IsMeta() bool {
+	return len(e.Data) >= 2 && e.Data[0] == 0xFF
+}
+
+// MetaType returns the type of a meta event
+func (e SMFEvent) MetaType() int {
+	return int(e.Data[1])
+}
+
+// IsSysEx reports whether the event is a system exclusive message
+func (e SMFEvent) IsSysEx() bool {
+	return len(e.Data) >= 1 && e.Data[0] == 0xF0
+}
+
+// SMFMetaEvent returns a meta event of type metaType
+func SMFMetaEvent(tick int64, metaType int, data []byte) SMFEvent {
+	return SMFEvent{Tick: tick, Data: append([]byte{0xFF, byte(metaType)}, data...)}
+}
+
+// channelMessageLength returns the number of data bytes of a channel message with status
+func channelMessageLength(status byte) int {
+	switch status & 0xF0 {
+	case 0xC0, 0xD0:
+		return 1
+	}
+	return 2
+}
+
+// smfReader reads the variable length quantities and bytes of a chunk
+type smfReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *smfReader) byte() (b byte, err error) {
+	if r.pos >= len(r.data) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b = r.data[r.pos]
+	r.pos++
+	return
+}
+
+func (r *smfReader) varLen() (v int64, err error) {
+	for i := 0; i < 4; i++ {
+		var b byte
+		if b, err = r.byte(); err != nil {
+			return
+		}
+		v = v<<7 | int64(b&0x7F)
+		if b&0x80 == 0 {
+			return
+		}
+	}
+	err = errors.New("Variable length quantity is longer than 4 bytes")
+	return
+}
+
+func (r *smfReader) bytes(n int64) (b []byte, err error) {
+	if n < 0 || int64(len(r.data)-r.pos) < n {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b = append([]byte(nil), r.data[r.pos:r.pos+int(n)]...)
+	r.pos += int(n)
+	return
+}
+
+// SMFFromStream reads a Standard MIDI File. Chunks other than the header and tracks are
+// skipped.
+func SMFFromStream(rdr io.Reader) (smf SMF, err error) {
+	var data []byte
+	if data, err = ioutil.ReadAll(rdr); err != nil {
+		return
+	}
+	if len(data) < 14 || string(data[:4]) != "MThd" {
+		err = errors.New("Not a Standard MIDI File: no MThd header")
+		return
+	}
+	headerLen := int(binary.BigEndian.Uint32(data[4:8]))
+	if headerLen < 6 || len(data) < 8+headerLen {
+		err = errors.Errorf("Invalid MThd header of %d bytes", headerLen)
+		return
+	}
+	smf.Format = int(binary.BigEndian.Uint16(data[8:10]))
+	numTracks := int(binary.BigEndian.Uint16(data[10:12]))
+	smf.Division = binary.BigEndian.Uint16(data[12:14])
+	if smf.Format > 2 {
+		err = errors.Errorf("Unknown SMF format %d", smf.Format)
+		return
+	}
+	pos := 8 + headerLen
+	for pos+8 <= len(data) {
+		id := string(data[pos : pos+4])
+		n := int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+		if n > len(data)-pos {
+			err = errors.Errorf("%s chunk of %d bytes is longer than the file", id, n)
+			return
+		}
+		if id == "MTrk" {
+			var track []SMFEvent
+			if track, err = readSMFTrack(data[pos : pos+n]); err != nil {
+				err = errors.Wrapf(err, "Invalid track %d", len(smf.Tracks))
+				return
+			}
+			smf.Tracks = append(smf.Tracks, track)
+		}
+		pos += n
+	}
+	if len(smf.Tracks) != numTracks {
+		err = errors.Errorf("SMF header gives %d tracks but the file has %d", numTracks, len(smf.Tracks))
+		return
+	}
+	return
+}
+
+// SMFFromFile reads the Standard MIDI File fname
+func SMFFromFile(fname string) (smf SMF, err error) {
+	var file *os.File
+	if file, err = os.Open(fname); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", fname)
+		return
+	}
+	defer file.Close()
+	if smf, err = SMFFromStream(file); err != nil {
+		err = errors.Wrapf(err, "Unable to parse file '%s'", fname)
+		return
+	}
+	return
+}
+
+// readSMFTrack reads the events of an MTrk chunk, up to its end of track event
+func readSMFTrack(data []byte) (track []SMFEvent, err error) {
+	r := &smfReader{data: data}
+	var tick int64
+	var running byte
+	for r.pos < len(r.data) {
+		var delta int64
+		if delta, err = r.varLen(); err != nil {
+			return
+		}
+		tick += delta
+		var status byte
+		if status, err = r.byte(); err != nil {
+			return
+		}
+		e := SMFEvent{Tick: tick}
+		switch {
+		case status == 0xFF:
+			var metaType byte
+			var n int64
+			if metaType, err = r.byte(); err != nil {
+				return
+			}
+			if n, err = r.varLen(); err != nil {
+				return
+			}
+			var body []byte
+			if body, err = r.bytes(n); err != nil {
+				return
+			}
+			e.Data = append([]byte{0xFF, metaType}, body...)
+			running = 0
+		case status == 0xF0 || status == 0xF7:
+			var n int64
+			if n, err = r.varLen(); err != nil {
+				return
+			}
+			var body []byte
+			if body, err = r.bytes(n); err != nil {
+				return
+			}
+			e.Data = append([]byte{status}, body...)
+			running = 0
+		case status&0x80 != 0 && status < 0xF0:
+			running = status
+			var body []byte
+			if body, err = r.bytes(int64(channelMessageLength(status))); err != nil {
+				return
+			}
+			e.Data = append([]byte{status}, body...)
+		case status&0x80 == 0 && running != 0:
+			var body []byte
+			if body, err = r.bytes(int64(channelMessageLength(running) - 1)); err != nil {
+				return
+			}
+			e.Data = append([]byte{running, status}, body...)
+		default:
+			err = errors.Errorf("Unexpected status byte %02X at tick %d", status, tick)
+			return
+		}
+		track = append(track, e)
+		if e.IsMeta() && e.MetaType() == SMFMetaEndOfTrack {
+			return
+		}
+	}
+	return
+}
+
+// maxVarLen is the largest variable length quantity, which takes 4 bytes
+const maxVarLen = 0x0FFFFFFF
+
+// writeVarLen writes v as a variable length quantity, which must be at most maxVarLen
+func writeVarLen(w *bytes.Buffer, v int64) {
+	var buf [4]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7F)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7F) | 0x80
+	}
+	w.Write(buf[i:])
+}
+
+// WriteSMF writes the file to w. Each track ends with an end of track event, which is added
+// at the time of the last event if the track does not have one.
+func (smf SMF) WriteSMF(w io.Writer) (err error) {
+	if smf.Format < 0 || smf.Format > 2 {
+		err = errors.Errorf("Unknown SMF format %d", smf.Format)
+		return
+	}
+	if smf.Format == 0 && len(smf.Tracks) != 1 {
+		err = errors.Errorf("A format 0 SMF must have 1 track, not %d", len(smf.Tracks))
+		return
+	}
+	bw := bufio.NewWriter(w)
+	header := []byte("MThd\x00\x00\x00\x06")
+	header = append(header, byte(smf.Format>>8), byte(smf.Format), byte(len(smf.Tracks)>>8), byte(len(smf.Tracks)),
+		byte(smf.Division>>8), byte(smf.Division))
+	bw.Write(header)
+	for i, track := range smf.Tracks {
+		var chunk bytes.Buffer
+		var tick int64
+		ended := false
+		for _, e := range track {
+			if ended {
+				err = errors.Errorf("Track %d has events after its end of track", i)
+				return
+			}
+			if e.Tick < tick {
+				err = errors.Errorf("Track %d goes back in time from tick %d to %d", i, tick, e.Tick)
+				return
+			}
+			if len(e.Data) == 0 {
+				err = errors.Errorf("Track %d has an empty event at tick %d", i, e.Tick)
+				return
+			}
+			if e.Tick-tick > maxVarLen {
+				err = errors.Errorf("Track %d has a gap of %d ticks before tick %d, more than an SMF can hold", i, e.Tick-tick, e.Tick)
+				return
+			}
+			if int64(len(e.Data)) > maxVarLen {
+				err = errors.Errorf("Track %d has an event of %d bytes at tick %d, more than an SMF can hold", i, len(e.Data), e.Tick)
+				return
+			}
+			writeVarLen(&chunk, e.Tick-tick)
+			tick = e.Tick
+			switch status := e.Data[0]; {
+			case status == 0xFF:
+				if len(e.Data) < 2 {
+					err = errors.Errorf("Track %d has a meta event with no type at tick %d", i, e.Tick)
+					return
+				}
+				chunk.Write(e.Data[:2])
+				writeVarLen(&chunk, int64(len(e.Data)-2))
+				chunk.Write(e.Data[2:])
+				ended = e.MetaType() == SMFMetaEndOfTrack
+			case status == 0xF0 || status == 0xF7:
+				chunk.WriteByte(status)
+				writeVarLen(&chunk, int64(len(e.Data)-1))
+				chunk.Write(e.Data[1:])
+			case status >= 0x80 && status < 0xF0 && len(e.Data) == 1+channelMessageLength(status):
+				chunk.Write(e.Data)
+			default:
+				err = errors.Errorf("Track %d has an invalid event % X at tick %d", i, e.Data, e.Tick)
+				return
+			}
+		}
+		if !ended {
+			chunk.Write([]byte{0x00, 0xFF, SMFMetaEndOfTrack, 0x00})
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(chunk.Len()))
+		bw.WriteString("MTrk")
+		bw.Write(length[:])
+		bw.Write(chunk.Bytes())
+	}
+	err = bw.Flush()
+	return
+}
@@ -0,0 +1,110 @@
+package scala
+
+import (
+	"bytes"
+	"gotest.tools/v3/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// SMF - reading running status, meta and system exclusive events
+func TestSMFRead(t *testing.T) {
+	data := []byte("MThd\x00\x00\x00\x06\x00\x00\x00\x01\x01\xE0" +
+		"MTrk\x00\x00\x00\x20" +
+		"\x00\xFF\x51\x03\x07\xA1\x20" + // tempo
+		"\x00\x90\x3C\x40" + // note on
+		"\x60\x3E\x40" + // running status
+		"\x81\x00\xF0\x03\x43\x10\xF7" + // system exclusive after 128 ticks
+		"\x00\xC0\x05" + // program change
+		"\x10\x80\x3C\x00" +
+		"\x00\xFF\x2F\x00")
+	smf, err := SMFFromStream(bytes.NewReader(data))
+	assert.NilError(t, err)
+	assert.Equal(t, smf.Format, 0)
+	assert.Equal(t, smf.Division, uint16(480))
+	assert.Equal(t, len(smf.Tracks), 1)
+	assert.DeepEqual(t, smf.Tracks[0], []SMFEvent{
+		{0, []byte{0xFF, 0x51, 0x07, 0xA1, 0x20}},
+		{0, []byte{0x90, 0x3C, 0x40}},
+		{96, []byte{0x90, 0x3E, 0x40}},
+		{224, []byte{0xF0, 0x43, 0x10, 0xF7}},
+		{224, []byte{0xC0, 0x05}},
+		{240, []byte{0x80, 0x3C, 0x00}},
+		{240, []byte{0xFF, 0x2F}},
+	})
+	assert.Assert(t, smf.Tracks[0][0].IsMeta())
+	assert.Equal(t, smf.Tracks[0][0].MetaType(), SMFMetaTempo)
+	assert.Assert(t, smf.Tracks[0][3].IsSysEx())
+
+	var buf bytes.Buffer
+	assert.NilError(t, smf.WriteSMF(&buf))
+	again, err := SMFFromStream(&buf)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, again, smf)
+}
+
+// SMF - writing adds the end of track, and files round trip
+func TestSMFWrite(t *testing.T) {
+	smf := SMF{Format: 1, Division: 96, Tracks: [][]SMFEvent{
+		{SMFMetaEvent(0, SMFMetaTrackName, []byte("Conductor")), SMFMetaEvent(0, SMFMetaTempo, []byte{0x07, 0xA1, 0x20})},
+		{{0, []byte{0x90, 60, 100}}, {20000, []byte{0x80, 60, 0}}, {20000, []byte{0xE0, 0x00, 0x40}}},
+	}}
+	var buf bytes.Buffer
+	assert.NilError(t, smf.WriteSMF(&buf))
+	assert.Assert(t, bytes.Contains(buf.Bytes(), []byte{0x81, 0x9C, 0x20, 0x80, 60, 0}))
+	again, err := SMFFromStream(bytes.NewReader(buf.Bytes()))
+	assert.NilError(t, err)
+	assert.Equal(t, len(again.Tracks), 2)
+	assert.Equal(t, len(again.Tracks[0]), 3)
+	assert.DeepEqual(t, again.Tracks[1][:3], smf.Tracks[1])
+	assert.DeepEqual(t, again.Tracks[1][3], SMFMetaEvent(20000, SMFMetaEndOfTrack, nil))
+
+	fname := filepath.Join(t.TempDir(), "test.mid")
+	assert.NilError(t, ioutil.WriteFile(fname, buf.Bytes(), 0644))
+	fromFile, err := SMFFromFile(fname)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, fromFile, again)
+	_, err = SMFFromFile(fname + ".missing")
+	assert.ErrorContains(t, err, "Unable to open file")
+}
+
+// SMF - errors
+func TestSMFErrors(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		msg  string
+	}{
+		{"RIFF", "no MThd"},
+		{"MThd\x00\x00\x00\x06\x00\x03\x00\x01\x00\x60", "Unknown SMF format"},
+		{"MThd\x00\x00\x00\x06\x00\x00\x00\x02\x00\x60MTrk\x00\x00\x00\x04\x00\xFF\x2F\x00", "gives 2 tracks"},
+		{"MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x60MTrk\x00\x00\x00\x09\x00\x90\x3C\x40\x00\xFF\x2F\x00", "longer than the file"},
+		{"MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x60MTrk\x00\x00\x00\x04\x00\x3C\x40\x00", "Unexpected status"},
+		{"MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x60MTrk\x00\x00\x00\x03\x00\x90\x3C", "EOF"},
+	} {
+		_, err := SMFFromStream(bytes.NewReader([]byte(c.data)))
+		assert.ErrorContains(t, err, c.msg)
+	}
+
+	for _, smf := range []SMF{
+		{Format: 3},
+		{Format: 0, Tracks: [][]SMFEvent{{}, {}}},
+		{Format: 1, Tracks: [][]SMFEvent{{{10, []byte{0x90, 60, 1}}, {5, []byte{0x80, 60, 0}}}}},
+		{Format: 1, Tracks: [][]SMFEvent{{{0, []byte{0x90, 60}}}}},
+		{Format: 1, Tracks: [][]SMFEvent{{SMFMetaEvent(0, SMFMetaEndOfTrack, nil), {0, []byte{0x90, 60, 1}}}}},
+	} {
+		assert.Assert(t, smf.WriteSMF(ioutil.Discard) != nil, smf)
+	}
+
+	// the longest gap between events is 4 bytes long
+	far := SMF{Format: 0, Division: 96, Tracks: [][]SMFEvent{{{1 << 36, []byte{0x90, 60, 1}}}}}
+	assert.ErrorContains(t, far.WriteSMF(ioutil.Discard), "more than an SMF can hold")
+	far.Tracks[0][0].Tick = 0x10000000
+	assert.ErrorContains(t, far.WriteSMF(ioutil.Discard), "more than an SMF can hold")
+	far.Tracks[0][0].Tick = 0x0FFFFFFF
+	var buf bytes.Buffer
+	assert.NilError(t, far.WriteSMF(&buf))
+	again, err := SMFFromStream(bytes.NewReader(buf.Bytes()))
+	assert.NilError(t, err)
+	assert.Equal(t, again.Tracks[0][0].Tick, int64(0x0FFFFFFF))
+}
@@ -0,0 +1,200 @@
+package scala
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// A TimedTuning is a tuning that takes effect at a time in ticks
+type TimedTuning struct {
+	Tick   int64
+	Tuning Tuning
+}
+
+// EmbedMTSOptions controls EmbedMTS
+type EmbedMTSOptions struct {
+	MTS MTSOptions
+	// SingleNote sends each tuning as real-time single note tuning changes of all 128 notes,
+	// which take effect on sounding notes, rather than as a bulk dump
+	SingleNote bool
+	Track      int // the track that holds the messages
+}
+
+// mtsMessages returns the messages that send t
+func mtsMessages(t Tuning, opts EmbedMTSOptions) (msgs [][]byte, err error) {
+	if !opts.SingleNote {
+		var msg []byte
+		if msg, _, err = MTSBulkDump(t, opts.MTS); err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+		return
+	}
+	// a message holds at most 127 notes
+	for lo := 0; lo < 128; lo += 64 {
+		notes := make([]int, 64)
+		for i := range notes {
+			notes[i] = lo + i
+		}
+		var msg []byte
+		if msg, _, err = MTSSingleNoteChange(t, notes, opts.MTS); err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// EmbedMTS returns smf with each of tunings sent as MTS system exclusive events at its tick,
+// so that the file carries its own tuning. The events go into opts.Track before any other
+// events at the same tick, so that notes starting then are played in the new tuning.
+func EmbedMTS(smf SMF, tunings []TimedTuning, opts EmbedMTSOptions) (out SMF, err error) {
+	if opts.Track < 0 || opts.Track >= len(smf.Tracks) {
+		err = errors.Errorf("SMF has no track %d", opts.Track)
+		return
+	}
+	var inserted []SMFEvent
+	for _, tt := range tunings {
+		if tt.Tick < 0 {
+			err = errors.Errorf("Tuning time must not be negative: %d", tt.Tick)
+			return
+		}
+		var msgs [][]byte
+		if msgs, err = mtsMessages(tt.Tuning, opts); err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			inserted = append(inserted, SMFEvent{Tick: tt.Tick, Data: msg})
+		}
+	}
+	sort.SliceStable(inserted, func(a, b int) bool {
+		return inserted[a].Tick < inserted[b].Tick
+	})
+
+	out = smf
+	out.Tracks = make([][]SMFEvent, len(smf.Tracks))
+	copy(out.Tracks, smf.Tracks)
+	track := smf.Tracks[opts.Track]
+	merged := make([]SMFEvent, 0, len(track)+len(inserted))
+	i := 0
+	for _, e := range track {
+		// the end of track must stay last, so it moves to the time of the last tuning
+		if e.IsMeta() && e.MetaType() == SMFMetaEndOfTrack {
+			merged = append(merged, inserted[i:]...)
+			i = len(inserted)
+			if n := len(merged); n > 0 && merged[n-1].Tick > e.Tick {
+				e.Tick = merged[n-1].Tick
+			}
+		}
+		for i < len(inserted) && inserted[i].Tick <= e.Tick {
+			merged = append(merged, inserted[i])
+			i++
+		}
+		merged = append(merged, e)
+	}
+	merged = append(merged, inserted[i:]...)
+	out.Tracks[opts.Track] = merged
+	return
+}
+
+// ScanSMFOptions controls ScanSMFTunings
+type ScanSMFOptions struct {
+	// BestFit adds the scale and mapping of MTSDecoder.ScaleAndMapping to each state
+	BestFit bool
+}
+
+// An SMFTuningState is the tuning of an SMF after one of its MTS messages
+type SMFTuningState struct {
+	Track       int    // the track of the message
+	Tick        int64  // the time of the message
+	Message     []byte // the whole SysEx message, from F0 to F7
+	Frequencies [128]float64
+	Tuning      Tuning // the tuning of exactly the frequencies, as TuningFromFrequencies
+	// Scale and KeyboardMapping are the best fit, with BestFit: the shortest scale that
+	// repeats to within the resolution of MTS
+	Scale           Scale
+	KeyboardMapping KeyboardMapping
+	// Err is why a malformed message could not be applied, in which case the tuning is
+	// the one before it
+	Err error
+}
+
+// ScanSMFTunings returns the tuning of smf after each of its MTS messages, in order of time
+// across all its tracks. The tuning starts as standard 12-EDO tuning and each message
+// changes it as MTSDecoder.Apply does. System exclusive messages split across several
+// events are joined; other system exclusive messages are skipped. A malformed MTS message
+// does not stop the scan, but is reported in the Err of its state.
+//
+// The tracks of a format 2 file are independent patterns, so each is scanned on its own,
+// starting from standard tuning, and the timeline holds the states of each track in turn.
+func ScanSMFTunings(smf SMF, opts ScanSMFOptions) (timeline []SMFTuningState, err error) {
+	if smf.Format != 2 {
+		timeline, err = scanTunings(mergedEvents(smf), opts)
+		return
+	}
+	for i, track := range smf.Tracks {
+		var events []smfEventRef
+		for _, e := range track {
+			events = append(events, smfEventRef{i, e})
+		}
+		var states []SMFTuningState
+		if states, err = scanTunings(events, opts); err != nil {
+			return
+		}
+		timeline = append(timeline, states...)
+	}
+	return
+}
+
+// scanTunings returns the tuning after each MTS message of events, which are in order of time
+func scanTunings(events []smfEventRef, opts ScanSMFOptions) (timeline []SMFTuningState, err error) {
+	var d MTSDecoder
+	pending := map[int]*SMFTuningState{} // SysEx messages continued in later events, by track
+	for _, ref := range events {
+		e := ref.event
+		var st *SMFTuningState
+		switch {
+		case e.IsSysEx():
+			st = &SMFTuningState{Track: ref.track, Tick: e.Tick, Message: append([]byte(nil), e.Data...)}
+		case len(e.Data) > 0 && e.Data[0] == 0xF7 && pending[ref.track] != nil:
+			st = pending[ref.track]
+			st.Message = append(st.Message, e.Data[1:]...)
+		default:
+			continue
+		}
+		if st.Message[len(st.Message)-1] != 0xF7 {
+			pending[ref.track] = st
+			continue
+		}
+		delete(pending, ref.track)
+		before := d
+		if err = d.Apply(st.Message); err == ErrNotMTS {
+			err = nil
+			continue
+		}
+		if err == nil {
+			err = fillTuningState(&d, st, opts)
+		}
+		if err != nil {
+			st.Err = errors.Wrapf(err, "Track %d at tick %d", st.Track, st.Tick)
+			d = before
+			if err = fillTuningState(&d, st, opts); err != nil {
+				return
+			}
+		}
+		timeline = append(timeline, *st)
+	}
+	return
+}
+
+// fillTuningState sets the tuning of st to that of d
+func fillTuningState(d *MTSDecoder, st *SMFTuningState, opts ScanSMFOptions) (err error) {
+	st.Frequencies = d.Frequencies()
+	if st.Tuning, err = TuningFromFrequencies(st.Frequencies); err != nil {
+		return
+	}
+	if opts.BestFit {
+		st.Scale, st.KeyboardMapping, err = d.ScaleAndMapping()
+	}
+	return
+}
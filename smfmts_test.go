@@ -0,0 +1,205 @@
+package scala
+
+import (
+	"bytes"
+	"gotest.tools/v3/assert"
+	"math"
+	"testing"
+)
+
+func embedTestSMF() SMF {
+	return SMF{Format: 1, Division: 480, Tracks: [][]SMFEvent{
+		{SMFMetaEvent(0, SMFMetaTempo, []byte{0x07, 0xA1, 0x20}), SMFMetaEvent(960, SMFMetaEndOfTrack, nil)},
+		{
+			{0, []byte{0x90, 60, 100}},
+			{960, []byte{0x80, 60, 0}},
+			{960, []byte{0x90, 62, 100}},
+			{1920, []byte{0x80, 62, 0}},
+			SMFMetaEvent(1920, SMFMetaEndOfTrack, nil),
+		},
+	}}
+}
+
+// SMF MTS - bulk dumps at the start and later
+func TestEmbedMTSBulkDump(t *testing.T) {
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	tun := mpeTestTuning(t)
+	smf := embedTestSMF()
+	out, err := EmbedMTS(smf, []TimedTuning{{960, tun}, {0, std}}, EmbedMTSOptions{Track: 1, MTS: MTSOptions{Program: 3}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, out.Tracks[0], smf.Tracks[0])
+	track := out.Tracks[1]
+	assert.Equal(t, len(track), len(smf.Tracks[1])+2)
+
+	assert.Assert(t, track[0].IsSysEx())
+	assert.Equal(t, track[0].Tick, int64(0))
+	assert.DeepEqual(t, track[1], smf.Tracks[1][0])
+	assert.Assert(t, track[2].IsSysEx())
+	assert.Equal(t, track[2].Tick, int64(960))
+	assert.DeepEqual(t, track[3], smf.Tracks[1][1])
+
+	want, _, err := MTSBulkDump(tun, MTSOptions{Program: 3})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, track[2].Data, want)
+
+	// the file round trips with its system exclusive framing, and decodes to the tuning
+	var buf bytes.Buffer
+	assert.NilError(t, out.WriteSMF(&buf))
+	again, err := SMFFromStream(&buf)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, again.Tracks[1][2].Data, want)
+	var d MTSDecoder
+	assert.NilError(t, d.Apply(again.Tracks[1][2].Data))
+	freqs := d.Frequencies()
+	for n := 0; n < 128; n++ {
+		assert.Equal(t, "", approxEqual(freqs[n]*0.001, freqs[n], tun.FrequencyForMidiNote(n)), n)
+	}
+}
+
+// SMF MTS - single note changes, and tunings after the end of the track
+func TestEmbedMTSSingleNote(t *testing.T) {
+	tun := mpeTestTuning(t)
+	smf := embedTestSMF()
+	out, err := EmbedMTS(smf, []TimedTuning{{500, tun}, {3000, tun}}, EmbedMTSOptions{SingleNote: true})
+	assert.NilError(t, err)
+	track := out.Tracks[0]
+	assert.Equal(t, len(track), 2+4)
+	for _, i := range []int{1, 2} {
+		assert.Equal(t, track[i].Tick, int64(500))
+		assert.DeepEqual(t, track[i].Data[:5], []byte{0xF0, 0x7F, 0x00, 0x08, 0x02})
+		assert.Equal(t, int(track[i].Data[6]), 64)
+	}
+	assert.Equal(t, int(track[1].Data[7]), 0)
+	assert.Equal(t, int(track[2].Data[7]), 64)
+	assert.Equal(t, track[4].Tick, int64(3000))
+	assert.DeepEqual(t, track[5], SMFMetaEvent(3000, SMFMetaEndOfTrack, nil))
+
+	var d MTSDecoder
+	assert.NilError(t, d.Apply(track[1].Data))
+	assert.NilError(t, d.Apply(track[2].Data))
+	freqs := d.Frequencies()
+	assert.Equal(t, "", approxEqual(0.01, freqs[70], tun.FrequencyForMidiNote(70)))
+
+	var buf bytes.Buffer
+	assert.NilError(t, out.WriteSMF(&buf))
+}
+
+// SMF MTS - errors
+func TestEmbedMTSErrors(t *testing.T) {
+	tun := mpeTestTuning(t)
+	smf := embedTestSMF()
+	_, err := EmbedMTS(smf, []TimedTuning{{0, tun}}, EmbedMTSOptions{Track: 2})
+	assert.ErrorContains(t, err, "no track 2")
+	_, err = EmbedMTS(smf, []TimedTuning{{-1, tun}}, EmbedMTSOptions{})
+	assert.ErrorContains(t, err, "negative")
+	_, err = EmbedMTS(smf, []TimedTuning{{0, tun}}, EmbedMTSOptions{MTS: MTSOptions{Program: 128}})
+	assert.ErrorContains(t, err, "0..127")
+}
+
+// SMF MTS - scanning the tunings of a file
+func TestScanSMFTunings(t *testing.T) {
+	tun := mpeTestTuning(t)
+	k, err := KeyboardMappingTuneA69To(442)
+	assert.NilError(t, err)
+	a442, err := TuningFromKBM(k)
+	assert.NilError(t, err)
+	smf, err := EmbedMTS(embedTestSMF(), []TimedTuning{{0, a442}}, EmbedMTSOptions{Track: 0})
+	assert.NilError(t, err)
+	smf, err = EmbedMTS(smf, []TimedTuning{{960, tun}}, EmbedMTSOptions{Track: 1, SingleNote: true})
+	assert.NilError(t, err)
+	smf.Tracks[0] = append([]SMFEvent{{0, []byte{0xF0, 0x43, 0x10, 0x01, 0xF7}}}, smf.Tracks[0]...)
+
+	timeline, err := ScanSMFTunings(smf, ScanSMFOptions{BestFit: true})
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 3)
+	assert.Equal(t, timeline[0].Track, 0)
+	assert.Equal(t, timeline[0].Tick, int64(0))
+	assert.Equal(t, timeline[0].Message[4], byte(0x01))
+	assert.Equal(t, timeline[1].Track, 1)
+	assert.Equal(t, timeline[1].Tick, int64(960))
+	assert.Equal(t, timeline[2].Tick, int64(960))
+
+	for n := 0; n < 128; n++ {
+		f := a442.FrequencyForMidiNote(n)
+		assert.Equal(t, "", approxEqual(f*1e-5, timeline[0].Tuning.FrequencyForMidiNote(n), f), n)
+		assert.Equal(t, "", approxEqual(f*1e-9, timeline[0].Tuning.FrequencyForMidiNote(n), timeline[0].Frequencies[n]), n)
+		// the first message of single note changes retunes the lower notes only
+		if n < 64 {
+			f = tun.FrequencyForMidiNote(n)
+		}
+		assert.Equal(t, "", approxEqual(f*1e-5, timeline[1].Frequencies[n], f), n)
+		f = tun.FrequencyForMidiNote(n)
+		assert.Equal(t, "", approxEqual(f*1e-5, timeline[2].Tuning.FrequencyForMidiNote(n), f), n)
+	}
+	assert.Equal(t, timeline[0].Scale.Count, 12)
+	assert.Equal(t, "", approxEqual(0.01, timeline[0].KeyboardMapping.TuningFrequency, a442.FrequencyForMidiNote(timeline[0].KeyboardMapping.TuningConstantNote)))
+	assert.Equal(t, timeline[2].Scale.Count, 31)
+
+	timeline, err = ScanSMFTunings(smf, ScanSMFOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, timeline[2].Scale.Count, 0)
+}
+
+// SMF MTS - messages split across events, and errors
+func TestScanSMFTuningsSplit(t *testing.T) {
+	tun := mpeTestTuning(t)
+	dump, _, err := MTSBulkDump(tun, MTSOptions{})
+	assert.NilError(t, err)
+	smf := SMF{Format: 1, Division: 96, Tracks: [][]SMFEvent{
+		{{0, dump[:100]}, {0, []byte{0x90, 60, 1}}, {5, append([]byte{0xF7}, dump[100:200]...)}},
+		{{3, []byte{0xF7, 0x01}}},
+		{{10, append([]byte{0xF7}, dump[200:]...)}},
+		{{20, append([]byte{0xF7}, dump[200:]...)}},
+	}}
+	timeline, err := ScanSMFTunings(smf, ScanSMFOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 0)
+
+	smf.Tracks[0] = append(smf.Tracks[0], SMFEvent{10, append([]byte{0xF7}, dump[200:]...)})
+	timeline, err = ScanSMFTunings(smf, ScanSMFOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 1)
+	assert.Equal(t, timeline[0].Tick, int64(0))
+	assert.DeepEqual(t, timeline[0].Message, dump)
+
+	// a malformed message leaves the tuning as it was, and the scan goes on
+	bad := append([]byte(nil), dump...)
+	bad[len(bad)-2] ^= 0x01
+	timeline, err = ScanSMFTunings(SMF{Format: 1, Tracks: [][]SMFEvent{{{9, dump}}, {{7, bad}}}}, ScanSMFOptions{BestFit: true})
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 2)
+	assert.ErrorContains(t, timeline[0].Err, "Track 1 at tick 7")
+	assert.ErrorContains(t, timeline[0].Err, "checksum")
+	assert.Equal(t, "", approxEqual(1e-9, timeline[0].Frequencies[69], 440.0))
+	assert.Equal(t, timeline[0].Scale.Count, 12)
+	assert.NilError(t, timeline[1].Err)
+	assert.Equal(t, timeline[1].Scale.Count, 31)
+}
+
+// SMF MTS - the tracks of a format 2 file are scanned on their own
+func TestScanSMFTuningsFormat2(t *testing.T) {
+	tun := mpeTestTuning(t)
+	dump, _, err := MTSBulkDump(tun, MTSOptions{})
+	assert.NilError(t, err)
+	change, _, err := MTSSingleNoteChange(tun, []int{62}, MTSOptions{})
+	assert.NilError(t, err)
+	smf := SMF{Format: 2, Division: 96, Tracks: [][]SMFEvent{
+		{{100, dump}},
+		{{0, change}},
+	}}
+	timeline, err := ScanSMFTunings(smf, ScanSMFOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(timeline), 2)
+	assert.Equal(t, timeline[0].Track, 0)
+	assert.Equal(t, timeline[1].Track, 1)
+	// the second pattern starts from standard tuning, not from the first
+	assert.Equal(t, "", approxEqual(1e-9, timeline[1].Frequencies[64], midi0Freq*math.Pow(2.0, 64.0/12.0)))
+	assert.Equal(t, "", approxEqual(1e-3, timeline[1].Frequencies[62], tun.FrequencyForMidiNote(62)))
+
+	smf.Format = 1
+	timeline, err = ScanSMFTunings(smf, ScanSMFOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, timeline[0].Track, 1)
+	assert.Equal(t, "", approxEqual(1e-3, timeline[1].Frequencies[64], tun.FrequencyForMidiNote(64)))
+}
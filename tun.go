@@ -0,0 +1,496 @@
+package scala
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// AnaMark TUN files give the frequency of each of the 128 MIDI notes. A version 1
+// file has a [Tuning] section of whole cents above a base frequency of 8.1758 Hz
+// (MIDI note 0 in standard tuning) and may have an [Exact Tuning] section with
+// fractional cents and its own BaseFreq. When [Exact Tuning] is present [Tuning]
+// is ignored. Notes that neither section lists keep their standard tuning.
+//
+// A version 2 file wraps each of its tunings in [Scale Begin] and [Scale End],
+// so one file can hold several, and may add a [Functional Tuning] section which
+// takes precedence over the others. Each of its entries defines a note relative
+// to another:
+//
+//	note 61="#>-1 % 100 ~127"
+//
+// "#=r" names note r as the reference and "#>d" the note d away from this one.
+// "% v" gives the note v cents above its reference; when the reference is the
+// note itself v is instead its frequency in Hz. "~n" applies the same entry to
+// each of the following notes up to note n, except those with entries of their
+// own. Notes without an entry keep their [Exact Tuning] or [Tuning] value.
+//
+// Other sections, such as [Info] (apart from its Name), [Mapping] and
+// [Assignment], are ignored.
+
+// tunBaseFreq is the default BaseFreq, that of MIDI note 0 in standard tuning
+const tunBaseFreq = 8.1757989156437073336
+
+// tunRule is an entry of a [Functional Tuning] section
+type tunRule struct {
+	relative bool // ref is relative to the note
+	ref      int
+	value    float64
+	lineno   int
+	line     string
+}
+
+// tunBlock is one tuning of a TUN file as it is read
+type tunBlock struct {
+	name     string
+	baseFreq float64
+	cents    map[int]float64 // [Tuning] notes
+	exact    map[int]float64 // [Exact Tuning] notes
+	hasExact bool
+	rules    map[int]tunRule // [Functional Tuning] notes
+	repeats  []tunRepeat
+}
+
+// tunRepeat is the "~" part of a [Functional Tuning] entry
+type tunRepeat struct {
+	from, to int
+	rule     tunRule
+}
+
+func newTUNBlock() *tunBlock {
+	return &tunBlock{baseFreq: tunBaseFreq,
+		cents: make(map[int]float64), exact: make(map[int]float64), rules: make(map[int]tunRule)}
+}
+
+// TuningsFromTUNStream returns the tunings of an AnaMark TUN file, in the order they
+// appear. Each Tuning's Scale has the tuning's [Info] Name as its Description.
+func TuningsFromTUNStream(rdr io.Reader) (tunings []Tuning, err error) {
+	tunings, err = parseTUN(rdr, "Tuning from TUN")
+	return
+}
+
+// TuningsFromTUNFile returns the tunings of the TUN file fname
+func TuningsFromTUNFile(fname string) (tunings []Tuning, err error) {
+	var file *os.File
+	if file, err = os.Open(fname); err != nil {
+		err = errors.Wrapf(err, "Unable to open file '%s'", fname)
+		return
+	}
+	defer file.Close()
+	if tunings, err = parseTUN(file, fname); err != nil {
+		err = errors.Wrapf(withFile(err, fname), "Unable to parse file '%s'", fname)
+		return
+	}
+	return
+}
+
+// TuningFromTUNStream returns the first tuning of an AnaMark TUN file
+func TuningFromTUNStream(rdr io.Reader) (tuning Tuning, err error) {
+	var tunings []Tuning
+	if tunings, err = TuningsFromTUNStream(rdr); err != nil {
+		return
+	}
+	tuning = tunings[0]
+	return
+}
+
+// TuningFromTUNFile returns the first tuning of the TUN file fname
+func TuningFromTUNFile(fname string) (tuning Tuning, err error) {
+	var tunings []Tuning
+	if tunings, err = TuningsFromTUNFile(fname); err != nil {
+		return
+	}
+	tuning = tunings[0]
+	return
+}
+
+// TuningFromTUNString returns the first tuning of the TUN file contents in memory
+func TuningFromTUNString(tunContents string) (tuning Tuning, err error) {
+	tuning, err = TuningFromTUNStream(strings.NewReader(tunContents))
+	return
+}
+
+// stripTUNComment removes a ';' comment that is not within quotes
+func stripTUNComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// tunNote returns the note number of a "note n" key
+func tunNote(key string) (note int, ok bool) {
+	fields := strings.Fields(key)
+	if len(fields) != 2 || fields[0] != "note" {
+		return
+	}
+	var err error
+	if note, err = strconv.Atoi(fields[1]); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+func parseTUN(rdr io.Reader, name string) (tunings []Tuning, err error) {
+	lines := ParseOptions{}.newLineReader(rdr)
+	var blocks []*tunBlock
+	var cur *tunBlock
+	v2 := false
+	inBlock := false
+	section := ""
+	lineno := 0
+
+	for lines.Scan() {
+		lineno++
+		raw := strings.TrimRight(lines.Text(), "\r\n")
+		line := strings.TrimSpace(stripTUNComment(raw))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				err = newParseError(KindBadHeader, lineno, raw, line, nil, "Invalid section header")
+				return
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "scale begin":
+				if inBlock {
+					err = newParseError(KindBadHeader, lineno, raw, line, nil, "[Scale Begin] before [Scale End]")
+					return
+				}
+				// anything outside the blocks of a version 2 file is ignored
+				v2 = true
+				inBlock = true
+				cur = newTUNBlock()
+			case "scale end":
+				if !inBlock {
+					err = newParseError(KindBadHeader, lineno, raw, line, nil, "[Scale End] without [Scale Begin]")
+					return
+				}
+				blocks = append(blocks, cur)
+				inBlock = false
+				cur = nil
+			}
+			continue
+		}
+		if v2 && !inBlock {
+			continue
+		}
+		if cur == nil {
+			cur = newTUNBlock()
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			err = newParseError(KindBadCharacter, lineno, raw, line, nil, "Expected a key=value line")
+			return
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:eq]))
+		value := strings.Trim(strings.TrimSpace(line[eq+1:]), "\"")
+
+		switch section {
+		case "info":
+			if key == "name" {
+				cur.name = value
+			}
+		case "tuning", "exact tuning":
+			if section == "exact tuning" {
+				cur.hasExact = true
+				if key == "basefreq" {
+					var f float64
+					if f, err = strconv.ParseFloat(value, 64); err != nil || !(f > 0) || math.IsInf(f, 1) {
+						err = newParseError(KindBadHeader, lineno, raw, value, err, "Invalid BaseFreq")
+						return
+					}
+					cur.baseFreq = f
+					continue
+				}
+			}
+			note, ok := tunNote(key)
+			if !ok {
+				continue
+			}
+			if note < 0 || note > 127 {
+				err = newParseError(KindRange, lineno, raw, line[:eq], nil, "Note must be in 0..127")
+				return
+			}
+			var c float64
+			if c, err = strconv.ParseFloat(value, 64); err != nil {
+				err = newParseError(KindBadTone, lineno, raw, value, err, "Invalid tuning")
+				return
+			}
+			if section == "exact tuning" {
+				cur.exact[note] = c
+			} else {
+				cur.cents[note] = c
+			}
+		case "functional tuning":
+			note, ok := tunNote(key)
+			if !ok {
+				continue
+			}
+			if note < 0 || note > 127 {
+				err = newParseError(KindRange, lineno, raw, line[:eq], nil, "Note must be in 0..127")
+				return
+			}
+			if err = cur.addRule(note, value, lineno, raw); err != nil {
+				return
+			}
+		}
+	}
+	if err = lines.Err(); err != nil {
+		return
+	}
+	if inBlock {
+		err = &ParseError{Line: lineno, Kind: KindIncomplete, Msg: "Missing [Scale End]"}
+		return
+	}
+	if !v2 && cur != nil {
+		blocks = append(blocks, cur)
+	}
+	if len(blocks) == 0 {
+		err = &ParseError{Line: lineno, Kind: KindIncomplete, Msg: "No tuning found"}
+		return
+	}
+
+	for _, b := range blocks {
+		var freqs [128]float64
+		if freqs, err = b.frequencies(); err != nil {
+			return
+		}
+		var s Scale
+		var k KeyboardMapping
+		if s, k, err = ScaleAndMappingFromFrequencies(freqs); err != nil {
+			return
+		}
+		s.Name = name
+		s.Description = b.name
+		var t Tuning
+		if t, err = TuningFromSCLAndKBM(s, k); err != nil {
+			return
+		}
+		tunings = append(tunings, t)
+	}
+	return
+}
+
+// addRule parses a [Functional Tuning] entry for note, and any repeats of it
+func (b *tunBlock) addRule(note int, value string, lineno int, line string) (err error) {
+	bad := func(cause error) error {
+		return newParseError(KindBadTone, lineno, line, value, cause, "Invalid functional tuning")
+	}
+	var rule tunRule
+	rule.lineno = lineno
+	rule.line = line
+	rest := strings.TrimSpace(value)
+	if !strings.HasPrefix(rest, "#") || len(rest) < 2 {
+		return bad(nil)
+	}
+	switch rest[1] {
+	case '=':
+	case '>':
+		rule.relative = true
+	default:
+		return bad(nil)
+	}
+	rest = rest[2:]
+	pct := strings.Index(rest, "%")
+	if pct < 0 {
+		return bad(nil)
+	}
+	if rule.ref, err = strconv.Atoi(strings.TrimSpace(rest[:pct])); err != nil {
+		return bad(err)
+	}
+	rest = rest[pct+1:]
+	repeatTo := note
+	if tilde := strings.Index(rest, "~"); tilde >= 0 {
+		if repeatTo, err = strconv.Atoi(strings.TrimSpace(rest[tilde+1:])); err != nil {
+			return bad(err)
+		}
+		rest = rest[:tilde]
+	}
+	if rule.value, err = strconv.ParseFloat(strings.TrimSpace(rest), 64); err != nil {
+		return bad(err)
+	}
+
+	b.rules[note] = rule
+	if repeatTo > note {
+		b.repeats = append(b.repeats, tunRepeat{from: note + 1, to: repeatTo, rule: rule})
+	}
+	return
+}
+
+// ruleFor returns the [Functional Tuning] entry for note n: its own, or else
+// the last repeat that covers it
+func (b *tunBlock) ruleFor(n int) (rule tunRule, ok bool) {
+	if rule, ok = b.rules[n]; ok {
+		return
+	}
+	for _, r := range b.repeats {
+		if n >= r.from && n <= r.to {
+			rule, ok = r.rule, true
+		}
+	}
+	return
+}
+
+// frequencies evaluates the block
+func (b *tunBlock) frequencies() (freqs [128]float64, err error) {
+	base := b.cents
+	if b.hasExact {
+		base = b.exact
+	}
+	for n := range freqs {
+		c, ok := base[n]
+		if !ok {
+			c = 100.0 * float64(n)
+		}
+		freqs[n] = b.baseFreq * math.Pow(2.0, c/1200.0)
+	}
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	var state [128]int
+	var resolve func(n int) error
+	resolve = func(n int) error {
+		rule, ok := b.ruleFor(n)
+		if !ok || state[n] == done {
+			return nil
+		}
+		lineno := rule.lineno
+		if state[n] == visiting {
+			return newParseError(KindBadTone, lineno, rule.line, "", nil,
+				fmt.Sprintf("Functional tuning of note %d refers back to itself", n))
+		}
+		state[n] = visiting
+		ref := rule.ref
+		if rule.relative {
+			ref += n
+		}
+		switch {
+		case ref < 0 || ref > 127:
+			return newParseError(KindRange, lineno, rule.line, "", nil,
+				fmt.Sprintf("Functional tuning of note %d refers to note %d, outside 0..127", n, ref))
+		case ref == n:
+			if !(rule.value > 0) || math.IsInf(rule.value, 1) {
+				return newParseError(KindRange, lineno, rule.line, "", nil,
+					fmt.Sprintf("Frequency of note %d must be positive", n))
+			}
+			freqs[n] = rule.value
+		default:
+			if err := resolve(ref); err != nil {
+				return err
+			}
+			freqs[n] = freqs[ref] * math.Pow(2.0, rule.value/1200.0)
+		}
+		state[n] = done
+		return nil
+	}
+	for n := range freqs {
+		if err = resolve(n); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// TUNOptions controls WriteTUN
+type TUNOptions struct {
+	Name     string // the [Info] Name; the Description of the tuning's Scale if empty
+	Unmapped UnmappedPolicy
+}
+
+// WriteTUN writes the 128 MIDI notes of t to w as a version 2 AnaMark TUN file. The
+// file has a [Tuning] section of whole cents for version 1 readers and an [Exact
+// Tuning] section which gives every note exactly. When the tuning repeats, every
+// KeyboardMapping().Count notes or, for a mapping of size 0, every Scale().Count
+// notes, and at least twice across the keyboard, a [Functional Tuning] section
+// describes it as one period from the mapping's tuning note, repeated upward and
+// downward. Notes that t leaves unmapped are tuned by opts.Unmapped.
+func WriteTUN(w io.Writer, t Tuning, opts TUNOptions) (err error) {
+	name := opts.Name
+	if name == "" {
+		name = t.Scale().Description
+	}
+	if strings.ContainsAny(name, "\r\n\"") {
+		err = errors.Errorf("TUN name must be a single line without quotes: \"%s\"", name)
+		return
+	}
+	freqs := frequencyTable(t, opts.Unmapped)
+	var cents [128]float64
+	for n, f := range freqs {
+		cents[n] = 1200.0 * math.Log2(f/tunBaseFreq)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "; AnaMark tuning file\n")
+	fmt.Fprintf(bw, "[Scale Begin]\nFormat= \"AnaMark-TUN\"\nFormatVersion= 200\n")
+	fmt.Fprintf(bw, "FormatSpecs= \"http://www.mark-henning.de/eternity/tuningspecs.html\"\n\n")
+	fmt.Fprintf(bw, "[Info]\nName= \"%s\"\n\n", name)
+	fmt.Fprintf(bw, "[Tuning]\n")
+	for n, c := range cents {
+		fmt.Fprintf(bw, "note %d=%d\n", n, int(math.Round(c)))
+	}
+	fmt.Fprintf(bw, "\n[Exact Tuning]\nBaseFreq= %s\n", strconv.FormatFloat(tunBaseFreq, 'f', -1, 64))
+	for n, c := range cents {
+		fmt.Fprintf(bw, "note %d= %s\n", n, tunNumber(c))
+	}
+
+	period := t.KeyboardMapping().Count
+	if period <= 0 {
+		period = t.Scale().Count
+	}
+	if period > 0 && 2*period <= len(cents) && isPeriodic(cents, period, periodTolerance) {
+		writeFunctionalTuning(bw, freqs, cents, period, t.KeyboardMapping().TuningConstantNote)
+	}
+	fmt.Fprintf(bw, "\n[Scale End]\n")
+	err = bw.Flush()
+	return
+}
+
+// writeFunctionalTuning writes the [Functional Tuning] section of a tuning that repeats every
+// period notes. The period of notes holding ref is given from ref, which has its frequency;
+// the notes above and below repeat it.
+func writeFunctionalTuning(w io.Writer, freqs [128]float64, cents [128]float64, period int, ref int) {
+	if ref < 0 || ref > 127 {
+		ref = 60
+	}
+	start := imin(ref, len(cents)-period)
+	interval := cents[period] - cents[0]
+	fmt.Fprintf(w, "\n[Functional Tuning]\n")
+	if start > 0 {
+		fmt.Fprintf(w, "note 0=\"#>%d %% %s ~%d\"\n", period, tunNumber(-interval), start-1)
+	}
+	for n := start; n < start+period; n++ {
+		if n == ref {
+			fmt.Fprintf(w, "note %d=\"#=%d %% %s\"\n", n, n, tunNumber(freqs[n]))
+		} else {
+			fmt.Fprintf(w, "note %d=\"#=%d %% %s\"\n", n, ref, tunNumber(cents[n]-cents[ref]))
+		}
+	}
+	if start+period < len(cents) {
+		fmt.Fprintf(w, "note %d=\"#>-%d %% %s ~%d\"\n", start+period, period, tunNumber(interval), len(cents)-1)
+	}
+}
+
+// tunNumber formats cents or Hz to a billionth, which hides rounding errors
+// in the last bits without changing any frequency audibly
+func tunNumber(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1e9)/1e9, 'f', -1, 64)
+}
@@ -0,0 +1,215 @@
+package scala
+
+import (
+	"gotest.tools/v3/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+// sameTuning checks that two tunings agree on the frequency of every note in the extended range
+func sameTuning(t *testing.T, t1 Tuning, t2 Tuning, lo int, hi int) {
+	t.Helper()
+	for n := lo; n <= hi; n++ {
+		f1, f2 := t1.FrequencyForMidiNote(n), t2.FrequencyForMidiNote(n)
+		assert.Equal(t, "", approxEqual(1e-8*f2, f1, f2), n)
+		assert.Equal(t, "", approxEqual(1e-8, t1.LogScaledFrequencyForMidiNote(n), t2.LogScaledFrequencyForMidiNote(n)), n)
+		assert.Equal(t, t1.IsMidiNoteMapped(n), t2.IsMidiNoteMapped(n))
+	}
+}
+
+// TUN - a version 1 file of whole cents
+func TestTUNVersion1(t *testing.T) {
+	tun, err := TuningFromTUNFile(testFile("tun/standard-v1.tun"))
+	assert.NilError(t, err)
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	sameTuning(t, tun, std, -256, 255)
+	assert.Equal(t, tun.Scale().Count, 12)
+	assert.Equal(t, tun.Scale().Name, testFile("tun/standard-v1.tun"))
+}
+
+// TUN - [Exact Tuning] is preferred to [Tuning]
+func TestTUNExact(t *testing.T) {
+	tun, err := TuningFromTUNFile(testFile("tun/31edo-exact.tun"))
+	assert.NilError(t, err)
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	scl, err := TuningFromSCL(s)
+	assert.NilError(t, err)
+	sameTuning(t, tun, scl, -256, 255)
+	assert.Equal(t, tun.Scale().Description, "31 equal divisions of the octave")
+	assert.Equal(t, tun.Scale().Count, 31)
+}
+
+// TUN - a [Functional Tuning] section
+func TestTUNFunctional(t *testing.T) {
+	tun, err := TuningFromTUNFile(testFile("tun/functional-a432.tun"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingTuneA69To(432)
+	assert.NilError(t, err)
+	a432, err := TuningFromKBM(k)
+	assert.NilError(t, err)
+	sameTuning(t, tun, a432, 0, 127)
+	assert.Equal(t, "", approxEqual(1e-9, tun.FrequencyForMidiNote(69), 432))
+
+	// an entry of its own is not replaced by a repeat
+	tun, err = TuningFromTUNString(`[Functional Tuning]
+note 60="#=60 % 250"
+note 61="#>-1 % 100 ~127"
+note 62="#=60 % 150"
+`)
+	assert.NilError(t, err)
+	assert.Equal(t, "", approxEqual(1e-9, tun.FrequencyForMidiNote(62), 250*math.Pow(2, 1.5/12)))
+	assert.Equal(t, "", approxEqual(1e-9, tun.FrequencyForMidiNote(63), 250*math.Pow(2, 2.5/12)))
+	assert.Equal(t, "", approxEqual(1e-9, tun.FrequencyForMidiNote(59), 8.1757989156437073336*math.Pow(2, 59.0/12)))
+}
+
+// TUN - a version 2 file with several tunings
+func TestTUNMulti(t *testing.T) {
+	tunings, err := TuningsFromTUNFile(testFile("tun/multi.tun"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(tunings), 2)
+	assert.Equal(t, tunings[0].Scale().Description, "Standard")
+	assert.Equal(t, tunings[1].Scale().Description, "Quarter tone")
+	assert.Equal(t, tunings[1].Scale().Count, 24)
+	assert.Equal(t, "", approxEqual(1e-9, tunings[1].FrequencyForMidiNote(60), 261.6255653005986))
+	assert.Equal(t, "", approxEqual(1e-9, tunings[1].FrequencyForMidiNote(84), 2*261.6255653005986))
+	assert.Equal(t, "", approxEqual(1e-9, tunings[1].FrequencyForMidiNote(-108), 261.6255653005986/128))
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	sameTuning(t, tunings[0], std, 0, 127)
+}
+
+// TUN - errors
+func TestTUNErrors(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		kind ErrorKind
+		line int
+	}{
+		{"", KindIncomplete, 0},
+		{"[Scale Begin]\n[Tuning]\nnote 1=100\n", KindIncomplete, 3},
+		{"[Scale End]\n", KindBadHeader, 1},
+		{"[Tuning\n", KindBadHeader, 1},
+		{"[Tuning]\nnote 1 100\n", KindBadCharacter, 2},
+		{"[Tuning]\nnote 1=abc\n", KindBadTone, 2},
+		{"[Tuning]\nnote 128=100\n", KindRange, 2},
+		{"[Exact Tuning]\nBaseFreq=-1\n", KindBadHeader, 2},
+		{"[Functional Tuning]\nnote 1=\"#>-1 100\"\n", KindBadTone, 2},
+		{"[Functional Tuning]\nnote 1=\"#>1 % 100\"\nnote 2=\"#>-1 % 100\"\n", KindBadTone, 2},
+		{"[Functional Tuning]\nnote 1=\"#=200 % 100\"\n", KindRange, 2},
+		{"[Functional Tuning]\nnote 1=\"#=1 % 0\"\n", KindRange, 2},
+	} {
+		_, err := TuningFromTUNString(c.text)
+		pe := parseErrorOf(t, err)
+		assert.Equal(t, pe.Kind, c.kind, c.text)
+		assert.Equal(t, pe.Line, c.line, c.text)
+	}
+}
+
+// TUN - frequencies that do not repeat give a scale spanning the keyboard
+func TestScaleAndMappingFromFrequencies(t *testing.T) {
+	var freqs [128]float64
+	for n := range freqs {
+		freqs[n] = 100 + float64(n*n)
+	}
+	s, k, err := ScaleAndMappingFromFrequencies(freqs)
+	assert.NilError(t, err)
+	assert.Equal(t, s.Count, 127)
+	assert.Equal(t, k.TuningConstantNote, 60)
+	tun, err := TuningFromFrequencies(freqs)
+	assert.NilError(t, err)
+	for n := range freqs {
+		assert.Equal(t, "", approxEqual(1e-9, tun.FrequencyForMidiNote(n), freqs[n]))
+	}
+
+	// steps of 200, 300 and 200 cents, repeating at a fifth
+	for n := range freqs {
+		freqs[n] = 440 * math.Pow(2, (float64(n/3*700)+[]float64{0, 200, 500}[n%3])/1200)
+	}
+	s, _, err = ScaleAndMappingFromFrequencies(freqs)
+	assert.NilError(t, err)
+	assert.Equal(t, s.Count, 3)
+	assert.Equal(t, "", approxEqual(1e-6, s.Tones[2].Cents, 700))
+
+	freqs[3] = 0
+	_, err = TuningFromFrequencies(freqs)
+	assert.ErrorContains(t, err, "note 3")
+}
+
+// tunRoundTrip writes a tuning as TUN and reads it back
+func tunRoundTrip(t *testing.T, tuning Tuning, opts TUNOptions) (text string, back Tuning) {
+	t.Helper()
+	var buf strings.Builder
+	assert.NilError(t, WriteTUN(&buf, tuning, opts))
+	text = buf.String()
+	back, err := TuningFromTUNString(text)
+	assert.NilError(t, err)
+	return
+}
+
+// TUN export - a periodic tuning gets a [Functional Tuning] section
+func TestWriteTUNFunctional(t *testing.T) {
+	s, err := ScaleFromSCLFile(testFile("31edo.scl"))
+	assert.NilError(t, err)
+	k, err := KeyboardMappingTuneA69To(432)
+	assert.NilError(t, err)
+	tuning, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+	text, back := tunRoundTrip(t, tuning, TUNOptions{})
+	assert.Assert(t, strings.Contains(text, "Name= \"31 equal divisions of octave\""))
+	assert.Assert(t, strings.Contains(text, "[Functional Tuning]\nnote 0=\"#>31 % -1200"), text)
+	assert.Assert(t, strings.Contains(text, "note 69=\"#=69 % 432\""), text)
+	sameTuning(t, back, tuning, 0, 127)
+
+	// the functional section alone gives the same tuning
+	functional := "[Scale Begin]\n" + text[strings.Index(text, "[Functional Tuning]"):]
+	back, err = TuningFromTUNString(functional)
+	assert.NilError(t, err)
+	sameTuning(t, back, tuning, 0, 127)
+}
+
+// TUN export - tunings that do not repeat only have a frequency table
+func TestWriteTUNExact(t *testing.T) {
+	var freqs [128]float64
+	for n := range freqs {
+		freqs[n] = 100 + float64(n*n)
+	}
+	tuning, err := TuningFromFrequencies(freqs)
+	assert.NilError(t, err)
+	text, back := tunRoundTrip(t, tuning, TUNOptions{Name: "Squares"})
+	assert.Assert(t, !strings.Contains(text, "[Functional Tuning]"))
+	assert.Assert(t, strings.Contains(text, "Name= \"Squares\""))
+	sameTuning(t, back, tuning, 0, 127)
+
+	// version 1 readers get the nearest cent
+	back, err = TuningFromTUNString(text[:strings.Index(text, "[Exact Tuning]")] + "[Scale End]\n")
+	assert.NilError(t, err)
+	for n := range freqs {
+		assert.Assert(t, math.Abs(1200*math.Log2(back.FrequencyForMidiNote(n)/freqs[n])) <= 0.5)
+	}
+
+	assert.ErrorContains(t, WriteTUN(&strings.Builder{}, tuning, TUNOptions{Name: "a \"b\""}), "single line")
+}
+
+// TUN export - the policies for unmapped notes
+func TestWriteTUNUnmapped(t *testing.T) {
+	k, err := KeyboardMappingFromKBMFile(testFile("mapping-whitekeys-c261.kbm"))
+	assert.NilError(t, err)
+	s, err := ScaleFromSCLFile(testFile("marvel12.scl"))
+	assert.NilError(t, err)
+	tuning, err := TuningFromSCLAndKBM(s, k)
+	assert.NilError(t, err)
+	assert.Assert(t, !tuning.IsMidiNoteMapped(61))
+
+	_, back := tunRoundTrip(t, tuning, TUNOptions{})
+	interpolated := tuning.WithSkippedNotesInterpolated()
+	for n := 0; n < 128; n++ {
+		assert.Assert(t, back.IsMidiNoteMapped(n))
+		assert.Equal(t, "", approxEqual(1e-6, back.FrequencyForMidiNote(n), interpolated.FrequencyForMidiNote(n)))
+	}
+	_, back = tunRoundTrip(t, tuning, TUNOptions{Unmapped: UnmappedStandard})
+	assert.Equal(t, "", approxEqual(1e-6, back.FrequencyForMidiNote(61), 277.1826309768721))
+	assert.Equal(t, "", approxEqual(1e-6, back.FrequencyForMidiNote(62), tuning.FrequencyForMidiNote(62)))
+}
@@ -9,7 +9,7 @@
 package scala
 
 import (
-	"github.com/pkg/errors"
+	"fmt"
 	"math"
 )
 
@@ -120,6 +120,95 @@ func TuningFromKBM(k KeyboardMapping) (t Tuning, err error) {
 	return
 }
 
+// TuningFromFrequencies constructs a tuning which gives the frequency in Hz of each of the
+// 128 MIDI notes. The scale and mapping are those of ScaleAndMappingFromFrequencies.
+func TuningFromFrequencies(freqs [128]float64) (t Tuning, err error) {
+	var s Scale
+	var k KeyboardMapping
+	if s, k, err = ScaleAndMappingFromFrequencies(freqs); err != nil {
+		return
+	}
+	if t, err = TuningFromSCLAndKBM(s, k); err != nil {
+		return
+	}
+	return
+}
+
+// periodTolerance is how far, in cents, the steps of a table of frequencies may
+// stray from repeating exactly and still be taken as periodic
+const periodTolerance = 1e-6
+
+// ScaleAndMappingFromFrequencies returns a scale and mapping that reproduce the frequency
+// in Hz of each of the 128 MIDI notes. The scale starts on note 60, which is also the
+// tuning note, and has as few tones as the frequencies allow, preferring a scale that
+// repeats at the octave: 12-EDO gives a 12 tone scale whose last tone is 1200 cents
+// rather than a single tone of 100 cents. A table with no period gives a 127 tone
+// scale spanning notes 0 to 127, which notes outside that range repeat.
+func ScaleAndMappingFromFrequencies(freqs [128]float64) (s Scale, k KeyboardMapping, err error) {
+	s, k, err = scaleAndMappingFromFrequencies(freqs, periodTolerance)
+	return
+}
+
+// scaleAndMappingFromFrequencies is ScaleAndMappingFromFrequencies for frequencies that are
+// only known to within tolerance cents
+func scaleAndMappingFromFrequencies(freqs [128]float64, tolerance float64) (s Scale, k KeyboardMapping, err error) {
+	var cents [128]float64
+	for i, f := range freqs {
+		if !(f > 0) || math.IsInf(f, 1) {
+			err = &TuningError{Kind: KindRange,
+				Msg: fmt.Sprintf("Unable to tune note %d to a frequency of %v Hz", i, f)}
+			return
+		}
+		cents[i] = 1200.0 * math.Log2(f/freqs[60])
+	}
+	// prefer a scale that repeats at the octave, so that 12-EDO gives 12 tones rather than one
+	period := 127
+	for p := 1; p < period; p++ {
+		if isPeriodic(cents, p, tolerance) && math.Abs(cents[p]-cents[0]-1200.0) <= tolerance {
+			period = p
+			break
+		}
+	}
+	if period == 127 {
+		for p := 1; p < period; p++ {
+			if isPeriodic(cents, p, tolerance) {
+				period = p
+				break
+			}
+		}
+	}
+	interval := cents[period] - cents[0]
+	tones := make([]Tone, period)
+	for i := 1; i <= period; i++ {
+		n := 60 + i
+		shift := 0.0
+		for n > 127 {
+			n -= period
+			shift += interval
+		}
+		tones[i-1] = ToneFromCents(cents[n] + shift)
+	}
+	if s, err = ScaleFromTones("Scale from frequencies", tones); err != nil {
+		return
+	}
+	if k, err = KeyboardMappingStartScaleOnAndTuneNoteTo(60, 60, freqs[60]); err != nil {
+		return
+	}
+	return
+}
+
+// isPeriodic reports whether every note is the same interval, to within tolerance cents,
+// from the note period notes below it
+func isPeriodic(cents [128]float64, period int, tolerance float64) bool {
+	interval := cents[period] - cents[0]
+	for n := period + 1; n < len(cents); n++ {
+		if math.Abs(cents[n]-cents[n-period]-interval) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
 // TuningFromSCLAndKBM constructs a tuning for a particular scale and mapping
 func TuningFromSCLAndKBM(s Scale, k KeyboardMapping) (tuning Tuning, err error) {
 	var t tuningImpl
@@ -127,12 +216,14 @@ func TuningFromSCLAndKBM(s Scale, k KeyboardMapping) (tuning Tuning, err error)
 	t.scale = s
 	t.keyboardMapping = k
 	if s.Count <= 0 {
-		err = errors.Errorf("Unable to tune to a scale with no notes. Your scale provided %v notes.", s.Count)
+		err = &TuningError{Kind: KindEmptyScale,
+			Msg: fmt.Sprintf("Unable to tune to a scale with no notes. Your scale provided %v notes.", s.Count)}
 		return
 	}
 	// From the KBM Spec: When not all scale degrees need to be mapped, the size of the map can be smaller than the size of the scale.
 	if k.OctaveDegrees > s.Count {
-		err = errors.Errorf("Unable to apply mapping of size %d to smaller scale of size %d", k.OctaveDegrees, s.Count)
+		err = &TuningError{Kind: KindMappingTooLarge,
+			Msg: fmt.Sprintf("Unable to apply mapping of size %d to smaller scale of size %d", k.OctaveDegrees, s.Count)}
 		return
 	}
 	var pitches [numPrecomputed]float64
@@ -188,64 +279,7 @@ func TuningFromSCLAndKBM(s Scale, k KeyboardMapping) (tuning Tuning, err error)
 			   int thisRound = (distanceFromScale0-1) % s.count
 			*/
 
-			var rounds int
-			var thisRound int
-			disable := false
-
-			if k.Count == 0 {
-				rounds = (distanceFromScale0 - 1) / s.Count
-				thisRound = (distanceFromScale0 - 1) % s.Count
-			} else {
-				/*
-				 ** Now we have this situation. We are at note i so we
-				 ** are m away from the center note which is distanceFromScale0
-				 **
-				 ** If we mod that by the mapping size we know which note we are on
-				 */
-				mappingKey := distanceFromScale0 % k.Count
-				if mappingKey < 0 {
-					mappingKey += k.Count
-				}
-				// Now have we gone off the end
-				rotations := 0
-				dt := distanceFromScale0
-				if dt > 0 {
-					for dt >= k.Count {
-						dt -= k.Count
-						rotations++
-					}
-				} else {
-					for dt < 0 {
-						dt += k.Count
-						rotations--
-					}
-				}
-
-				cm := k.Keys[mappingKey]
-				push := 0
-				if cm < 0 {
-					disable = true
-				} else {
-					push = mappingKey - cm
-				}
-
-				if k.OctaveDegrees > 0 && k.OctaveDegrees != k.Count {
-					rounds = rotations
-					thisRound = cm - 1
-					if thisRound < 0 {
-						thisRound = k.OctaveDegrees - 1
-						rounds--
-					}
-				} else {
-					rounds = (distanceFromScale0 - push - 1) / s.Count
-					thisRound = (distanceFromScale0 - push - 1) % s.Count
-				}
-			}
-
-			if thisRound < 0 {
-				thisRound += s.Count
-				rounds -= 1
-			}
+			rounds, thisRound, disable := scaleStep(s, k, distanceFromScale0)
 
 			if disable {
 				pitches[i] = 0
@@ -264,6 +298,67 @@ func TuningFromSCLAndKBM(s Scale, k KeyboardMapping) (tuning Tuning, err error)
 	return
 }
 
+// scaleStep returns the tone of s that k maps to the note distanceFromScale0 keys from
+// its middle note: the index thisRound into s.Tones, rounds periods away. disable
+// reports that k leaves the note unmapped.
+func scaleStep(s Scale, k KeyboardMapping, distanceFromScale0 int) (rounds int, thisRound int, disable bool) {
+	if k.Count == 0 {
+		rounds = (distanceFromScale0 - 1) / s.Count
+		thisRound = (distanceFromScale0 - 1) % s.Count
+	} else {
+		/*
+		 ** Now we have this situation. We are at a note so we
+		 ** are m away from the center note which is distanceFromScale0
+		 **
+		 ** If we mod that by the mapping size we know which note we are on
+		 */
+		mappingKey := distanceFromScale0 % k.Count
+		if mappingKey < 0 {
+			mappingKey += k.Count
+		}
+		// Now have we gone off the end
+		rotations := 0
+		dt := distanceFromScale0
+		if dt > 0 {
+			for dt >= k.Count {
+				dt -= k.Count
+				rotations++
+			}
+		} else {
+			for dt < 0 {
+				dt += k.Count
+				rotations--
+			}
+		}
+
+		cm := k.Keys[mappingKey]
+		push := 0
+		if cm < 0 {
+			disable = true
+		} else {
+			push = mappingKey - cm
+		}
+
+		if k.OctaveDegrees > 0 && k.OctaveDegrees != k.Count {
+			rounds = rotations
+			thisRound = cm - 1
+			if thisRound < 0 {
+				thisRound = k.OctaveDegrees - 1
+				rounds--
+			}
+		} else {
+			rounds = (distanceFromScale0 - push - 1) / s.Count
+			thisRound = (distanceFromScale0 - push - 1) % s.Count
+		}
+	}
+
+	if thisRound < 0 {
+		thisRound += s.Count
+		rounds -= 1
+	}
+	return
+}
+
 // Skipped notes can either have nonsense values or interpolated values.
 // The old API made the bad choice to have nonsense values which we retain
 // for compatibility, but this method will return a new tuning with correctly
@@ -289,6 +384,35 @@ func (t tuningImpl) WithSkippedNotesInterpolated() (tuning Tuning) {
 	return res
 }
 
+// UnmappedPolicy selects the frequency that exporters such as WriteTUN give to notes
+// which the keyboard mapping leaves unmapped, since most formats have no way to
+// leave a note out
+type UnmappedPolicy int
+
+const (
+	// UnmappedInterpolate gives unmapped notes the frequencies of WithSkippedNotesInterpolated,
+	// spaced evenly in pitch between the nearest mapped notes
+	UnmappedInterpolate UnmappedPolicy = iota
+	// UnmappedStandard gives unmapped notes their frequency in standard 12-EDO tuning at A=440
+	UnmappedStandard
+)
+
+// frequencyTable returns the frequencies of the 128 MIDI notes, following policy for unmapped notes
+func frequencyTable(t Tuning, policy UnmappedPolicy) (freqs [128]float64) {
+	interpolated := t.WithSkippedNotesInterpolated()
+	for n := range freqs {
+		switch {
+		case t.IsMidiNoteMapped(n):
+			freqs[n] = t.FrequencyForMidiNote(n)
+		case policy == UnmappedStandard:
+			freqs[n] = midi0Freq * math.Pow(2.0, float64(n)/12.0)
+		default:
+			freqs[n] = interpolated.FrequencyForMidiNote(n)
+		}
+	}
+	return
+}
+
 func imin(x int, y int) int {
 	if x < y {
 		return x
@@ -793,6 +793,25 @@ func TestToneAPIValid(tt *testing.T) {
 	assert.Equal(tt, t.FloatValue, math.Log(3.0/1.0)/math.Log(2.0)+1.0)
 }
 
+// Tone API - Labelled Tones
+func TestToneAPILabels(tt *testing.T) {
+	t, err := toneFromString("100.200 with extra stuff", 1)
+	assert.NilError(tt, err)
+	assert.Equal(tt, t.Cents, 100.2)
+	assert.Equal(tt, t.Label, "with extra stuff")
+
+	t, err = toneFromString("  3 / 2\tperfect fifth. ", 1)
+	assert.NilError(tt, err)
+	assert.Equal(tt, t.RatioN, 3)
+	assert.Equal(tt, t.RatioD, 2)
+	assert.Equal(tt, t.Label, "perfect fifth.")
+
+	t, err = toneFromString(" 2 octave", 1)
+	assert.NilError(tt, err)
+	assert.Equal(tt, t.RatioN, 2)
+	assert.Equal(tt, t.Label, "octave")
+}
+
 // Tone API - Error Tones
 func TestToneAPIErrors(tt *testing.T) {
 	var err error
@@ -800,8 +819,6 @@ func TestToneAPIErrors(tt *testing.T) {
 	assert.ErrorContains(tt, err, "Error parsing")
 
 	// the following are commented out in the C++, but test cleanly for Go:
-	_, err = toneFromString("100.200 with extra stuff", 1)
-	assert.ErrorContains(tt, err, "Error parsing")
 	_, err = toneFromString("7/4/2", 1)
 	assert.ErrorContains(tt, err, "Error parsing")
 	_, err = toneFromString("7*2", 1)
@@ -0,0 +1,121 @@
+package scala
+
+import (
+	"github.com/pkg/errors"
+	"math"
+)
+
+// Yamaha's FM synths take microtunings as Yamaha bulk dumps rather than MTS:
+//
+//	F0 43 0n 7E <byte count: 2 bytes> <10 character header> <data> <checksum> F7
+//
+// where n is the device number and the checksum is the two's complement of the sum of the
+// header and data bytes. Each key of the data takes two bytes: a MIDI note number in 13..108
+// and a fine step of 1/64 semitone (about 1.6 cents) in 0..63 above it. Full keyboard tables
+// give all 128 keys; octave tables give the 12 notes from C to B, which repeat every octave.
+
+// YamahaFormat selects a Yamaha microtuning bulk dump
+type YamahaFormat int
+
+const (
+	// YamahaDX7IIKeyboard for the full keyboard micro tuning of the DX7II, DX7s and TX802
+	YamahaDX7IIKeyboard YamahaFormat = iota
+	// YamahaTX81ZOctave for the octave micro tuning of the TX81Z, DX11 and V50
+	YamahaTX81ZOctave
+	// YamahaTX81ZKeyboard for the full keyboard micro tuning of the TX81Z, DX11 and V50
+	YamahaTX81ZKeyboard
+)
+
+// YamahaOptions controls YamahaMicrotuning
+type YamahaOptions struct {
+	Format   YamahaFormat
+	Device   int            // the device number 0..15, usually the MIDI channel less 1
+	Memory   int            // YamahaDX7IIKeyboard: 0 for the edit buffer, or internal memory 1 or 2
+	Unmapped UnmappedPolicy // the tuning of notes that the Tuning leaves unmapped
+}
+
+// The range of a key's tuning
+const (
+	yamahaLowest  = 13.0
+	yamahaHighest = 108.0 + 63.0/64.0
+)
+
+// yamahaPitch returns the note and fine step nearest to semitones, a MIDI note number
+// with a fraction, and the error in cents
+func yamahaPitch(semitones float64) (data [2]byte, errCents float64) {
+	target := semitones
+	semitones = math.Min(math.Max(semitones, yamahaLowest), yamahaHighest)
+	note := math.Floor(semitones)
+	fine := math.Round((semitones - note) * 64.0)
+	if fine >= 64 {
+		note++
+		fine = 0
+	}
+	data = [2]byte{byte(note), byte(fine)}
+	errCents = 100.0 * (note + fine/64.0 - target)
+	return
+}
+
+// YamahaMicrotuning returns t as a Yamaha microtuning bulk dump of opts.Format, and the
+// error in cents of each of the 128 notes, which is the encoded pitch less the pitch of t.
+// An octave table takes the tuning of the octave from middle C, so the error is large
+// for notes of tunings that do not repeat at the octave.
+func YamahaMicrotuning(t Tuning, opts YamahaOptions) (msg []byte, errs [128]float64, err error) {
+	if opts.Device < 0 || opts.Device > 15 {
+		err = errors.Errorf("Yamaha device number must be in 0..15: %d", opts.Device)
+		return
+	}
+	var header string
+	switch opts.Format {
+	case YamahaDX7IIKeyboard:
+		switch opts.Memory {
+		case 0:
+			header = "LM  MCRYE "
+		case 1, 2:
+			header = "LM  MCRYM" + string(rune('0'+opts.Memory-1))
+		default:
+			err = errors.Errorf("DX7II micro tuning memory must be 0 (edit buffer), 1 or 2: %d", opts.Memory)
+			return
+		}
+	case YamahaTX81ZOctave:
+		header = "LM  MCRTE0"
+	case YamahaTX81ZKeyboard:
+		header = "LM  MCRTE1"
+	default:
+		err = errors.Errorf("Unknown Yamaha microtuning format %d", int(opts.Format))
+		return
+	}
+
+	var semitones [128]float64
+	for n, f := range frequencyTable(t, opts.Unmapped) {
+		semitones[n] = 69.0 + 12.0*math.Log2(f/440.0)
+	}
+	body := []byte(header)
+	if opts.Format == YamahaTX81ZOctave {
+		var sent [12]float64
+		for pc := 0; pc < 12; pc++ {
+			data, _ := yamahaPitch(semitones[60+pc])
+			sent[pc] = float64(data[0]) + float64(data[1])/64.0
+			body = append(body, data[:]...)
+		}
+		for n := range errs {
+			octave := float64(n/12 - 5)
+			errs[n] = 100.0 * (sent[n%12] + 12.0*octave - semitones[n])
+		}
+	} else {
+		for n := range semitones {
+			var data [2]byte
+			data, errs[n] = yamahaPitch(semitones[n])
+			body = append(body, data[:]...)
+		}
+	}
+
+	var sum int
+	for _, b := range body {
+		sum += int(b)
+	}
+	msg = []byte{0xF0, 0x43, byte(opts.Device), 0x7E, byte(len(body) >> 7), byte(len(body) & 0x7F)}
+	msg = append(msg, body...)
+	msg = append(msg, byte(-sum)&0x7F, 0xF7)
+	return
+}
@@ -0,0 +1,102 @@
+package scala
+
+import (
+	"gotest.tools/v3/assert"
+	"math"
+	"testing"
+)
+
+// Yamaha - pitch encoding
+func TestYamahaPitch(t *testing.T) {
+	for _, c := range []struct {
+		semitones float64
+		data      [2]byte
+		err       float64
+	}{
+		{69, [2]byte{69, 0}, 0},
+		{69.5, [2]byte{69, 32}, 0},
+		{69.999, [2]byte{70, 0}, 0.1},
+		{69 + 1.0/128 - 0.0001, [2]byte{69, 0}, -0.77},
+		{0, [2]byte{13, 0}, 1300},
+		{120, [2]byte{108, 63}, -1101.6},
+	} {
+		data, errCents := yamahaPitch(c.semitones)
+		assert.Equal(t, data, c.data, c.semitones)
+		assert.Equal(t, "", approxEqual(0.1, errCents, c.err), c.semitones)
+	}
+}
+
+func checkYamahaMessage(t *testing.T, msg []byte, header string, size int) {
+	t.Helper()
+	assert.Equal(t, len(msg), 6+10+2*size+2)
+	assert.DeepEqual(t, msg[:4], []byte{0xF0, 0x43, 0x02, 0x7E})
+	assert.Equal(t, int(msg[4])<<7|int(msg[5]), 10+2*size)
+	assert.Equal(t, string(msg[6:16]), header)
+	var sum int
+	for _, b := range msg[6 : len(msg)-1] {
+		sum += int(b)
+	}
+	assert.Equal(t, sum&0x7F, 0)
+	assert.Equal(t, msg[len(msg)-1], byte(0xF7))
+}
+
+// Yamaha - full keyboard tables
+func TestYamahaKeyboard(t *testing.T) {
+	k, err := KeyboardMappingTuneA69To(432)
+	assert.NilError(t, err)
+	a432, err := TuningFromKBM(k)
+	assert.NilError(t, err)
+
+	msg, errs, err := YamahaMicrotuning(a432, YamahaOptions{Device: 2, Memory: 2})
+	assert.NilError(t, err)
+	checkYamahaMessage(t, msg, "LM  MCRYM1", 128)
+	// 432 Hz is 31.77 cents below A440: 68 + 44/64 semitones
+	assert.DeepEqual(t, msg[16+2*69:18+2*69], []byte{68, 44})
+	assert.Equal(t, "", approxEqual(0.01, errs[69], 100*(68+44.0/64)-6900+100*12*math.Log2(440.0/432)))
+	for n := 14; n <= 108; n++ {
+		assert.Assert(t, math.Abs(errs[n]) <= 100.0/128, n)
+	}
+	assert.Assert(t, errs[0] > 100)
+
+	msg, _, err = YamahaMicrotuning(a432, YamahaOptions{Device: 2})
+	assert.NilError(t, err)
+	checkYamahaMessage(t, msg, "LM  MCRYE ", 128)
+	msg, _, err = YamahaMicrotuning(a432, YamahaOptions{Format: YamahaTX81ZKeyboard, Device: 2})
+	assert.NilError(t, err)
+	checkYamahaMessage(t, msg, "LM  MCRTE1", 128)
+}
+
+// Yamaha - octave tables
+func TestYamahaOctave(t *testing.T) {
+	ascl, err := AbletonScaleFromASCLFile(testFile("meantone.ascl"))
+	assert.NilError(t, err)
+	meantone, err := ascl.Tuning()
+	assert.NilError(t, err)
+	msg, errs, err := YamahaMicrotuning(meantone, YamahaOptions{Format: YamahaTX81ZOctave, Device: 2})
+	assert.NilError(t, err)
+	checkYamahaMessage(t, msg, "LM  MCRTE0", 12)
+	assert.DeepEqual(t, msg[16+2*9:18+2*9], []byte{69, 0})
+	for n := range errs {
+		assert.Assert(t, math.Abs(errs[n]) <= 100.0/128, n)
+	}
+
+	s, err := ScaleEvenDivisionOfSpanByM(3, 13)
+	assert.NilError(t, err)
+	bp, err := TuningFromSCL(s)
+	assert.NilError(t, err)
+	_, errs, err = YamahaMicrotuning(bp, YamahaOptions{Format: YamahaTX81ZOctave})
+	assert.NilError(t, err)
+	assert.Assert(t, math.Abs(errs[100]) > 10)
+}
+
+// Yamaha - errors
+func TestYamahaErrors(t *testing.T) {
+	std, err := TuningEvenStandard()
+	assert.NilError(t, err)
+	_, _, err = YamahaMicrotuning(std, YamahaOptions{Device: 16})
+	assert.ErrorContains(t, err, "device number")
+	_, _, err = YamahaMicrotuning(std, YamahaOptions{Memory: 3})
+	assert.ErrorContains(t, err, "memory")
+	_, _, err = YamahaMicrotuning(std, YamahaOptions{Format: 9})
+	assert.ErrorContains(t, err, "Unknown Yamaha")
+}